@@ -0,0 +1,82 @@
+package acceptance_test
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/gomega"
+)
+
+// writeInputTile zips a tile with the given metadata and the fixture release
+// embedded under embed/windowsfs-release.
+func writeInputTile(path, metadata string) {
+	f, err := os.Create(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+
+	w, err := zw.Create("metadata/windows.yml")
+	Expect(err).NotTo(HaveOccurred())
+	_, err = w.Write([]byte(metadata))
+	Expect(err).NotTo(HaveOccurred())
+
+	releaseDir := "../release/fixtures/windowsfs-release"
+	err = filepath.Walk(releaseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(releaseDir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = "embed/windowsfs-release/" + filepath.ToSlash(rel)
+		header.Method = zip.Deflate
+
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(w, src)
+		return err
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	Expect(zw.Close()).To(Succeed())
+}
+
+func readZip(path string) map[string][]byte {
+	zr, err := zip.OpenReader(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer zr.Close()
+
+	entries := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		Expect(err).NotTo(HaveOccurred())
+
+		contents, err := ioutil.ReadAll(rc)
+		Expect(err).NotTo(HaveOccurred())
+		rc.Close()
+
+		entries[f.Name] = contents
+	}
+
+	return entries
+}
@@ -1,12 +1,20 @@
 package acceptance_test
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
+	"github.com/pivotal-cf/winfs-injector/internal/testhelpers"
 )
 
 var _ = Describe("acceptance", func() {
@@ -55,7 +63,187 @@ var _ = Describe("acceptance", func() {
   --input-tile, -i   path to input tile (example: /path/to/input.pivotal)
   --output-tile, -o  path to output tile (example: /path/to/output.pivotal)
   --registry, -r     path to docker registry (example: /path/to/registry, default: "https://registry.hub.docker.com")
+  --image-digest     manifest digest the rootfs image must resolve to (example: sha256:4b2d...)
+  --image-lock       path to a lock file pinning the rootfs image digest (example: /path/to/image-lock.yml)
+  --cache-dir        path to a directory caching image layers between runs (example: /path/to/cache)
+  --parallelism      number of image layers downloaded at the same time (default: 4)
+  --max-bandwidth    caps the combined download rate per second (example: 20MB)
+  --os-version       windows build selected from multi-platform images (example: 10.0.17763, default: derived from the image tag)
+  --foreign-layers   how foreign base layers are handled: include, skip or require-mirror (default: include)
+  --gzip-level       compression of the release tarball: 1-9, fastest, default or best (default: default)
+  --gzip-workers     number of blocks of the release tarball compressed in parallel (default: number of CPUs)
+  --release-tarball  prebuilt windowsfs release injected instead of building one (example: /path/to/windows2019fs-9.3.6.tgz)
+  --export-release   directory receiving a copy of the release tarball with its checksums (example: /path/to/export)
+  --metadata-ops-file
+                     go-patch ops file applied to the product metadata after the release is added, can be repeated (example: /path/to/ops.yml)
+  --version-suffix   appended to the product_version of the tile, so injected tiles can be told apart (example: +winfs)
+  --allow-mismatch   warns instead of failing when the rootfs image is built for another Windows build than the stemcell of the tile
+  --metadata-file    product metadata inside the tile, instead of discovering it in metadata/ (example: metadata/windows.yml)
+  --replace-release  replaces a windowsfs release the tile metadata already lists with another version, instead of failing
+  --reproducible     identical inputs produce byte-identical release tarballs and tiles, dated $SOURCE_DATE_EPOCH (default: 1980-01-01)
   --help, -h         prints this usage information`))
 		})
+
+		Describe("injecting the rootfs", func() {
+			var (
+				tmpDir   string
+				registry *testhelpers.Registry
+			)
+
+			BeforeEach(func() {
+				if runtime.GOOS != "linux" {
+					Skip("the injection is run with an empty PATH on linux only")
+				}
+
+				var err error
+				tmpDir, err = ioutil.TempDir("", "")
+				Expect(err).NotTo(HaveOccurred())
+
+				inputTile = filepath.Join(tmpDir, "input.pivotal")
+				outputTile = filepath.Join(tmpDir, "output.pivotal")
+				writeInputTile(inputTile, "name: windows2019\nproduct_version: 2.11.0\nreleases: []\n")
+
+				registry = testhelpers.NewRegistry("cloudfoundry/windows2016fs")
+				registry.AddImage("2019.0.43", []byte("rootfs-layer"))
+			})
+
+			AfterEach(func() {
+				if registry != nil {
+					registry.Close()
+				}
+				Expect(os.RemoveAll(tmpDir)).To(Succeed())
+			})
+
+			It("injects the release without any external binaries", func() {
+				cmd = exec.Command(winfsInjector, "-i", inputTile, "-o", outputTile, "-r", registry.URL())
+				cmd.Env = []string{"PATH=", "TMPDIR=" + tmpDir}
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session, 30*time.Second).Should(gexec.Exit(0))
+
+				entries := readZip(outputTile)
+				Expect(entries).To(HaveKey("releases/windows2019fs-9.3.6.tgz"))
+				Expect(string(entries["metadata/windows.yml"])).To(ContainSubstring("file: windows2019fs-9.3.6.tgz"))
+				Expect(string(entries["metadata/windows.yml"])).To(ContainSubstring(fmt.Sprintf("sha1: %x", sha1.Sum(entries["releases/windows2019fs-9.3.6.tgz"]))))
+				for name := range entries {
+					Expect(name).NotTo(HavePrefix("embed/windowsfs-release"))
+				}
+			})
+
+			It("applies metadata ops files after adding the release", func() {
+				opsFile := filepath.Join(tmpDir, "ops.yml")
+				Expect(ioutil.WriteFile(opsFile, []byte("- type: replace\n  path: /releases/name=windows2019fs/url?\n  value: https://example.com/windows2019fs.tgz\n"), 0644)).To(Succeed())
+
+				cmd = exec.Command(winfsInjector, "-i", inputTile, "-o", outputTile, "-r", registry.URL(), "--metadata-ops-file", opsFile)
+				cmd.Env = []string{"PATH=", "TMPDIR=" + tmpDir}
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session, 30*time.Second).Should(gexec.Exit(0))
+
+				Expect(string(readZip(outputTile)["metadata/windows.yml"])).To(ContainSubstring("url: https://example.com/windows2019fs.tgz"))
+			})
+
+			It("reports what the injection changed in the tile", func() {
+				cmd = exec.Command(winfsInjector, "-i", inputTile, "-o", outputTile, "-r", registry.URL())
+				cmd.Env = []string{"PATH=", "TMPDIR=" + tmpDir}
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session, 30*time.Second).Should(gexec.Exit(0))
+
+				cmd = exec.Command(winfsInjector, "diff", inputTile, outputTile)
+				session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(1))
+
+				output := string(session.Out.Contents())
+				Expect(output).To(ContainSubstring("  + releases/windows2019fs-9.3.6.tgz: "))
+				Expect(output).To(ContainSubstring("  - embed/windowsfs-release/VERSION: "))
+				Expect(output).To(ContainSubstring("Product metadata (metadata/windows.yml):\n  + releases[windows2019fs]: {file: windows2019fs-9.3.6.tgz, "))
+			})
+
+			It("removes and adds releases", func() {
+				cmd = exec.Command(winfsInjector, "-i", inputTile, "-o", outputTile, "-r", registry.URL())
+				cmd.Env = []string{"PATH=", "TMPDIR=" + tmpDir}
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session, 30*time.Second).Should(gexec.Exit(0))
+
+				releaseTarball := filepath.Join(tmpDir, "windows2019fs-9.3.6.tgz")
+				Expect(ioutil.WriteFile(releaseTarball, readZip(outputTile)["releases/windows2019fs-9.3.6.tgz"], 0644)).To(Succeed())
+
+				cmd = exec.Command(winfsInjector, "remove-release", "--tile", outputTile, "--release", "windows2019fs")
+				session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+
+				entries := readZip(outputTile)
+				Expect(entries).NotTo(HaveKey("releases/windows2019fs-9.3.6.tgz"))
+				Expect(string(entries["metadata/windows.yml"])).NotTo(ContainSubstring("windows2019fs"))
+
+				cmd = exec.Command(winfsInjector, "add-release", "--tile", outputTile, "--release", releaseTarball)
+				session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(string(session.Out.Contents())).To(ContainSubstring("Added release windows2019fs version 9.3.6"))
+
+				entries = readZip(outputTile)
+				releaseContents, err := ioutil.ReadFile(releaseTarball)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(entries["releases/windows2019fs-9.3.6.tgz"]).To(Equal(releaseContents))
+				Expect(string(entries["metadata/windows.yml"])).To(ContainSubstring(fmt.Sprintf("sha1: %x", sha1.Sum(entries["releases/windows2019fs-9.3.6.tgz"]))))
+			})
+
+			It("produces identical tiles from independent reproducible runs", func() {
+				var tiles [][]byte
+				for i := 0; i < 2; i++ {
+					outputTile := filepath.Join(tmpDir, fmt.Sprintf("output-%d.pivotal", i))
+					cmd = exec.Command(winfsInjector, "-i", inputTile, "-o", outputTile, "-r", registry.URL(), "--reproducible")
+					cmd.Env = []string{"PATH=", "TMPDIR=" + tmpDir, "SOURCE_DATE_EPOCH=1622548800"}
+					session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(session, 30*time.Second).Should(gexec.Exit(0))
+
+					contents, err := ioutil.ReadFile(outputTile)
+					Expect(err).NotTo(HaveOccurred())
+					tiles = append(tiles, contents)
+
+					// Entries written within the same second would hide
+					// timestamps that are not normalized.
+					time.Sleep(time.Second)
+				}
+
+				Expect(sha256.Sum256(tiles[1])).To(Equal(sha256.Sum256(tiles[0])))
+			})
+		})
+
+		Describe("cache", func() {
+			var cacheDir string
+
+			BeforeEach(func() {
+				var err error
+				cacheDir, err = ioutil.TempDir("", "")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(cacheDir)).To(Succeed())
+			})
+
+			It("lists the cached layers", func() {
+				cmd = exec.Command(winfsInjector, "cache", "ls", "--cache-dir", cacheDir)
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(string(session.Out.Contents())).To(ContainSubstring("0 layers, 0 B"))
+			})
+
+			It("requires a limit to prune the cache", func() {
+				cmd = exec.Command(winfsInjector, "cache", "prune", "--cache-dir", cacheDir)
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(string(session.Err.Contents())).To(ContainSubstring("--max-size or --max-age is required"))
+			})
+		})
 	})
 })
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pivotal-cf/jhanda"
+	"github.com/pivotal-cf/winfs-injector/image"
+)
+
+const cacheUsageText = `winfs-injector cache manages the image layer cache shared between runs.
+
+Usage: winfs-injector cache <ls|prune>
+  --cache-dir        path to the image layer cache (example: /path/to/cache)
+  --max-size         prune: least recently used layers are removed until the cache fits (example: 50GB)
+  --max-age          prune: layers not used within this duration are removed (example: 720h)
+  --help, -h         prints this usage information
+`
+
+func runCache(args []string) error {
+	var arguments struct {
+		CacheDir string        `long:"cache-dir"`
+		MaxSize  string        `long:"max-size"`
+		MaxAge   time.Duration `long:"max-age"`
+		Help     bool          `short:"h" long:"help"`
+	}
+
+	var command string
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	_, err := jhanda.Parse(&arguments, args)
+	if err != nil {
+		return err
+	}
+
+	if arguments.Help || command == "" || command == "--help" || command == "-h" {
+		fmt.Fprint(os.Stdout, cacheUsageText)
+		return nil
+	}
+
+	if arguments.CacheDir == "" {
+		return errors.New("--cache-dir is required")
+	}
+
+	cache := image.NewCache(arguments.CacheDir)
+
+	switch command {
+	case "ls":
+		entries, err := cache.List()
+		if err != nil {
+			return err
+		}
+
+		printCacheEntries(entries)
+		return nil
+	case "prune":
+		var maxSize uint64
+
+		if arguments.MaxSize == "" && arguments.MaxAge == 0 {
+			return errors.New("--max-size or --max-age is required")
+		}
+
+		if arguments.MaxSize != "" {
+			maxSize, err = humanize.ParseBytes(arguments.MaxSize)
+			if err != nil {
+				return fmt.Errorf("invalid --max-size: %s", err)
+			}
+		}
+
+		removed, err := cache.Prune(int64(maxSize), arguments.MaxAge)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stdout, "Removed %d layers from %s\n", len(removed), cache.Dir())
+		printCacheEntries(removed)
+		return nil
+	default:
+		return fmt.Errorf("unknown cache command: %s", command)
+	}
+}
+
+func printCacheEntries(entries []image.CacheEntry) {
+	var totalSize int64
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tSIZE\tLAST USED")
+	for _, entry := range entries {
+		totalSize += entry.Size
+		fmt.Fprintf(w, "%s\t%s\t%s\n", entry.Digest, humanize.Bytes(uint64(entry.Size)), entry.LastUsed.Format(time.RFC3339))
+	}
+	w.Flush()
+
+	fmt.Fprintf(os.Stdout, "%d layers, %s\n", len(entries), humanize.Bytes(uint64(totalSize)))
+}
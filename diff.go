@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/pivotal-cf/jhanda"
+	"github.com/pivotal-cf/winfs-injector/tile"
+)
+
+const diffUsageText = `winfs-injector diff compares the files and the product metadata of two tiles.
+
+Usage: winfs-injector diff <old-tile> <new-tile>
+  --help, -h         prints this usage information
+
+Files are compared by size and CRC. The exit status is 0 when the tiles are
+the same, 1 when they differ and 2 on errors.
+`
+
+// runDiff prints the differences between two tiles, and tells whether there
+// are any.
+func runDiff(args []string) (bool, error) {
+	var arguments struct {
+		Help bool `short:"h" long:"help"`
+	}
+
+	tiles, err := jhanda.Parse(&arguments, args)
+	if err != nil {
+		return false, err
+	}
+
+	if arguments.Help {
+		fmt.Fprint(os.Stdout, diffUsageText)
+		return false, nil
+	}
+
+	if len(tiles) != 2 {
+		return false, errors.New("expected the paths of two tiles to compare")
+	}
+
+	diff, err := tile.NewZipper().Diff(tiles[0], tiles[1])
+	if err != nil {
+		return false, err
+	}
+
+	if diff.Empty() {
+		fmt.Fprintln(os.Stdout, "The tiles have the same files and product metadata")
+		return false, nil
+	}
+
+	if len(diff.Files) > 0 {
+		fmt.Fprintln(os.Stdout, "Files:")
+		for _, change := range diff.Files {
+			fmt.Fprintf(os.Stdout, "  %s\n", change)
+		}
+	}
+
+	if len(diff.Metadata) > 0 {
+		metadataFile := diff.OldMetadataFile
+		if diff.NewMetadataFile != diff.OldMetadataFile {
+			metadataFile = fmt.Sprintf("%s -> %s", diff.OldMetadataFile, diff.NewMetadataFile)
+		}
+
+		fmt.Fprintf(os.Stdout, "Product metadata (%s):\n", metadataFile)
+		for _, change := range diff.Metadata {
+			fmt.Fprintf(os.Stdout, "  %s\n", change)
+		}
+	}
+
+	return true, nil
+}
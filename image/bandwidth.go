@@ -0,0 +1,62 @@
+package image
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const bandwidthChunkSize = 32 * 1024
+
+// bandwidthLimiter caps the combined throughput of every reader it wraps.
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+
+	mutex sync.Mutex
+	next  time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+func (l *bandwidthLimiter) reader(r io.Reader) io.Reader {
+	return limitedReader{reader: r, limiter: l}
+}
+
+// wait blocks until n more bytes may be transferred without exceeding the
+// limit.
+func (l *bandwidthLimiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	l.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunkSize {
+		p = p[:bandwidthChunkSize]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
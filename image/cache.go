@@ -0,0 +1,216 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const staleCacheTempFileAge = 24 * time.Hour
+
+// Cache is a content-addressable store of image layers shared between runs.
+// Blobs are written to a temporary file and atomically renamed into place,
+// and all access to a blob is serialised across processes with a file lock.
+type Cache struct {
+	dir string
+}
+
+type CacheEntry struct {
+	Digest   digest.Digest
+	Size     int64
+	LastUsed time.Time
+}
+
+func NewCache(dir string) Cache {
+	return Cache{dir: dir}
+}
+
+func (c Cache) Dir() string {
+	return c.dir
+}
+
+func (c Cache) blobsDir() string {
+	return filepath.Join(c.dir, "blobs", "sha256")
+}
+
+func (c Cache) locksDir() string {
+	return filepath.Join(c.dir, "locks")
+}
+
+func (c Cache) tmpDir() string {
+	return filepath.Join(c.dir, "tmp")
+}
+
+func (c Cache) blobPath(d digest.Digest) string {
+	return filepath.Join(c.blobsDir(), d.Encoded())
+}
+
+func (c Cache) init() error {
+	for _, dir := range []string{c.blobsDir(), c.locksDir(), c.tmpDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("unable to create cache directory: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Lock takes an exclusive lock on the blob with the given digest. The returned
+// function releases it.
+func (c Cache) Lock(d digest.Digest) (func(), error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(c.locksDir(), d.Encoded()+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to lock cache entry %s: %s", d, err)
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// Open returns the cached blob with the given digest, or an error satisfying
+// os.IsNotExist when it is not cached. Opening a blob marks it as used.
+func (c Cache) Open(d digest.Digest) (*os.File, error) {
+	path := c.blobPath(d)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return f, nil
+}
+
+// Write stores the blob produced by write under the given digest. The blob
+// only becomes visible once write has returned successfully.
+func (c Cache) Write(d digest.Digest, write func(*os.File) error) error {
+	if err := c.init(); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(c.tmpDir(), d.Encoded())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.blobPath(d))
+}
+
+func (c Cache) Remove(d digest.Digest) error {
+	err := os.Remove(c.blobPath(d))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the cached blobs, least recently used first.
+func (c Cache) List() ([]CacheEntry, error) {
+	files, err := ioutil.ReadDir(c.blobsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []CacheEntry
+	for _, file := range files {
+		d := digest.NewDigestFromEncoded(digest.SHA256, file.Name())
+		if file.IsDir() || d.Validate() != nil {
+			continue
+		}
+
+		entries = append(entries, CacheEntry{
+			Digest:   d,
+			Size:     file.Size(),
+			LastUsed: file.ModTime(),
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+
+	return entries, nil
+}
+
+// Prune removes blobs that have not been used within maxAge, and then the
+// least recently used blobs until the cache is no larger than maxSize. A zero
+// maxAge or maxSize disables that limit. Temporary files abandoned by
+// interrupted downloads are removed as well.
+func (c Cache) Prune(maxSize int64, maxAge time.Duration) ([]CacheEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var totalSize int64
+	for _, entry := range entries {
+		totalSize += entry.Size
+	}
+
+	now := time.Now()
+
+	var removed []CacheEntry
+	for _, entry := range entries {
+		expired := maxAge > 0 && now.Sub(entry.LastUsed) > maxAge
+		oversized := maxSize > 0 && totalSize > maxSize
+		if !expired && !oversized {
+			continue
+		}
+
+		unlock, err := c.Lock(entry.Digest)
+		if err != nil {
+			return removed, err
+		}
+		err = c.Remove(entry.Digest)
+		unlock()
+		if err != nil {
+			return removed, err
+		}
+
+		totalSize -= entry.Size
+		removed = append(removed, entry)
+	}
+
+	tmpFiles, err := ioutil.ReadDir(c.tmpDir())
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	for _, file := range tmpFiles {
+		if now.Sub(file.ModTime()) > staleCacheTempFileAge {
+			os.Remove(filepath.Join(c.tmpDir(), file.Name()))
+		}
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,192 @@
+package image_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pivotal-cf/winfs-injector/image"
+)
+
+var _ = Describe("Cache", func() {
+	var (
+		cacheDir string
+		cache    image.Cache
+	)
+
+	BeforeEach(func() {
+		var err error
+		cacheDir, err = ioutil.TempDir("", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		cache = image.NewCache(cacheDir)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(cacheDir)).To(Succeed())
+	})
+
+	write := func(contents string, lastUsed time.Time) digest.Digest {
+		d := digest.FromString(contents)
+		Expect(cache.Write(d, func(w *os.File) error {
+			_, err := io.WriteString(w, contents)
+			return err
+		})).To(Succeed())
+
+		path := filepath.Join(cacheDir, "blobs", "sha256", d.Encoded())
+		Expect(os.Chtimes(path, lastUsed, lastUsed)).To(Succeed())
+
+		return d
+	}
+
+	Describe("Write", func() {
+		It("stores the blob under its digest", func() {
+			d := write("some-layer", time.Now())
+
+			f, err := cache.Open(d)
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+
+			contents, err := ioutil.ReadAll(f)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("some-layer"))
+		})
+
+		It("does not store the blob when writing it fails", func() {
+			d := digest.FromString("some-layer")
+			err := cache.Write(d, func(w *os.File) error {
+				io.WriteString(w, "some-")
+				return errors.New("connection reset")
+			})
+			Expect(err).To(MatchError("connection reset"))
+
+			_, err = cache.Open(d)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			tmpFiles, err := ioutil.ReadDir(filepath.Join(cacheDir, "tmp"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tmpFiles).To(BeEmpty())
+		})
+	})
+
+	Describe("Lock", func() {
+		It("serialises access to a blob", func() {
+			d := digest.FromString("some-layer")
+
+			var (
+				wg      sync.WaitGroup
+				mutex   sync.Mutex
+				holders int
+				maximum int
+			)
+
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+
+					unlock, err := cache.Lock(d)
+					Expect(err).NotTo(HaveOccurred())
+
+					mutex.Lock()
+					holders++
+					if holders > maximum {
+						maximum = holders
+					}
+					mutex.Unlock()
+
+					time.Sleep(10 * time.Millisecond)
+
+					mutex.Lock()
+					holders--
+					mutex.Unlock()
+
+					unlock()
+				}()
+			}
+
+			wg.Wait()
+			Expect(maximum).To(Equal(1))
+		})
+	})
+
+	Describe("List", func() {
+		It("lists cached blobs, least recently used first", func() {
+			newer := write("newer-layer", time.Now().Add(-time.Hour))
+			older := write("older-layer", time.Now().Add(-48*time.Hour))
+
+			entries, err := cache.List()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(entries).To(HaveLen(2))
+			Expect(entries[0].Digest).To(Equal(older))
+			Expect(entries[0].Size).To(Equal(int64(len("older-layer"))))
+			Expect(entries[1].Digest).To(Equal(newer))
+		})
+
+		It("returns nothing when the cache does not exist yet", func() {
+			entries, err := image.NewCache(filepath.Join(cacheDir, "missing")).List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(BeEmpty())
+		})
+	})
+
+	Describe("Prune", func() {
+		var (
+			oldest digest.Digest
+			older  digest.Digest
+			recent digest.Digest
+		)
+
+		BeforeEach(func() {
+			oldest = write("0123456789", time.Now().Add(-72*time.Hour))
+			older = write("abcdefghij", time.Now().Add(-48*time.Hour))
+			recent = write("ABCDEFGHIJ", time.Now().Add(-time.Minute))
+		})
+
+		It("removes blobs that have not been used within the max age", func() {
+			removed, err := cache.Prune(0, 60*time.Hour)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(removed).To(HaveLen(1))
+			Expect(removed[0].Digest).To(Equal(oldest))
+
+			entries, err := cache.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(2))
+		})
+
+		It("removes the least recently used blobs until the cache fits the max size", func() {
+			removed, err := cache.Prune(15, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(removed).To(HaveLen(2))
+			Expect(removed[0].Digest).To(Equal(oldest))
+			Expect(removed[1].Digest).To(Equal(older))
+
+			entries, err := cache.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Digest).To(Equal(recent))
+		})
+
+		It("removes abandoned temporary files", func() {
+			abandoned := filepath.Join(cacheDir, "tmp", "abandoned")
+			Expect(ioutil.WriteFile(abandoned, []byte("partial"), 0644)).To(Succeed())
+			Expect(os.Chtimes(abandoned, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))).To(Succeed())
+
+			_, err := cache.Prune(0, 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(abandoned).NotTo(BeAnExistingFile())
+		})
+	})
+})
@@ -0,0 +1,212 @@
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	maxDownloadAttempts = 5
+	initialBackoff      = time.Second
+	maxBackoff          = time.Minute
+)
+
+var sleep = sleepContext
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+type downloader struct {
+	registry      *registry
+	logger        *log.Logger
+	limiter       *bandwidthLimiter
+	foreignLayers ForeignLayerPolicy
+}
+
+// retry calls fn until it succeeds, fails in a way that retrying cannot fix,
+// has been attempted maxDownloadAttempts times or ctx is done. Attempts are
+// spaced with exponential backoff, unless the server asked for a specific
+// delay with Retry-After.
+func (d downloader) retry(ctx context.Context, description string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil || !retryable(err) || attempt >= maxDownloadAttempts {
+			return err
+		}
+
+		wait := backoff(attempt)
+		var status statusError
+		if errors.As(err, &status) && status.retryAfter > 0 {
+			wait = status.retryAfter
+		}
+
+		d.logger.Printf("Attempt %d of %d %s failed: %s; retrying in %s\n", attempt, maxDownloadAttempts, description, err, wait)
+		sleep(ctx, wait)
+	}
+}
+
+// download writes the layer to file. When an attempt fails part way through,
+// the next one resumes where it stopped with a range request. The content is
+// hashed as it is written and verified once the layer is complete.
+func (d downloader) download(ctx context.Context, layer v1.Descriptor, file *os.File) error {
+	var (
+		blobName = fmt.Sprintf("layer %s", layer.Digest)
+		hash     = sha256.New()
+		written  int64
+	)
+
+	return d.retry(ctx, "downloading "+blobName, func() error {
+		resp, err := d.openLayer(ctx, layer, written)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if written > 0 && resp.StatusCode != http.StatusPartialContent {
+			d.logger.Printf("Server does not support resuming %s; starting over\n", blobName)
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			hash.Reset()
+			written = 0
+		}
+
+		var body io.Reader = resp.Body
+		if d.limiter != nil {
+			body = d.limiter.reader(body)
+		}
+		if layer.Size > 0 {
+			body = io.LimitReader(body, layer.Size-written+1)
+		}
+
+		n, err := io.Copy(io.MultiWriter(file, hash), body)
+		written += n
+		if err != nil {
+			return err
+		}
+
+		return verify(layer, blobName, written, hash)
+	})
+}
+
+func (d downloader) openLayer(ctx context.Context, layer v1.Descriptor, offset int64) (*http.Response, error) {
+	url, external, err := d.layerURL(layer)
+	if err != nil {
+		return nil, err
+	}
+
+	if external {
+		return d.registry.external(ctx, url, offset)
+	}
+	return d.registry.get(ctx, url, rangeHeader(offset), true)
+}
+
+// layerURL returns the URL the layer is downloaded from, and whether it is
+// hosted outside of the registry.
+func (d downloader) layerURL(layer v1.Descriptor) (string, bool, error) {
+	switch {
+	case layer.MediaType == mediaTypeDockerLayer, layer.MediaType == v1.MediaTypeImageLayerGzip:
+		return d.registry.blobURL(layer.Digest), false, nil
+	case isForeign(layer) && d.foreignLayers == ForeignLayersRequireMirror:
+		return d.registry.blobURL(layer.Digest), false, nil
+	case layer.MediaType == mediaTypeDockerForeignLayer, layer.MediaType == v1.MediaTypeImageLayerNonDistributableGzip:
+		if len(layer.URLs) == 0 {
+			return "", false, fmt.Errorf("foreign layer %s does not specify any urls", layer.Digest)
+		}
+		return layer.URLs[0], true, nil
+	default:
+		return "", false, fmt.Errorf("invalid layer media type: %s", layer.MediaType)
+	}
+}
+
+// copyVerified copies src to dst while hashing it, and fails if the content
+// does not match the size and digest of the descriptor.
+func copyVerified(dst io.Writer, src io.Reader, descriptor v1.Descriptor, blobName string) error {
+	if descriptor.Size > 0 {
+		src = io.LimitReader(src, descriptor.Size+1)
+	}
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		return err
+	}
+
+	return verify(descriptor, blobName, written, hash)
+}
+
+func verify(descriptor v1.Descriptor, blobName string, written int64, hash hash.Hash) error {
+	if descriptor.Digest.Algorithm() != digest.SHA256 {
+		return fmt.Errorf("unsupported digest algorithm for %s: %s", blobName, descriptor.Digest.Algorithm())
+	}
+
+	if descriptor.Size > 0 && written != descriptor.Size {
+		return SizeMismatchError{Blob: blobName, Expected: descriptor.Size, Actual: written}
+	}
+
+	actual := digest.NewDigest(digest.SHA256, hash)
+	if actual != descriptor.Digest {
+		return DigestMismatchError{Blob: blobName, Expected: descriptor.Digest, Actual: actual}
+	}
+
+	return nil
+}
+
+func retryable(err error) bool {
+	var mismatch DigestMismatchError
+	if errors.As(err, &mismatch) {
+		return false
+	}
+
+	// A blob that comes back larger than its descriptor is not truncated, so
+	// resuming it would only request a range past its end.
+	var size SizeMismatchError
+	if errors.As(err, &size) && size.Actual > size.Expected {
+		return false
+	}
+
+	var status statusError
+	if errors.As(err, &status) {
+		return status.temporary()
+	}
+
+	return true
+}
+
+func backoff(attempt int) time.Duration {
+	wait := initialBackoff << uint(attempt-1)
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
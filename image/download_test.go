@@ -0,0 +1,180 @@
+package image_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pivotal-cf/winfs-injector/image"
+	"github.com/pivotal-cf/winfs-injector/internal/testhelpers"
+)
+
+var _ = Describe("downloading layers", func() {
+	var (
+		registry *testhelpers.Registry
+		outDir   string
+		config   image.Config
+		sleeps   []time.Duration
+
+		layer       []byte
+		layerDigest digest.Digest
+	)
+
+	BeforeEach(func() {
+		registry = testhelpers.NewRegistry("cloudfoundry/windows2016fs")
+
+		layer = []byte("some-layer-contents")
+		layerDigest = digest.FromBytes(layer)
+		registry.AddImage("2019.0.43", layer)
+
+		var err error
+		outDir, err = ioutil.TempDir("", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = image.Config{}
+
+		sleeps = nil
+		image.SetSleep(func(d time.Duration) {
+			sleeps = append(sleeps, d)
+		})
+	})
+
+	AfterEach(func() {
+		image.ResetSleep()
+		registry.Close()
+		Expect(os.RemoveAll(outDir)).To(Succeed())
+	})
+
+	fetch := func() error {
+		fetcher := image.NewFetcher(log.New(GinkgoWriter, "", 0), config)
+		_, err := fetcher.Fetch(outDir, "cloudfoundry/windows2016fs", "2019.0.43", registry.URL())
+		return err
+	}
+
+	fetchedLayer := func() []byte {
+		entries := testhelpers.ReadTgzFile(filepath.Join(outDir, "windows2016fs-2019.0.43.tgz"))
+		return entries["blobs/sha256/"+layerDigest.Encoded()]
+	}
+
+	It("retries transient errors with exponential backoff", func() {
+		registry.FailBlob(layerDigest,
+			testhelpers.BlobFailure{Status: http.StatusBadGateway},
+			testhelpers.BlobFailure{Status: http.StatusServiceUnavailable},
+			testhelpers.BlobFailure{Status: http.StatusInternalServerError},
+		)
+
+		Expect(fetch()).To(Succeed())
+
+		Expect(sleeps).To(Equal([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second}))
+		Expect(fetchedLayer()).To(Equal(layer))
+	})
+
+	It("waits as long as the registry asks when it is rate limited", func() {
+		registry.FailBlob(layerDigest, testhelpers.BlobFailure{Status: http.StatusTooManyRequests, RetryAfter: "17"})
+
+		Expect(fetch()).To(Succeed())
+
+		Expect(sleeps).To(Equal([]time.Duration{17 * time.Second}))
+	})
+
+	It("resumes a dropped download where it stopped", func() {
+		registry.FailBlob(layerDigest, testhelpers.BlobFailure{DropAfter: 5})
+
+		Expect(fetch()).To(Succeed())
+
+		Expect(registry.Ranges()).To(Equal([]string{"bytes=5-"}))
+		Expect(fetchedLayer()).To(Equal(layer))
+	})
+
+	It("resumes a download that stalls", func() {
+		image.SetIdleTimeout(50 * time.Millisecond)
+		defer image.ResetIdleTimeout()
+		registry.FailBlob(layerDigest, testhelpers.BlobFailure{DropAfter: 5, Stall: true})
+
+		Expect(fetch()).To(Succeed())
+
+		Expect(sleeps).To(HaveLen(1))
+		Expect(registry.Ranges()).To(Equal([]string{"bytes=5-"}))
+		Expect(fetchedLayer()).To(Equal(layer))
+	})
+
+	It("does not retry a layer that is larger than its descriptor", func() {
+		registry.SetBlob(layerDigest, append(layer, []byte("-and-more")...))
+
+		err := fetch()
+		Expect(err).To(MatchError(ContainSubstring(fmt.Sprintf("size mismatch for layer %s: expected %d bytes, got %d", layerDigest, len(layer), len(layer)+1))))
+		Expect(sleeps).To(BeEmpty())
+		Expect(registry.Ranges()).To(BeEmpty())
+	})
+
+	It("gives up after five attempts", func() {
+		for i := 0; i < 5; i++ {
+			registry.FailBlob(layerDigest, testhelpers.BlobFailure{Status: http.StatusBadGateway})
+		}
+
+		err := fetch()
+		Expect(err).To(MatchError(ContainSubstring("failed downloading layer " + layerDigest.String())))
+		Expect(err).To(MatchError(ContainSubstring(": 502")))
+		Expect(sleeps).To(HaveLen(4))
+	})
+
+	It("does not retry errors that retrying cannot fix", func() {
+		registry.FailBlob(layerDigest, testhelpers.BlobFailure{Status: http.StatusForbidden})
+
+		Expect(fetch()).To(MatchError(ContainSubstring(": 403")))
+		Expect(sleeps).To(BeEmpty())
+	})
+
+	It("stops the other downloads when the first layer fails", func() {
+		// The layout writes layers in digest order, so this layer comes first.
+		failing := []byte("failing-layer-contents")
+		failingDigest := digest.FromBytes(failing)
+		registry.AddImage("2019.0.43", failing, layer)
+		registry.FailBlob(failingDigest, testhelpers.BlobFailure{Status: http.StatusForbidden})
+		registry.FailBlob(layerDigest, testhelpers.BlobFailure{DropAfter: 5, Stall: true})
+
+		errs := make(chan error, 1)
+		go func() { errs <- fetch() }()
+
+		var err error
+		Eventually(errs, 5*time.Second).Should(Receive(&err))
+		Expect(err).To(MatchError(ContainSubstring("layer " + failingDigest.String())))
+		Expect(err).To(MatchError(ContainSubstring(": 403")))
+		Expect(sleeps).To(BeEmpty())
+	})
+
+	Context("when the image has more layers than the parallelism", func() {
+		BeforeEach(func() {
+			registry.AddImage("2019.0.43", []byte("layer-1"), []byte("layer-2"), []byte("layer-3"), []byte("layer-4"), []byte("layer-5"))
+			registry.SetDelay(20 * time.Millisecond)
+			config.Parallelism = 2
+		})
+
+		It("downloads at most that many layers at a time", func() {
+			Expect(fetch()).To(Succeed())
+
+			Expect(registry.MaxInFlight()).To(Equal(2))
+		})
+	})
+
+	Context("when the bandwidth is capped", func() {
+		BeforeEach(func() {
+			registry.AddImage("2019.0.43", make([]byte, 1000), make([]byte, 1001))
+			config.MaxBandwidth = 4000
+		})
+
+		It("does not download faster than the cap", func() {
+			start := time.Now()
+			Expect(fetch()).To(Succeed())
+
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+		})
+	})
+})
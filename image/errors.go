@@ -0,0 +1,51 @@
+package image
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type DigestMismatchError struct {
+	Blob     string
+	Expected digest.Digest
+	Actual   digest.Digest
+}
+
+func (e DigestMismatchError) Error() string {
+	return fmt.Sprintf("digest mismatch for %s: expected %s, got %s", e.Blob, e.Expected, e.Actual)
+}
+
+type SizeMismatchError struct {
+	Blob     string
+	Expected int64
+	Actual   int64
+}
+
+func (e SizeMismatchError) Error() string {
+	return fmt.Sprintf("size mismatch for %s: expected %d bytes, got %d", e.Blob, e.Expected, e.Actual)
+}
+
+type statusError struct {
+	url        string
+	statusCode int
+	retryAfter time.Duration
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unsuccessful response from %s: %d", e.url, e.statusCode)
+}
+
+// temporary reports whether the request may succeed when it is retried.
+func (e statusError) temporary() bool {
+	switch {
+	case e.statusCode == http.StatusRequestTimeout, e.statusCode == http.StatusTooManyRequests:
+		return true
+	case e.statusCode >= 500:
+		return true
+	default:
+		return false
+	}
+}
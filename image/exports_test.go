@@ -0,0 +1,22 @@
+package image
+
+import (
+	"context"
+	"time"
+)
+
+func SetSleep(f func(time.Duration)) {
+	sleep = func(_ context.Context, d time.Duration) { f(d) }
+}
+
+func ResetSleep() {
+	sleep = sleepContext
+}
+
+func SetIdleTimeout(d time.Duration) {
+	idleTimeout = d
+}
+
+func ResetIdleTimeout() {
+	idleTimeout = time.Minute
+}
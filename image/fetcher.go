@@ -0,0 +1,318 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const defaultParallelism = 4
+
+type Config struct {
+	Digest   string
+	LockFile string
+	CacheDir string
+
+	// Parallelism is the number of layers downloaded at the same time.
+	Parallelism int
+	// MaxBandwidth caps the combined download rate in bytes per second.
+	MaxBandwidth int64
+
+	// OSVersion selects the Windows build, such as 10.0.17763, when the
+	// registry serves a manifest list. It is derived from the tag if empty.
+	OSVersion string
+
+	ForeignLayers ForeignLayerPolicy
+
+	// ScratchDir holds the layers that are downloaded but not yet written
+	// out, at most Parallelism of them at a time. It defaults to the system
+	// temp dir.
+	ScratchDir string
+}
+
+type Image struct {
+	Name string
+	Tag  string
+	// Digest is the digest of the manifest or manifest list the tag resolved
+	// to, and ManifestDigest the digest of the image manifest that was used.
+	Digest         digest.Digest
+	ManifestDigest digest.Digest
+	Platform       v1.Platform
+	Layers         []v1.Descriptor
+	ForeignLayers  []ForeignLayer
+}
+
+type imageConfig struct {
+	v1.Image
+	OSVersion string `json:"os.version,omitempty"`
+}
+
+type Fetcher struct {
+	logger *log.Logger
+	config Config
+}
+
+func NewFetcher(logger *log.Logger, config Config) Fetcher {
+	return Fetcher{
+		logger: logger,
+		config: config,
+	}
+}
+
+// Fetch downloads the image and writes it to outDir as an OCI layout tarball
+// named after the image and tag. Every blob is verified against its descriptor
+// while it is being written. When the configuration pins a digest, the manifest
+// is requested by that digest and must hash to it.
+func (f Fetcher) Fetch(outDir, imageName, imageTag, registryURL string) (Image, error) {
+	layout, err := f.Open(imageName, imageTag, registryURL)
+	if err != nil {
+		return Image{}, err
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return Image{}, err
+	}
+
+	outFile := filepath.Join(outDir, layout.FileName())
+	f.logger.Printf("Writing %s...\n", outFile)
+
+	tmp, err := ioutil.TempFile(outDir, layout.FileName()+".tmp")
+	if err != nil {
+		return Image{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := layout.WriteTo(tmp); err != nil {
+		return Image{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Image{}, err
+	}
+	if err := os.Rename(tmp.Name(), outFile); err != nil {
+		return Image{}, err
+	}
+	f.logger.Println("Done.")
+
+	return layout.Image(), nil
+}
+
+// Open resolves the image and returns its OCI layout, without downloading any
+// of its layers yet. They are downloaded while the layout is written.
+func (f Fetcher) Open(imageName, imageTag, registryURL string) (*Layout, error) {
+	nameParts := strings.Split(imageName, "/")
+	if len(nameParts) != 2 {
+		return nil, fmt.Errorf("invalid image name: %s", imageName)
+	}
+
+	pinnedDigest, err := f.pinnedDigest(imageName, imageTag)
+	if err != nil {
+		return nil, err
+	}
+
+	reference := imageTag
+	if pinnedDigest != "" {
+		reference = pinnedDigest.String()
+	}
+
+	d := downloader{
+		registry:      newRegistry(registryURL, imageName),
+		logger:        f.logger,
+		limiter:       newBandwidthLimiter(f.config.MaxBandwidth),
+		foreignLayers: f.config.ForeignLayers,
+	}
+
+	f.logger.Printf("\nDownloading image: %s with tag: %s from registry: %s\n", imageName, imageTag, registryURL)
+	var rawManifest []byte
+	err = d.retry(context.Background(), "downloading manifest", func() error {
+		rawManifest, err = d.registry.manifest(reference, mediaTypeDockerManifest, v1.MediaTypeImageManifest, mediaTypeDockerManifestList, v1.MediaTypeImageIndex)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed downloading manifest for %s:%s: %s", imageName, imageTag, err)
+	}
+
+	resolvedDigest := digest.FromBytes(rawManifest)
+	if pinnedDigest != "" && resolvedDigest != pinnedDigest {
+		return nil, DigestMismatchError{Blob: fmt.Sprintf("manifest of %s:%s", imageName, imageTag), Expected: pinnedDigest, Actual: resolvedDigest}
+	}
+	f.logger.Printf("Resolved image %s:%s to digest %s\n", imageName, imageTag, resolvedDigest)
+
+	build := f.config.OSVersion
+	if build == "" {
+		build = WindowsBuildForTag(imageTag)
+	}
+
+	manifest, manifestDigest, err := f.resolveManifest(d, rawManifest, build)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve manifest for %s:%s: %s", imageName, imageTag, err)
+	}
+
+	config, err := f.fetchConfig(d, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	platform := v1.Platform{OS: config.OS, Architecture: config.Architecture, OSVersion: config.OSVersion}
+	if build != "" && config.OSVersion != "" && !matchesBuild(config.OSVersion, build) {
+		if f.config.OSVersion != "" || manifestDigest != resolvedDigest {
+			return nil, fmt.Errorf("image config os.version %s does not match Windows build %s", config.OSVersion, build)
+		}
+		f.logger.Printf("Warning: image config os.version %s does not match Windows build %s expected for tag %s\n", config.OSVersion, build, imageTag)
+	}
+	f.logger.Printf("Using platform %s\n", describePlatform(&platform))
+
+	diffIDs := config.RootFS.DiffIDs
+	if len(manifest.Layers) != len(diffIDs) {
+		return nil, fmt.Errorf("mismatch: %d layers, %d diffIds", len(manifest.Layers), len(diffIDs))
+	}
+
+	image := Image{
+		Name:           imageName,
+		Tag:            imageTag,
+		Digest:         resolvedDigest,
+		ManifestDigest: manifestDigest,
+		Platform:       platform,
+		Layers:         manifest.Layers,
+	}
+
+	return f.newLayout(d, image, diffIDs, fmt.Sprintf("%s-%s.tgz", nameParts[1], imageTag))
+}
+
+// resolveManifest returns the image manifest and its digest. When the registry
+// served a manifest list, the manifest for the Windows build is selected from
+// it, fetched, and verified against the digest the list gives for it.
+func (f Fetcher) resolveManifest(d downloader, rawManifest []byte, build string) (v1.Manifest, digest.Digest, error) {
+	index, err := isIndex(rawManifest)
+	if err != nil {
+		return v1.Manifest{}, "", err
+	}
+
+	manifestDigest := digest.FromBytes(rawManifest)
+
+	if index {
+		var list v1.Index
+		if err := json.Unmarshal(rawManifest, &list); err != nil {
+			return v1.Manifest{}, "", err
+		}
+
+		selected, err := selectPlatform(list, build)
+		if err != nil {
+			return v1.Manifest{}, "", err
+		}
+		f.logger.Printf("Selected %s (%s) from manifest list\n", describePlatform(selected.Platform), selected.Digest)
+
+		err = d.retry(context.Background(), "downloading platform manifest", func() error {
+			rawManifest, err = d.registry.manifest(selected.Digest.String(), mediaTypeDockerManifest, v1.MediaTypeImageManifest)
+			return err
+		})
+		if err != nil {
+			return v1.Manifest{}, "", err
+		}
+
+		manifestDigest = digest.FromBytes(rawManifest)
+		if manifestDigest != selected.Digest {
+			return v1.Manifest{}, "", DigestMismatchError{Blob: "platform manifest", Expected: selected.Digest, Actual: manifestDigest}
+		}
+	}
+
+	var manifest v1.Manifest
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return v1.Manifest{}, "", err
+	}
+
+	return manifest, manifestDigest, nil
+}
+
+func (f Fetcher) pinnedDigest(imageName, imageTag string) (digest.Digest, error) {
+	var pinned digest.Digest
+
+	if f.config.Digest != "" {
+		d, err := parseDigest(f.config.Digest)
+		if err != nil {
+			return "", err
+		}
+		pinned = d
+	}
+
+	if f.config.LockFile != "" {
+		lock, err := ReadLockFile(f.config.LockFile)
+		if err != nil {
+			return "", err
+		}
+
+		d, err := lock.digestFor(imageName, imageTag)
+		if err != nil {
+			return "", err
+		}
+
+		if pinned != "" && pinned != d {
+			return "", fmt.Errorf("image digest %s does not match digest %s from lock file %s", pinned, d, f.config.LockFile)
+		}
+		pinned = d
+	}
+
+	return pinned, nil
+}
+
+func (f Fetcher) fetchConfig(d downloader, descriptor v1.Descriptor) (imageConfig, error) {
+	if descriptor.MediaType != mediaTypeDockerConfig && descriptor.MediaType != v1.MediaTypeImageConfig {
+		return imageConfig{}, fmt.Errorf("invalid image config media type: %s", descriptor.MediaType)
+	}
+
+	var rawConfig bytes.Buffer
+	err := d.retry(context.Background(), "downloading image config", func() error {
+		rawConfig.Reset()
+
+		resp, err := d.registry.blob(context.Background(), descriptor.Digest, 0)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		return copyVerified(&rawConfig, resp.Body, descriptor, "image config")
+	})
+	if err != nil {
+		return imageConfig{}, fmt.Errorf("failed downloading image config: %s", err)
+	}
+
+	var config imageConfig
+	if err := json.Unmarshal(rawConfig.Bytes(), &config); err != nil {
+		return imageConfig{}, fmt.Errorf("unable to parse image config: %s", err)
+	}
+
+	if config.OS != "windows" {
+		return imageConfig{}, fmt.Errorf("invalid container OS: %s", config.OS)
+	}
+
+	if config.Architecture != "amd64" {
+		return imageConfig{}, fmt.Errorf("invalid container arch: %s", config.Architecture)
+	}
+
+	return config, nil
+}
+
+func (f Fetcher) reportForeignLayers(layers []ForeignLayer) {
+	if len(layers) == 0 {
+		return
+	}
+
+	policy := f.config.ForeignLayers
+	if policy == "" {
+		policy = ForeignLayersInclude
+	}
+
+	f.logger.Printf("\nForeign layers (policy: %s):\n", policy)
+	for _, layer := range layers {
+		f.logger.Printf("  %s\n    size:   %d bytes\n    urls:   %s\n    source: %s\n", layer.Digest, layer.Size, strings.Join(layer.URLs, ", "), layer.Source)
+	}
+}
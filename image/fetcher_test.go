@@ -0,0 +1,473 @@
+package image_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pivotal-cf/winfs-injector/image"
+	"github.com/pivotal-cf/winfs-injector/internal/testhelpers"
+)
+
+var _ = Describe("Fetcher", func() {
+	var (
+		registry *testhelpers.Registry
+		outDir   string
+		config   image.Config
+
+		layerA []byte
+		layerB []byte
+
+		manifestDigest digest.Digest
+	)
+
+	BeforeEach(func() {
+		registry = testhelpers.NewRegistry("cloudfoundry/windows2016fs")
+
+		layerA = []byte("layer-a-contents")
+		layerB = []byte("layer-b-contents")
+		manifestDigest = registry.AddImage("2019.0.43", layerA, layerB)
+
+		var err error
+		outDir, err = ioutil.TempDir("", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = image.Config{}
+	})
+
+	AfterEach(func() {
+		registry.Close()
+		Expect(os.RemoveAll(outDir)).To(Succeed())
+	})
+
+	fetch := func() (image.Image, error) {
+		fetcher := image.NewFetcher(log.New(GinkgoWriter, "", 0), config)
+		return fetcher.Fetch(outDir, "cloudfoundry/windows2016fs", "2019.0.43", registry.URL())
+	}
+
+	It("writes the image as an oci layout tarball", func() {
+		_, err := fetch()
+		Expect(err).NotTo(HaveOccurred())
+
+		entries := testhelpers.ReadTgzFile(filepath.Join(outDir, "windows2016fs-2019.0.43.tgz"))
+		Expect(entries).To(HaveKey("index.json"))
+		Expect(entries).To(HaveKey("oci-layout"))
+		Expect(entries).To(HaveKeyWithValue("blobs/sha256/"+digest.FromBytes(layerA).Encoded(), layerA))
+		Expect(entries).To(HaveKeyWithValue("blobs/sha256/"+digest.FromBytes(layerB).Encoded(), layerB))
+	})
+
+	Describe("Open", func() {
+		It("streams a layout of the size it announces, without leaving layers behind", func() {
+			config.ScratchDir = filepath.Join(outDir, "scratch")
+			Expect(os.MkdirAll(config.ScratchDir, 0755)).To(Succeed())
+
+			fetcher := image.NewFetcher(log.New(GinkgoWriter, "", 0), config)
+			layout, err := fetcher.Open("cloudfoundry/windows2016fs", "2019.0.43", registry.URL())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layout.FileName()).To(Equal("windows2016fs-2019.0.43.tgz"))
+			Expect(registry.Requests()).NotTo(ContainElement(ContainSubstring(digest.FromBytes(layerA).String())))
+
+			var buf bytes.Buffer
+			n, err := layout.WriteTo(&buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(layout.Size()))
+			Expect(int64(buf.Len())).To(Equal(layout.Size()))
+
+			tgz := filepath.Join(outDir, "layout.tgz")
+			Expect(ioutil.WriteFile(tgz, buf.Bytes(), 0644)).To(Succeed())
+			Expect(testhelpers.ReadTgzFile(tgz)).To(HaveKeyWithValue("blobs/sha256/"+digest.FromBytes(layerB).Encoded(), layerB))
+
+			scratch, err := ioutil.ReadDir(config.ScratchDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scratch).To(BeEmpty())
+		})
+
+		It("verifies the layout it wrote", func() {
+			fetcher := image.NewFetcher(log.New(GinkgoWriter, "", 0), config)
+			layout, err := fetcher.Open("cloudfoundry/windows2016fs", "2019.0.43", registry.URL())
+			Expect(err).NotTo(HaveOccurred())
+
+			var buf bytes.Buffer
+			_, err = layout.WriteTo(&buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layout.Verify(bytes.NewReader(buf.Bytes()))).To(Succeed())
+
+			// The layout is stored without compression, so the layer can be
+			// corrupted in place.
+			corrupted := bytes.Replace(buf.Bytes(), layerB, []byte("layer-b-tampered"), 1)
+			Expect(corrupted).NotTo(Equal(buf.Bytes()))
+
+			err = layout.Verify(bytes.NewReader(corrupted))
+			Expect(err).To(MatchError(ContainSubstring("digest mismatch for layer " + digest.FromBytes(layerB).String())))
+		})
+	})
+
+	It("returns the resolved manifest digest", func() {
+		img, err := fetch()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(img.Digest).To(Equal(manifestDigest))
+		Expect(img.Layers).To(HaveLen(2))
+	})
+
+	Context("when a digest is pinned", func() {
+		BeforeEach(func() {
+			config.Digest = manifestDigest.String()
+		})
+
+		It("requests the manifest by digest", func() {
+			_, err := fetch()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(registry.Requests()).To(ContainElement("/v2/cloudfoundry/windows2016fs/manifests/" + manifestDigest.String()))
+		})
+
+		Context("when the registry serves a different manifest", func() {
+			BeforeEach(func() {
+				registry.AddManifest(manifestDigest.String(), []byte(`{"schemaVersion":2}`))
+			})
+
+			It("returns a digest mismatch error", func() {
+				_, err := fetch()
+				Expect(err).To(MatchError(ContainSubstring("digest mismatch for manifest of cloudfoundry/windows2016fs:2019.0.43: expected " + manifestDigest.String())))
+			})
+		})
+
+		Context("when the digest is malformed", func() {
+			BeforeEach(func() {
+				config.Digest = "sha256:nope"
+			})
+
+			It("returns an error", func() {
+				_, err := fetch()
+				Expect(err).To(MatchError(ContainSubstring(`invalid image digest "sha256:nope"`)))
+			})
+		})
+	})
+
+	Context("when a lock file is provided", func() {
+		var lockFile string
+
+		BeforeEach(func() {
+			lockFile = filepath.Join(outDir, "image-lock.yml")
+			config.LockFile = lockFile
+		})
+
+		It("pins the digest from the lock file", func() {
+			Expect(ioutil.WriteFile(lockFile, []byte("image: cloudfoundry/windows2016fs\ndigest: "+manifestDigest.String()+"\n"), 0644)).To(Succeed())
+
+			_, err := fetch()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(registry.Requests()).To(ContainElement("/v2/cloudfoundry/windows2016fs/manifests/" + manifestDigest.String()))
+		})
+
+		It("returns an error when the lock file is for a different tag", func() {
+			Expect(ioutil.WriteFile(lockFile, []byte("tag: 2019.0.42\ndigest: "+manifestDigest.String()+"\n"), 0644)).To(Succeed())
+
+			_, err := fetch()
+			Expect(err).To(MatchError("image lock is for tag 2019.0.42, but 2019.0.43 was requested"))
+		})
+
+		It("returns an error when it disagrees with the pinned digest", func() {
+			Expect(ioutil.WriteFile(lockFile, []byte("digest: "+manifestDigest.String()+"\n"), 0644)).To(Succeed())
+			config.Digest = digest.FromString("something-else").String()
+
+			_, err := fetch()
+			Expect(err).To(MatchError(ContainSubstring("does not match digest " + manifestDigest.String())))
+		})
+
+		It("returns an error when the lock file has no digest", func() {
+			Expect(ioutil.WriteFile(lockFile, []byte("image: cloudfoundry/windows2016fs\n"), 0644)).To(Succeed())
+
+			_, err := fetch()
+			Expect(err).To(MatchError(ContainSubstring("does not specify a digest")))
+		})
+	})
+
+	Context("when a cache dir is configured", func() {
+		BeforeEach(func() {
+			config.CacheDir = filepath.Join(outDir, "cache")
+		})
+
+		It("does not download cached layers again", func() {
+			_, err := fetch()
+			Expect(err).NotTo(HaveOccurred())
+
+			entries, err := image.NewCache(config.CacheDir).List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(2))
+
+			Expect(os.Remove(filepath.Join(outDir, "windows2016fs-2019.0.43.tgz"))).To(Succeed())
+			requestsBefore := len(registry.Requests())
+
+			_, err = fetch()
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, request := range registry.Requests()[requestsBefore:] {
+				Expect(request).NotTo(ContainSubstring(digest.FromBytes(layerA).String()))
+				Expect(request).NotTo(ContainSubstring(digest.FromBytes(layerB).String()))
+			}
+
+			tgzEntries := testhelpers.ReadTgzFile(filepath.Join(outDir, "windows2016fs-2019.0.43.tgz"))
+			Expect(tgzEntries).To(HaveKeyWithValue("blobs/sha256/"+digest.FromBytes(layerA).Encoded(), layerA))
+		})
+
+		It("downloads a corrupted cached layer again", func() {
+			_, err := fetch()
+			Expect(err).NotTo(HaveOccurred())
+
+			cachedLayer := filepath.Join(config.CacheDir, "blobs", "sha256", digest.FromBytes(layerA).Encoded())
+			Expect(ioutil.WriteFile(cachedLayer, []byte("corrupted"), 0644)).To(Succeed())
+
+			_, err = fetch()
+			Expect(err).NotTo(HaveOccurred())
+
+			contents, err := ioutil.ReadFile(cachedLayer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(Equal(layerA))
+		})
+	})
+
+	Context("when a layer does not match its digest", func() {
+		BeforeEach(func() {
+			registry.SetBlob(digest.FromBytes(layerB), []byte("tampered-content"))
+		})
+
+		It("returns a digest mismatch error and does not write the image", func() {
+			_, err := fetch()
+			Expect(err).To(MatchError(ContainSubstring("digest mismatch for layer " + digest.FromBytes(layerB).String())))
+
+			Expect(filepath.Join(outDir, "windows2016fs-2019.0.43.tgz")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Context("when the image is not a windows image", func() {
+		BeforeEach(func() {
+			registry.AddManifest("2019.0.43", registry.BuildManifest(testhelpers.Platform{OS: "linux"}, layerA))
+		})
+
+		It("returns an error", func() {
+			_, err := fetch()
+			Expect(err).To(MatchError("invalid container OS: linux"))
+		})
+	})
+
+	Context("when the registry serves a manifest list", func() {
+		var indexDigest digest.Digest
+
+		BeforeEach(func() {
+			indexDigest = registry.AddIndex("2019.0.43", []testhelpers.Platform{
+				{OS: "linux", OSVersion: ""},
+				{OS: "windows", OSVersion: "10.0.14393.4283"},
+				{OS: "windows", OSVersion: "10.0.17763.1879"},
+			}, layerA, layerB)
+		})
+
+		It("selects the image for the windows build derived from the tag", func() {
+			img, err := fetch()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(img.Digest).To(Equal(indexDigest))
+			Expect(img.ManifestDigest).NotTo(Equal(indexDigest))
+			Expect(img.Platform.OS).To(Equal("windows"))
+			Expect(img.Platform.Architecture).To(Equal("amd64"))
+			Expect(img.Platform.OSVersion).To(Equal("10.0.17763.1879"))
+			Expect(registry.Requests()).To(ContainElement("/v2/cloudfoundry/windows2016fs/manifests/" + img.ManifestDigest.String()))
+
+			entries := testhelpers.ReadTgzFile(filepath.Join(outDir, "windows2016fs-2019.0.43.tgz"))
+			Expect(entries).To(HaveKeyWithValue("blobs/sha256/"+digest.FromBytes(layerA).Encoded(), layerA))
+		})
+
+		It("selects the image for the configured windows build", func() {
+			config.OSVersion = "10.0.14393"
+
+			img, err := fetch()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(img.Platform.OSVersion).To(Equal("10.0.14393.4283"))
+		})
+
+		It("accepts a digest pinning the manifest list", func() {
+			config.Digest = indexDigest.String()
+
+			img, err := fetch()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(img.Digest).To(Equal(indexDigest))
+		})
+
+		It("returns an error when no image matches the windows build", func() {
+			config.OSVersion = "10.0.20348"
+
+			_, err := fetch()
+			Expect(err).To(MatchError(ContainSubstring("no windows/amd64 image for Windows build 10.0.20348 found in manifest list (available: windows/amd64 10.0.14393.4283, windows/amd64 10.0.17763.1879)")))
+		})
+
+		Context("when the manifest list only contains linux images", func() {
+			BeforeEach(func() {
+				registry.AddIndex("2019.0.43", []testhelpers.Platform{{OS: "linux"}}, layerA)
+			})
+
+			It("returns an error", func() {
+				_, err := fetch()
+				Expect(err).To(MatchError(ContainSubstring("no windows/amd64 image found in manifest list (available: linux/amd64)")))
+			})
+		})
+	})
+
+	Context("when the image has a foreign layer", func() {
+		var (
+			baseLayer  []byte
+			baseServer *httptest.Server
+			baseURL    string
+			logs       *bytes.Buffer
+			baseHits   int
+		)
+
+		BeforeEach(func() {
+			baseLayer = []byte("foreign-base-layer-contents")
+			baseHits = 0
+			baseServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				baseHits++
+				w.Write(baseLayer)
+			}))
+			baseURL = baseServer.URL + "/base-layer"
+			registry.AddForeignImage("2019.0.43", baseURL, baseLayer, layerA)
+
+			logs = &bytes.Buffer{}
+		})
+
+		AfterEach(func() {
+			baseServer.Close()
+		})
+
+		fetchWithLogs := func() (image.Image, error) {
+			fetcher := image.NewFetcher(log.New(logs, "", 0), config)
+			return fetcher.Fetch(outDir, "cloudfoundry/windows2016fs", "2019.0.43", registry.URL())
+		}
+
+		It("downloads it from its url by default", func() {
+			img, err := fetchWithLogs()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(baseHits).To(Equal(1))
+			entries := testhelpers.ReadTgzFile(filepath.Join(outDir, "windows2016fs-2019.0.43.tgz"))
+			Expect(entries).To(HaveKeyWithValue("blobs/sha256/"+digest.FromBytes(baseLayer).Encoded(), baseLayer))
+
+			Expect(img.ForeignLayers).To(Equal([]image.ForeignLayer{{
+				Digest: digest.FromBytes(baseLayer),
+				Size:   int64(len(baseLayer)),
+				URLs:   []string{baseURL},
+				Source: baseURL,
+			}}))
+		})
+
+		It("reports the foreign layers", func() {
+			_, err := fetchWithLogs()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(logs.String()).To(ContainSubstring("Foreign layers (policy: include):"))
+			Expect(logs.String()).To(ContainSubstring(digest.FromBytes(baseLayer).String()))
+			Expect(logs.String()).To(ContainSubstring(fmt.Sprintf("size:   %d bytes", len(baseLayer))))
+			Expect(logs.String()).To(ContainSubstring("urls:   " + baseURL))
+		})
+
+		Context("when the policy is skip", func() {
+			BeforeEach(func() {
+				config.ForeignLayers = image.ForeignLayersSkip
+			})
+
+			It("does not download or embed the layer", func() {
+				img, err := fetchWithLogs()
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(baseHits).To(Equal(0))
+				entries := testhelpers.ReadTgzFile(filepath.Join(outDir, "windows2016fs-2019.0.43.tgz"))
+				Expect(entries).NotTo(HaveKey("blobs/sha256/" + digest.FromBytes(baseLayer).Encoded()))
+				Expect(entries).To(HaveKeyWithValue("blobs/sha256/"+digest.FromBytes(layerA).Encoded(), layerA))
+
+				Expect(img.ForeignLayers).To(HaveLen(1))
+				Expect(img.ForeignLayers[0].Source).To(Equal("skipped"))
+				Expect(logs.String()).To(ContainSubstring("Warning: skipping foreign layer " + digest.FromBytes(baseLayer).String()))
+			})
+		})
+
+		Context("when the policy is require-mirror", func() {
+			BeforeEach(func() {
+				config.ForeignLayers = image.ForeignLayersRequireMirror
+			})
+
+			It("downloads the layer from the registry", func() {
+				registry.AddBlob(baseLayer)
+
+				img, err := fetchWithLogs()
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(baseHits).To(Equal(0))
+				Expect(registry.Requests()).To(ContainElement("/v2/cloudfoundry/windows2016fs/blobs/" + digest.FromBytes(baseLayer).String()))
+				Expect(img.ForeignLayers[0].Source).To(HavePrefix(registry.URL()))
+			})
+
+			It("returns an error when the registry does not mirror the layer", func() {
+				_, err := fetchWithLogs()
+				Expect(err).To(MatchError(ContainSubstring("failed downloading layer " + digest.FromBytes(baseLayer).String())))
+				Expect(baseHits).To(Equal(0))
+			})
+		})
+	})
+
+	Context("when the image has an uncompressed foreign layer", func() {
+		var (
+			baseLayer  []byte
+			baseServer *httptest.Server
+			baseHits   int
+		)
+
+		BeforeEach(func() {
+			baseLayer = []byte("uncompressed-base-layer-contents")
+			baseHits = 0
+			baseServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				baseHits++
+				w.Write(baseLayer)
+			}))
+
+			registry.AddBlob(baseLayer)
+			registry.AddForeignImageOfType("2019.0.43", v1.MediaTypeImageLayerNonDistributable, baseServer.URL+"/base-layer", baseLayer, layerA)
+		})
+
+		AfterEach(func() {
+			baseServer.Close()
+		})
+
+		for _, policy := range []image.ForeignLayerPolicy{image.ForeignLayersInclude, image.ForeignLayersSkip, image.ForeignLayersRequireMirror} {
+			policy := policy
+
+			It(fmt.Sprintf("refuses it before downloading anything with policy %s", policy), func() {
+				config.ForeignLayers = policy
+
+				_, err := fetch()
+				Expect(err).To(MatchError(fmt.Sprintf("foreign layer %s is not compressed (%s), which is not supported", digest.FromBytes(baseLayer), v1.MediaTypeImageLayerNonDistributable)))
+				Expect(baseHits).To(Equal(0))
+				Expect(filepath.Join(outDir, "windows2016fs-2019.0.43.tgz")).NotTo(BeAnExistingFile())
+			})
+		}
+	})
+
+	Context("when the image name is malformed", func() {
+		It("returns an error", func() {
+			fetcher := image.NewFetcher(log.New(GinkgoWriter, "", 0), config)
+			_, err := fetcher.Fetch(outDir, "windows2016fs", "2019.0.43", registry.URL())
+			Expect(err).To(MatchError("invalid image name: windows2016fs"))
+		})
+	})
+})
@@ -0,0 +1,52 @@
+package image
+
+import (
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const skippedLayerSource = "skipped"
+
+// ForeignLayerPolicy controls how layers that the image marks as foreign, or
+// non-distributable, are handled. Windows images reference their Microsoft
+// base layers this way, with URLs outside of the registry.
+type ForeignLayerPolicy string
+
+const (
+	// ForeignLayersInclude downloads foreign layers from their URLs and
+	// embeds them like any other layer.
+	ForeignLayersInclude ForeignLayerPolicy = "include"
+	// ForeignLayersSkip leaves foreign layers out of the written image.
+	ForeignLayersSkip ForeignLayerPolicy = "skip"
+	// ForeignLayersRequireMirror downloads foreign layers from the
+	// configured registry by digest, and never from their URLs.
+	ForeignLayersRequireMirror ForeignLayerPolicy = "require-mirror"
+)
+
+func ParseForeignLayerPolicy(s string) (ForeignLayerPolicy, error) {
+	switch policy := ForeignLayerPolicy(s); policy {
+	case ForeignLayersInclude, ForeignLayersSkip, ForeignLayersRequireMirror:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid foreign layer policy %q: expected one of include, skip or require-mirror", s)
+	}
+}
+
+type ForeignLayer struct {
+	Digest digest.Digest
+	Size   int64
+	URLs   []string
+	// Source is where the layer was fetched from, or "skipped".
+	Source string
+}
+
+func isForeign(layer v1.Descriptor) bool {
+	switch layer.MediaType {
+	case mediaTypeDockerForeignLayer, v1.MediaTypeImageLayerNonDistributable, v1.MediaTypeImageLayerNonDistributableGzip:
+		return true
+	default:
+		return false
+	}
+}
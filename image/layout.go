@@ -0,0 +1,558 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	directory "code.cloudfoundry.org/hydrator/oci-directory"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pivotal-cf/winfs-injector/tarstream"
+)
+
+// Modes of the entries of the layout tarball, including the file type bits
+// the way hydrator writes them.
+const (
+	layoutDirMode  = 040755
+	layoutFileMode = 0100644
+)
+
+// Layout is a resolved image that can be written as a gzipped OCI layout
+// tarball. Its size is known before any layer is downloaded, so the tarball
+// can be streamed into another archive. Layers are already compressed, so the
+// tarball is stored in gzip without compressing it again.
+type Layout struct {
+	fetcher  Fetcher
+	d        downloader
+	image    Image
+	fileName string
+	entries  []layoutEntry
+	size     int64
+}
+
+// layoutEntry is a directory, a metadata file or a layer of the layout.
+type layoutEntry struct {
+	header   tar.Header
+	contents []byte
+	layer    *v1.Descriptor
+	// index of the layer in the image manifest.
+	index int
+}
+
+func (f Fetcher) newLayout(d downloader, image Image, diffIDs []digest.Digest, fileName string) (*Layout, error) {
+	var (
+		layers   []v1.Descriptor
+		streamed = map[digest.Digest]bool{}
+		entries  []layoutEntry
+	)
+
+	for i, layer := range image.Layers {
+		if err := layer.Digest.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid layer digest %q: %s", layer.Digest, err)
+		}
+		if layer.Size <= 0 {
+			return nil, fmt.Errorf("layer %s does not specify its size", layer.Digest)
+		}
+
+		// The written manifest describes every layer as gzipped, which an
+		// uncompressed layer is not, whether it is embedded or skipped.
+		if layer.MediaType == v1.MediaTypeImageLayerNonDistributable {
+			return nil, fmt.Errorf("foreign layer %s is not compressed (%s), which is not supported", layer.Digest, layer.MediaType)
+		}
+
+		if isForeign(layer) && f.config.ForeignLayers == ForeignLayersSkip {
+			f.logger.Printf("Warning: skipping foreign layer %s (%d bytes) from %s; it will not be embedded in the release\n", layer.Digest, layer.Size, strings.Join(layer.URLs, ", "))
+			layers = append(layers, v1.Descriptor{
+				MediaType: v1.MediaTypeImageLayerNonDistributableGzip,
+				Size:      layer.Size,
+				Digest:    layer.Digest,
+				URLs:      layer.URLs,
+			})
+			continue
+		}
+
+		if _, _, err := d.layerURL(layer); err != nil {
+			return nil, err
+		}
+
+		layers = append(layers, v1.Descriptor{
+			MediaType: v1.MediaTypeImageLayerGzip,
+			Size:      layer.Size,
+			Digest:    layer.Digest,
+		})
+
+		// A layer that appears more than once is only stored once.
+		if streamed[layer.Digest] {
+			continue
+		}
+		streamed[layer.Digest] = true
+
+		layer := layer
+		entries = append(entries, layoutEntry{
+			header: tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     path.Join("blobs", "sha256", layer.Digest.Encoded()),
+				Mode:     layoutFileMode,
+				Size:     layer.Size,
+			},
+			layer: &layer,
+			index: i,
+		})
+	}
+
+	metadata, err := f.layoutMetadata(layers, diffIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	entries = append(entries,
+		layoutEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: "blobs/", Mode: layoutDirMode}},
+		layoutEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: "blobs/sha256/", Mode: layoutDirMode}},
+	)
+	for name, contents := range metadata {
+		entries = append(entries, layoutEntry{
+			header: tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Mode:     layoutFileMode,
+				Size:     int64(len(contents)),
+			},
+			contents: contents,
+		})
+	}
+
+	// Entries are in the order hydrator writes them, which is also the order
+	// the layers are downloaded in.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].header.Name < entries[j].header.Name })
+
+	headers := make([]*tar.Header, len(entries))
+	for i := range entries {
+		headers[i] = &entries[i].header
+	}
+	tarSize, err := tarstream.Size(headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Layout{
+		fetcher:  f,
+		d:        d,
+		image:    image,
+		fileName: fileName,
+		entries:  entries,
+		size:     tarstream.GzipSize(tarSize),
+	}, nil
+}
+
+// layoutMetadata returns the oci-layout, index, manifest and config files of
+// the layout by their path inside of it.
+func (f Fetcher) layoutMetadata(layers []v1.Descriptor, diffIDs []digest.Digest) (map[string][]byte, error) {
+	dir, err := ioutil.TempDir(f.config.ScratchDir, "winfs-image")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := directory.NewHandler(dir).WriteMetadata(layers, diffIDs, false); err != nil {
+		return nil, err
+	}
+
+	metadata := map[string][]byte{}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		metadata[filepath.ToSlash(rel)] = contents
+		return nil
+	})
+
+	return metadata, err
+}
+
+// FileName is the name the bosh release expects the layout tarball under.
+func (l *Layout) FileName() string {
+	return l.fileName
+}
+
+// Size is the exact size of the tarball written by WriteTo.
+func (l *Layout) Size() int64 {
+	return l.size
+}
+
+// Image describes the image of the layout. Where each foreign layer came
+// from is only known once the layout has been written.
+func (l *Layout) Image() Image {
+	return l.image
+}
+
+// WriteTo writes the layout tarball to w. Layers are downloaded ahead of
+// being written, at most the configured parallelism of them at a time, and
+// each one is removed from the scratch dir as soon as it has been written, so
+// scratch space stays bounded by that many layers.
+func (l *Layout) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	gw := tarstream.NewGzipWriter(counter)
+	tw := tar.NewWriter(gw)
+
+	scratchDir, err := ioutil.TempDir(l.fetcher.config.ScratchDir, "winfs-layers")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(scratchDir)
+
+	var layers []layoutEntry
+	for _, entry := range l.entries {
+		if entry.layer != nil {
+			layers = append(layers, entry)
+		}
+	}
+
+	p := l.fetcher.prefetch(l.d, layers, scratchDir)
+	defer p.stop()
+
+	sources := map[int]string{}
+	for _, entry := range l.entries {
+		header := entry.header
+		if err := tw.WriteHeader(&header); err != nil {
+			return counter.n, err
+		}
+
+		if entry.layer == nil {
+			if _, err := tw.Write(entry.contents); err != nil {
+				return counter.n, err
+			}
+			continue
+		}
+
+		source, err := p.copy(tw, entry)
+		if err != nil {
+			return counter.n, fmt.Errorf("failed downloading layer %s: %s", entry.layer.Digest, err)
+		}
+		sources[entry.index] = source
+	}
+
+	if err := tw.Close(); err != nil {
+		return counter.n, err
+	}
+	if err := gw.Close(); err != nil {
+		return counter.n, err
+	}
+
+	if counter.n != l.size {
+		return counter.n, fmt.Errorf("wrote %d bytes of image layout, expected %d", counter.n, l.size)
+	}
+	l.fetcher.logger.Printf("\nAll layers downloaded.\n")
+
+	l.recordForeignLayers(sources)
+	l.fetcher.reportForeignLayers(l.image.ForeignLayers)
+
+	return counter.n, nil
+}
+
+// Verify reads a layout tarball written by WriteTo and checks that it holds
+// every layer of the layout with its digest and size, and the metadata
+// describing them.
+func (l *Layout) Verify(r io.Reader) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	entries := map[string]layoutEntry{}
+	for _, entry := range l.entries {
+		if entry.header.Typeflag == tar.TypeReg {
+			entries[entry.header.Name] = entry
+		}
+	}
+
+	seen := map[string]bool{}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		entry, ok := entries[hdr.Name]
+		if !ok {
+			return fmt.Errorf("image layout contains unexpected file %s", hdr.Name)
+		}
+		seen[hdr.Name] = true
+
+		if entry.layer != nil {
+			if err := copyVerified(ioutil.Discard, tr, *entry.layer, fmt.Sprintf("layer %s", entry.layer.Digest)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(contents, entry.contents) {
+			return fmt.Errorf("image layout file %s does not match the image", hdr.Name)
+		}
+	}
+
+	var missing []string
+	for name := range entries {
+		if !seen[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("image layout is missing %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func (l *Layout) recordForeignLayers(sources map[int]string) {
+	var foreignLayers []ForeignLayer
+	for i, layer := range l.image.Layers {
+		if !isForeign(layer) {
+			continue
+		}
+
+		source, ok := sources[i]
+		if !ok {
+			source = skippedLayerSource
+			for j, other := range l.image.Layers[:i] {
+				if other.Digest == layer.Digest && sources[j] != "" {
+					source = sources[j]
+				}
+			}
+		}
+
+		foreignLayers = append(foreignLayers, ForeignLayer{
+			Digest: layer.Digest,
+			Size:   layer.Size,
+			URLs:   layer.URLs,
+			Source: source,
+		})
+	}
+	l.image.ForeignLayers = foreignLayers
+}
+
+// prefetcher downloads layers in the order they are written. A layer holds
+// its download slot until it has been written, so no more than parallelism
+// layers are ever on disk.
+type prefetcher struct {
+	results []chan fetchedLayer
+	slots   chan struct{}
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	next    int
+}
+
+// fetchedLayer is a downloaded layer, either in the scratch dir or in the
+// cache.
+type fetchedLayer struct {
+	file    *os.File
+	scratch bool
+	source  string
+	err     error
+}
+
+func (l fetchedLayer) release() {
+	if l.file == nil {
+		return
+	}
+	l.file.Close()
+	if l.scratch {
+		os.Remove(l.file.Name())
+	}
+}
+
+func (f Fetcher) prefetch(d downloader, layers []layoutEntry, scratchDir string) *prefetcher {
+	parallelism := f.config.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultParallelism
+	}
+
+	f.logger.Printf("Downloading %d layers, %d at a time...\n", len(layers), parallelism)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prefetcher{
+		results: make([]chan fetchedLayer, len(layers)),
+		slots:   make(chan struct{}, parallelism),
+		cancel:  cancel,
+	}
+	for i := range p.results {
+		p.results[i] = make(chan fetchedLayer, 1)
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		for i, entry := range layers {
+			select {
+			case p.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			p.wg.Add(1)
+			go func(i int, layer v1.Descriptor) {
+				defer p.wg.Done()
+
+				f.logger.Printf("Layer %.8s begin\n", layer.Digest.Encoded())
+				fetched := f.fetchLayer(ctx, d, layer, scratchDir)
+				if fetched.err == nil {
+					f.logger.Printf("Layer %.8s end\n", layer.Digest.Encoded())
+				}
+				p.results[i] <- fetched
+			}(i, *entry.layer)
+		}
+	}()
+
+	return p
+}
+
+// copy writes the next layer to w and frees its download slot. It returns
+// where the layer came from.
+func (p *prefetcher) copy(w io.Writer, entry layoutEntry) (string, error) {
+	fetched := <-p.results[p.next]
+	p.next++
+	defer func() { <-p.slots }()
+	defer fetched.release()
+
+	if fetched.err != nil {
+		return "", fetched.err
+	}
+
+	if err := copyVerified(w, fetched.file, *entry.layer, fmt.Sprintf("layer %s", entry.layer.Digest)); err != nil {
+		return "", err
+	}
+	return fetched.source, nil
+}
+
+// stop cancels the downloads, waits for them to return and removes the layers
+// that were not written.
+func (p *prefetcher) stop() {
+	p.cancel()
+	p.wg.Wait()
+
+	for _, results := range p.results[p.next:] {
+		select {
+		case fetched := <-results:
+			fetched.release()
+		default:
+		}
+	}
+}
+
+// fetchLayer downloads the layer into the cache, or into scratchDir when
+// there is no cache, and opens it.
+func (f Fetcher) fetchLayer(ctx context.Context, d downloader, layer v1.Descriptor, scratchDir string) fetchedLayer {
+	url, _, err := d.layerURL(layer)
+	if err != nil {
+		return fetchedLayer{err: err}
+	}
+
+	if f.config.CacheDir == "" {
+		file, err := os.Create(filepath.Join(scratchDir, layer.Digest.Encoded()))
+		if err != nil {
+			return fetchedLayer{err: err}
+		}
+
+		fetched := fetchedLayer{file: file, scratch: true, source: url}
+		if err := d.download(ctx, layer, file); err != nil {
+			fetched.release()
+			return fetchedLayer{err: err}
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			fetched.release()
+			return fetchedLayer{err: err}
+		}
+		return fetched
+	}
+
+	cache := NewCache(f.config.CacheDir)
+	unlock, err := cache.Lock(layer.Digest)
+	if err != nil {
+		return fetchedLayer{err: err}
+	}
+	defer unlock()
+
+	// The cached layer is verified before it is used, so that a corrupted
+	// one is downloaded again rather than failing half way through the
+	// tarball. It stays open, so it can be read after the lock is released.
+	if cached, err := cache.Open(layer.Digest); err == nil {
+		err = verifyFile(cached, layer)
+		if err == nil {
+			f.logger.Printf("Layer %.8s found in cache %s\n", layer.Digest.Encoded(), cache.Dir())
+			return fetchedLayer{file: cached, source: "cache " + cache.Dir()}
+		}
+		cached.Close()
+
+		f.logger.Printf("Cached layer %.8s is unusable, downloading it again: %s\n", layer.Digest.Encoded(), err)
+		if err := cache.Remove(layer.Digest); err != nil {
+			return fetchedLayer{err: err}
+		}
+	}
+
+	err = cache.Write(layer.Digest, func(file *os.File) error {
+		return d.download(ctx, layer, file)
+	})
+	if err != nil {
+		return fetchedLayer{err: err}
+	}
+
+	cached, err := cache.Open(layer.Digest)
+	if err != nil {
+		return fetchedLayer{err: err}
+	}
+	return fetchedLayer{file: cached, source: url}
+}
+
+// verifyFile checks the file against the descriptor and rewinds it.
+func verifyFile(file *os.File, layer v1.Descriptor) error {
+	if err := copyVerified(ioutil.Discard, file, layer, fmt.Sprintf("layer %s", layer.Digest)); err != nil {
+		return err
+	}
+
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
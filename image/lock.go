@@ -0,0 +1,61 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	digest "github.com/opencontainers/go-digest"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Lock pins an image to an immutable manifest digest. Name and Tag are
+// optional, but when present they must match the image being fetched.
+type Lock struct {
+	Name   string `yaml:"image"`
+	Tag    string `yaml:"tag"`
+	Digest string `yaml:"digest"`
+}
+
+func ReadLockFile(path string) (Lock, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Lock{}, err
+	}
+
+	var lock Lock
+	err = yaml.Unmarshal(contents, &lock)
+	if err != nil {
+		return Lock{}, fmt.Errorf("unable to parse image lock file %s: %s", path, err)
+	}
+
+	if lock.Digest == "" {
+		return Lock{}, fmt.Errorf("image lock file %s does not specify a digest", path)
+	}
+
+	return lock, nil
+}
+
+func (l Lock) digestFor(name, tag string) (digest.Digest, error) {
+	if l.Name != "" && l.Name != name {
+		return "", fmt.Errorf("image lock is for image %s, but %s was requested", l.Name, name)
+	}
+
+	if l.Tag != "" && l.Tag != tag {
+		return "", fmt.Errorf("image lock is for tag %s, but %s was requested", l.Tag, tag)
+	}
+
+	return parseDigest(l.Digest)
+}
+
+func parseDigest(s string) (digest.Digest, error) {
+	d, err := digest.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid image digest %q: %s", s, err)
+	}
+
+	if d.Algorithm() != digest.SHA256 {
+		return "", fmt.Errorf("invalid image digest %q: only sha256 digests are supported", s)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,122 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// WindowsBuilds maps the Windows releases that rootfs image tags and
+// stemcells are named after, as in 2019.0.43 and windows2019, to the Windows
+// build their containers and VMs run on.
+var WindowsBuilds = map[string]string{
+	"1607": "10.0.14393",
+	"2016": "10.0.14393",
+	"1709": "10.0.16299",
+	"1803": "10.0.17134",
+	"1809": "10.0.17763",
+	"2019": "10.0.17763",
+	"2022": "10.0.20348",
+}
+
+// WindowsBuildForTag derives the Windows build from an image tag such as
+// 2019.0.43, or returns an empty string when the tag does not name a known
+// Windows release.
+func WindowsBuildForTag(tag string) string {
+	release := strings.SplitN(tag, ".", 2)[0]
+	return WindowsBuilds[release]
+}
+
+// WindowsBuildForOSVersion drops the revision from the os.version of an image
+// config, such as 10.0.17763.1879, and returns the build it belongs to.
+func WindowsBuildForOSVersion(osVersion string) string {
+	parts := strings.SplitN(osVersion, ".", 4)
+	if len(parts) < 3 {
+		return osVersion
+	}
+	return strings.Join(parts[:3], ".")
+}
+
+func isIndex(rawManifest []byte) (bool, error) {
+	var manifest struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return false, err
+	}
+
+	switch manifest.MediaType {
+	case mediaTypeDockerManifestList, v1.MediaTypeImageIndex:
+		return true, nil
+	case "":
+		return manifest.Manifests != nil, nil
+	default:
+		return false, nil
+	}
+}
+
+// selectPlatform picks the windows/amd64 manifest for the given Windows build
+// out of an index. When no build is given, the index must contain exactly
+// one windows/amd64 manifest.
+func selectPlatform(index v1.Index, build string) (v1.Descriptor, error) {
+	var candidates, matches []v1.Descriptor
+
+	for _, manifest := range index.Manifests {
+		if manifest.Platform == nil || manifest.Platform.OS != "windows" || manifest.Platform.Architecture != "amd64" {
+			continue
+		}
+		candidates = append(candidates, manifest)
+
+		if build != "" && matchesBuild(manifest.Platform.OSVersion, build) {
+			matches = append(matches, manifest)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return v1.Descriptor{}, fmt.Errorf("no windows/amd64 image found in manifest list (available: %s)", describePlatforms(index.Manifests))
+	}
+
+	if build == "" {
+		if len(candidates) > 1 {
+			return v1.Descriptor{}, fmt.Errorf("manifest list contains several windows/amd64 images (%s); specify the Windows build to use", describePlatforms(candidates))
+		}
+		return candidates[0], nil
+	}
+
+	if len(matches) == 0 {
+		return v1.Descriptor{}, fmt.Errorf("no windows/amd64 image for Windows build %s found in manifest list (available: %s)", build, describePlatforms(candidates))
+	}
+
+	return matches[0], nil
+}
+
+// matchesBuild reports whether osVersion, such as 10.0.17763.1879, belongs to
+// build, which may be given with or without the revision.
+func matchesBuild(osVersion, build string) bool {
+	return osVersion == build || strings.HasPrefix(osVersion, build+".")
+}
+
+func describePlatform(platform *v1.Platform) string {
+	if platform == nil {
+		return "unknown"
+	}
+
+	description := fmt.Sprintf("%s/%s", platform.OS, platform.Architecture)
+	if platform.OSVersion != "" {
+		description += " " + platform.OSVersion
+	}
+	return description
+}
+
+func describePlatforms(manifests []v1.Descriptor) string {
+	var descriptions []string
+	for _, manifest := range manifests {
+		descriptions = append(descriptions, describePlatform(manifest.Platform))
+	}
+	return strings.Join(descriptions, ", ")
+}
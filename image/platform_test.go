@@ -0,0 +1,33 @@
+package image_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/winfs-injector/image"
+)
+
+var _ = Describe("WindowsBuildForTag", func() {
+	DescribeTable("derives the windows build from the image tag",
+		func(tag, build string) {
+			Expect(image.WindowsBuildForTag(tag)).To(Equal(build))
+		},
+		Entry("windows 2016", "1607.0.12", "10.0.14393"),
+		Entry("version 1709", "1709.0.5", "10.0.16299"),
+		Entry("version 1803", "1803.0.7", "10.0.17134"),
+		Entry("windows 2019", "2019.0.43", "10.0.17763"),
+		Entry("windows 2022", "2022.0.1", "10.0.20348"),
+		Entry("unknown release", "latest", ""),
+	)
+})
+
+var _ = Describe("WindowsBuildForOSVersion", func() {
+	DescribeTable("drops the revision of the os version",
+		func(osVersion, build string) {
+			Expect(image.WindowsBuildForOSVersion(osVersion)).To(Equal(build))
+		},
+		Entry("with a revision", "10.0.17763.1879", "10.0.17763"),
+		Entry("without a revision", "10.0.20348", "10.0.20348"),
+		Entry("empty", "", ""),
+	)
+})
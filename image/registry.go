@@ -0,0 +1,268 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	manifestURL = "%s/v2/%s/manifests/%s"
+	blobURL     = "%s/v2/%s/blobs/%s"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// idleTimeout is how long a response body may go without delivering any data
+// before its request is abandoned, so that a stalled connection fails the
+// attempt instead of hanging the download.
+var idleTimeout = time.Minute
+
+var authenticateHeaderPattern = regexp.MustCompile(`realm="(.*)".*service="(.*)".*scope="(.*)".*`)
+
+type registry struct {
+	serverURL string
+	imageName string
+	client    *http.Client
+
+	tokenMutex sync.Mutex
+	token      string
+}
+
+func newRegistry(serverURL, imageName string) *registry {
+	return &registry{
+		serverURL: serverURL,
+		imageName: imageName,
+		client:    newHTTPClient(),
+	}
+}
+
+// newHTTPClient returns a client that gives up on connections that cannot be
+// established or do not answer, unlike http.DefaultClient. There is no
+// overall timeout, as a layer can take hours to download; a body that stalls
+// is caught by idleTimeout instead.
+func newHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
+
+func (r *registry) manifest(reference string, acceptMediaTypes ...string) ([]byte, error) {
+	header := http.Header{}
+	for _, mediaType := range acceptMediaTypes {
+		header.Add("Accept", mediaType)
+	}
+
+	resp, err := r.get(context.Background(), fmt.Sprintf(manifestURL, r.serverURL, r.imageName, reference), header, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// blob requests the blob with the given digest from the registry, starting at
+// offset. Servers that do not support range requests answer with the whole
+// blob, which callers can detect from the response status.
+func (r *registry) blob(ctx context.Context, d digest.Digest, offset int64) (*http.Response, error) {
+	return r.get(ctx, r.blobURL(d), rangeHeader(offset), true)
+}
+
+func (r *registry) blobURL(d digest.Digest) string {
+	return fmt.Sprintf(blobURL, r.serverURL, r.imageName, d)
+}
+
+// external requests a blob hosted outside of the registry. No registry
+// credentials are sent with the request.
+func (r *registry) external(ctx context.Context, url string, offset int64) (*http.Response, error) {
+	return r.get(ctx, url, rangeHeader(offset), false)
+}
+
+func (r *registry) get(ctx context.Context, url string, header http.Header, authenticate bool) (*http.Response, error) {
+	resp, err := r.do(ctx, url, header, authenticate)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && authenticate {
+		challenge := resp.Header.Get("Www-Authenticate")
+		resp.Body.Close()
+
+		if err := r.refreshToken(challenge); err != nil {
+			return nil, err
+		}
+
+		resp, err = r.do(ctx, url, header, authenticate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, statusError{
+			url:        url,
+			statusCode: resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	return resp, nil
+}
+
+func (r *registry) do(ctx context.Context, url string, header http.Header, authenticate bool) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if authenticate {
+		r.tokenMutex.Lock()
+		token := r.token
+		r.tokenMutex.Unlock()
+
+		if token != "" {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = newIdleTimeoutBody(resp.Body, url, cancel)
+	return resp, nil
+}
+
+// idleTimeoutBody cancels its request when no data has been read from it for
+// idleTimeout.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	url     string
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired int32
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, url string, cancel context.CancelFunc) *idleTimeoutBody {
+	b := &idleTimeoutBody{body: body, url: url, cancel: cancel}
+	b.timer = time.AfterFunc(idleTimeout, func() {
+		atomic.StoreInt32(&b.expired, 1)
+		cancel()
+	})
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if atomic.LoadInt32(&b.expired) == 1 {
+		return n, fmt.Errorf("no data received from %s for %s", b.url, idleTimeout)
+	}
+	b.timer.Reset(idleTimeout)
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
+
+func (r *registry) refreshToken(challenge string) error {
+	matches := authenticateHeaderPattern.FindStringSubmatch(challenge)
+	if len(matches) != 4 {
+		return fmt.Errorf("unable to parse registry authentication challenge: %q", challenge)
+	}
+	realm, service, scope := matches[1], matches[2], matches[3]
+
+	resp, err := r.client.Get(fmt.Sprintf("%s?service=%s&scope=%s", realm, service, scope))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError{
+			url:        realm,
+			statusCode: resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	var token struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+
+	r.tokenMutex.Lock()
+	r.token = token.Token
+	r.tokenMutex.Unlock()
+
+	return nil
+}
+
+func rangeHeader(offset int64) http.Header {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return header
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
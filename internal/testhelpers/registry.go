@@ -0,0 +1,334 @@
+// Package testhelpers holds the fixtures shared by the test suites: a fake
+// docker registry serving windows images, and helpers to read tarballs and
+// copy release directories.
+package testhelpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/gomega"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerConfigMediaType   = "application/vnd.docker.container.image.v1+json"
+	dockerLayerMediaType    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	dockerForeignMediaType  = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// Registry is a fake docker registry serving the images of a single
+// repository.
+type Registry struct {
+	server    *httptest.Server
+	imageName string
+
+	mutex     sync.Mutex
+	manifests map[string][]byte
+	blobs     map[digest.Digest][]byte
+	failures  map[digest.Digest][]BlobFailure
+	requests  []string
+	ranges    []string
+
+	inFlight    int
+	maxInFlight int
+	delay       time.Duration
+}
+
+// BlobFailure describes how a single request for a blob fails. When Status is
+// zero, the first DropAfter bytes are sent before the connection is dropped,
+// or before it stalls until the client gives up when Stall is set.
+type BlobFailure struct {
+	Status     int
+	RetryAfter string
+	DropAfter  int
+	Stall      bool
+}
+
+// NewRegistry starts a registry serving the repository imageName.
+func NewRegistry(imageName string) *Registry {
+	r := &Registry{
+		imageName: imageName,
+		manifests: map[string][]byte{},
+		blobs:     map[digest.Digest][]byte{},
+		failures:  map[digest.Digest][]BlobFailure{},
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+func (r *Registry) URL() string {
+	return r.server.URL
+}
+
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+func (r *Registry) Requests() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.requests...)
+}
+
+func (r *Registry) Ranges() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string{}, r.ranges...)
+}
+
+func (r *Registry) MaxInFlight() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.maxInFlight
+}
+
+// SetDelay makes every blob request take at least the given time.
+func (r *Registry) SetDelay(delay time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.delay = delay
+}
+
+// FailBlob makes the next requests for the blob fail, one failure per request.
+func (r *Registry) FailBlob(d digest.Digest, failures ...BlobFailure) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.failures[d] = append(r.failures[d], failures...)
+}
+
+func (r *Registry) AddBlob(contents []byte) digest.Digest {
+	d := digest.FromBytes(contents)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.blobs[d] = contents
+
+	return d
+}
+
+func (r *Registry) SetBlob(d digest.Digest, contents []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.blobs[d] = contents
+}
+
+// AddImage publishes a windows image made of the given layers under tag and
+// returns the digest of its manifest.
+func (r *Registry) AddImage(tag string, layers ...[]byte) digest.Digest {
+	return r.AddManifest(tag, r.BuildManifest(Platform{OS: "windows", OSVersion: "10.0.17763.1879"}, layers...))
+}
+
+// Platform is the os and os.version of an image config.
+type Platform struct {
+	OS        string
+	OSVersion string
+}
+
+// AddIndex publishes a manifest list with an image of the given layers for
+// each platform under tag, and returns the digest of the list.
+func (r *Registry) AddIndex(tag string, platforms []Platform, layers ...[]byte) digest.Digest {
+	var manifests []v1.Descriptor
+	for _, platform := range platforms {
+		manifest := r.BuildManifest(platform, layers...)
+		manifests = append(manifests, v1.Descriptor{
+			MediaType: dockerManifestMediaType,
+			Size:      int64(len(manifest)),
+			Digest:    r.AddManifest(digest.FromBytes(manifest).String(), manifest),
+			Platform: &v1.Platform{
+				OS:           platform.OS,
+				Architecture: "amd64",
+				OSVersion:    platform.OSVersion,
+			},
+		})
+	}
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.docker.distribution.manifest.list.v2+json",
+		"manifests":     manifests,
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	return r.AddManifest(tag, index)
+}
+
+// AddForeignImage publishes a windows image under tag whose first layer is
+// the foreign layer base, hosted at baseURL rather than in the registry.
+func (r *Registry) AddForeignImage(tag string, baseURL string, base []byte, layers ...[]byte) digest.Digest {
+	return r.AddForeignImageOfType(tag, dockerForeignMediaType, baseURL, base, layers...)
+}
+
+// AddForeignImageOfType is AddForeignImage with a base layer of the media
+// type, such as one of the OCI non-distributable layer types.
+func (r *Registry) AddForeignImageOfType(tag, mediaType, baseURL string, base []byte, layers ...[]byte) digest.Digest {
+	foreign := v1.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(base)),
+		Digest:    digest.FromBytes(base),
+		URLs:      []string{baseURL},
+	}
+	return r.AddManifest(tag, r.buildManifestWithForeignLayers(Platform{OS: "windows", OSVersion: "10.0.17763.1879"}, []v1.Descriptor{foreign}, layers...))
+}
+
+// BuildManifest adds the layers and a config for platform, and returns a
+// manifest of them.
+func (r *Registry) BuildManifest(platform Platform, layers ...[]byte) []byte {
+	return r.buildManifestWithForeignLayers(platform, nil, layers...)
+}
+
+func (r *Registry) buildManifestWithForeignLayers(platform Platform, foreignLayers []v1.Descriptor, layers ...[]byte) []byte {
+	var (
+		descriptors []v1.Descriptor
+		diffIDs     []digest.Digest
+	)
+
+	for _, foreign := range foreignLayers {
+		descriptors = append(descriptors, foreign)
+		diffIDs = append(diffIDs, digest.FromString("diff-"+foreign.Digest.String()))
+	}
+
+	for _, layer := range layers {
+		descriptors = append(descriptors, v1.Descriptor{
+			MediaType: dockerLayerMediaType,
+			Size:      int64(len(layer)),
+			Digest:    r.AddBlob(layer),
+		})
+		diffIDs = append(diffIDs, digest.FromBytes(append([]byte("diff-"), layer...)))
+	}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"os":           platform.OS,
+		"os.version":   platform.OSVersion,
+		"architecture": "amd64",
+		"rootfs":       v1.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     dockerManifestMediaType,
+		"config": v1.Descriptor{
+			MediaType: dockerConfigMediaType,
+			Size:      int64(len(config)),
+			Digest:    r.AddBlob(config),
+		},
+		"layers": descriptors,
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	return manifest
+}
+
+func (r *Registry) AddManifest(tag string, manifest []byte) digest.Digest {
+	d := digest.FromBytes(manifest)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.manifests[tag] = manifest
+	r.manifests[d.String()] = manifest
+
+	return d
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	r.requests = append(r.requests, req.URL.Path)
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" {
+		r.ranges = append(r.ranges, rangeHeader)
+	}
+	r.mutex.Unlock()
+
+	prefix := fmt.Sprintf("/v2/%s/", r.imageName)
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, prefix), "/", 2)
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if parts[0] == "manifests" {
+		r.mutex.Lock()
+		contents, ok := r.manifests[parts[1]]
+		r.mutex.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Write(contents)
+		return
+	}
+
+	d := digest.Digest(parts[1])
+
+	r.mutex.Lock()
+	contents, ok := r.blobs[d]
+	var failure *BlobFailure
+	if len(r.failures[d]) > 0 {
+		failure = &r.failures[d][0]
+		r.failures[d] = r.failures[d][1:]
+	}
+	r.inFlight++
+	if r.inFlight > r.maxInFlight {
+		r.maxInFlight = r.inFlight
+	}
+	delay := r.delay
+	r.mutex.Unlock()
+
+	defer func() {
+		r.mutex.Lock()
+		r.inFlight--
+		r.mutex.Unlock()
+	}()
+
+	time.Sleep(delay)
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if failure != nil && failure.Status != 0 {
+		if failure.RetryAfter != "" {
+			w.Header().Set("Retry-After", failure.RetryAfter)
+		}
+		w.WriteHeader(failure.Status)
+		return
+	}
+
+	var offset int
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" {
+		_, err := fmt.Sscanf(rangeHeader, "bytes=%d-", &offset)
+		Expect(err).NotTo(HaveOccurred())
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(contents)-1, len(contents)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)-offset))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+	}
+
+	if failure != nil {
+		w.Write(contents[offset:failure.DropAfter])
+		w.(http.Flusher).Flush()
+		if failure.Stall {
+			<-req.Context().Done()
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	w.Write(contents[offset:])
+}
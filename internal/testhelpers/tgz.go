@@ -0,0 +1,44 @@
+package testhelpers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	. "github.com/onsi/gomega"
+)
+
+// ReadTgz returns the contents of the files in a gzipped tarball by name.
+func ReadTgz(tgz []byte) map[string][]byte {
+	return readTgz(bytes.NewReader(tgz))
+}
+
+// ReadTgzFile returns the contents of the files in the gzipped tarball at
+// path by name.
+func ReadTgzFile(path string) map[string][]byte {
+	contents, err := ioutil.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+
+	return ReadTgz(contents)
+}
+
+func readTgz(r io.Reader) map[string][]byte {
+	gzr, err := gzip.NewReader(r)
+	Expect(err).NotTo(HaveOccurred())
+
+	entries := map[string][]byte{}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		Expect(err).NotTo(HaveOccurred())
+
+		contents, err := ioutil.ReadAll(tr)
+		Expect(err).NotTo(HaveOccurred())
+		entries[hdr.Name] = contents
+	}
+}
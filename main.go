@@ -5,27 +5,107 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/pivotal-cf/jhanda"
+	"github.com/pivotal-cf/winfs-injector/image"
+	"github.com/pivotal-cf/winfs-injector/release"
 	"github.com/pivotal-cf/winfs-injector/tile"
 	"github.com/pivotal-cf/winfs-injector/winfsinjector"
 )
 
+// version is set at build time, and recorded in the provenance of the tiles
+// the injector writes.
+var version = "dev"
+
 const usageText = `winfs-injector injects the Windows 2016 root file system into the Windows 2016 Runtime Tile.
 
 Usage: winfs-injector
   --input-tile, -i   path to input tile (example: /path/to/input.pivotal)
   --output-tile, -o  path to output tile (example: /path/to/output.pivotal)
   --registry, -r     path to docker registry (example: /path/to/registry, default: "https://registry.hub.docker.com")
+  --image-digest     manifest digest the rootfs image must resolve to (example: sha256:4b2d...)
+  --image-lock       path to a lock file pinning the rootfs image digest (example: /path/to/image-lock.yml)
+  --cache-dir        path to a directory caching image layers between runs (example: /path/to/cache)
+  --parallelism      number of image layers downloaded at the same time (default: 4)
+  --max-bandwidth    caps the combined download rate per second (example: 20MB)
+  --os-version       windows build selected from multi-platform images (example: 10.0.17763, default: derived from the image tag)
+  --foreign-layers   how foreign base layers are handled: include, skip or require-mirror (default: include)
+  --gzip-level       compression of the release tarball: 1-9, fastest, default or best (default: default)
+  --gzip-workers     number of blocks of the release tarball compressed in parallel (default: number of CPUs)
+  --release-tarball  prebuilt windowsfs release injected instead of building one (example: /path/to/windows2019fs-9.3.6.tgz)
+  --export-release   directory receiving a copy of the release tarball with its checksums (example: /path/to/export)
+  --metadata-ops-file
+                     go-patch ops file applied to the product metadata after the release is added, can be repeated (example: /path/to/ops.yml)
+  --version-suffix   appended to the product_version of the tile, so injected tiles can be told apart (example: +winfs)
+  --allow-mismatch   warns instead of failing when the rootfs image is built for another Windows build than the stemcell of the tile
+  --metadata-file    product metadata inside the tile, instead of discovering it in metadata/ (example: metadata/windows.yml)
+  --replace-release  replaces a windowsfs release the tile metadata already lists with another version, instead of failing
+  --reproducible     identical inputs produce byte-identical release tarballs and tiles, dated $SOURCE_DATE_EPOCH (default: 1980-01-01)
   --help, -h         prints this usage information
+
+Other commands:
+  add-release        adds a bosh release to a tile (see: winfs-injector add-release --help)
+  cache              lists or prunes the image layer cache (see: winfs-injector cache --help)
+  diff               compares the files and product metadata of two tiles (see: winfs-injector diff --help)
+  remove-release     removes a bosh release from a tile (see: winfs-injector remove-release --help)
 `
 
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "add-release" || os.Args[1] == "remove-release") {
+		err := runReleaseCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		differ, err := runDiff(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(2)
+		}
+		if differ {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		err := runCache(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	var arguments struct {
-		InputTile  string `short:"i" long:"input-tile"`
-		OutputTile string `short:"o" long:"output-tile"`
-		Registry   string `short:"r" long:"registry" default:"https://registry.hub.docker.com"`
-		Help       bool   `short:"h" long:"help"`
+		InputTile      string   `short:"i" long:"input-tile"`
+		OutputTile     string   `short:"o" long:"output-tile"`
+		Registry       string   `short:"r" long:"registry" default:"https://registry.hub.docker.com"`
+		ImageDigest    string   `long:"image-digest"`
+		ImageLock      string   `long:"image-lock"`
+		CacheDir       string   `long:"cache-dir"`
+		Parallelism    int      `long:"parallelism" default:"4"`
+		MaxBandwidth   string   `long:"max-bandwidth"`
+		OSVersion      string   `long:"os-version"`
+		ForeignLayers  string   `long:"foreign-layers" default:"include"`
+		GzipLevel      string   `long:"gzip-level" default:"default"`
+		GzipWorkers    int      `long:"gzip-workers"`
+		ReleaseTarball string   `long:"release-tarball"`
+		ExportRelease  string   `long:"export-release"`
+		Reproducible   bool     `long:"reproducible"`
+		ReplaceRelease bool     `long:"replace-release"`
+		MetadataFile   string   `long:"metadata-file"`
+		AllowMismatch  bool     `long:"allow-mismatch"`
+		VersionSuffix  string   `long:"version-suffix"`
+		MetadataOps    []string `long:"metadata-ops-file"`
+		Help           bool     `short:"h" long:"help"`
 	}
 
 	_, err := jhanda.Parse(&arguments, os.Args[1:])
@@ -38,9 +118,28 @@ func main() {
 		return
 	}
 
-	var tileInjector = tile.NewTileInjector()
-	var zipper = tile.NewZipper()
-	var releaseCreator = winfsinjector.ReleaseCreator{}
+	var maxBandwidth uint64
+	if arguments.MaxBandwidth != "" {
+		maxBandwidth, err = humanize.ParseBytes(arguments.MaxBandwidth)
+		if err != nil {
+			log.Fatalf("invalid --max-bandwidth: %s", err)
+		}
+	}
+
+	foreignLayers, err := image.ParseForeignLayerPolicy(arguments.ForeignLayers)
+	if err != nil {
+		log.Fatalf("invalid --foreign-layers: %s", err)
+	}
+
+	compressionLevel, err := release.ParseCompressionLevel(arguments.GzipLevel)
+	if err != nil {
+		log.Fatalf("invalid --gzip-level: %s", err)
+	}
+
+	sourceDate, err := sourceDate(arguments.Reproducible)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	wd, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -48,7 +147,41 @@ func main() {
 	}
 	defer os.RemoveAll(wd)
 
+	var tileInjector = tile.NewTileInjector(log.New(os.Stdout, "", 0))
+	tileInjector.MetadataFile = arguments.MetadataFile
+	tileInjector.ProductVersionSuffix = arguments.VersionSuffix
+	tileInjector.MetadataOpsFiles = arguments.MetadataOps
+	if arguments.ReplaceRelease {
+		tileInjector.ExistingRelease = tile.ExistingReleaseReplace
+	}
+	var zipper = tile.NewZipper()
+	zipper.SourceDate = sourceDate
+	var releaseCreator = winfsinjector.ReleaseCreator{
+		Image: image.Config{
+			Digest:   arguments.ImageDigest,
+			LockFile: arguments.ImageLock,
+			CacheDir: arguments.CacheDir,
+
+			Parallelism:  arguments.Parallelism,
+			MaxBandwidth: int64(maxBandwidth),
+
+			OSVersion:     arguments.OSVersion,
+			ForeignLayers: foreignLayers,
+		},
+		Release: release.Config{
+			CompressionLevel:   compressionLevel,
+			CompressionWorkers: arguments.GzipWorkers,
+			SourceDate:         sourceDate,
+		},
+		ScratchDir: wd,
+	}
+
 	app := winfsinjector.NewApplication(releaseCreator, tileInjector, zipper)
+	app.ReleaseTarball = arguments.ReleaseTarball
+	app.ExportDir = arguments.ExportRelease
+	app.AllowStemcellMismatch = arguments.AllowMismatch
+	app.InjectorVersion = version
+	app.InjectedAt = sourceDate
 
 	err = app.Run(arguments.InputTile, arguments.OutputTile, arguments.Registry, wd)
 	if err != nil {
@@ -57,6 +190,34 @@ func main() {
 	}
 }
 
+// defaultSourceDate dates reproducible outputs when SOURCE_DATE_EPOCH is not
+// set. It is the earliest time a zip file can record.
+var defaultSourceDate = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// sourceDate returns the time recorded in every entry of reproducible outputs,
+// SOURCE_DATE_EPOCH when it is set, or the zero time when outputs need not be
+// reproducible. SOURCE_DATE_EPOCH is only read in reproducible mode, so that a
+// variable left in the environment does not change the outputs unasked.
+func sourceDate(reproducible bool) (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if !reproducible {
+		if epoch != "" {
+			fmt.Println("Ignoring SOURCE_DATE_EPOCH, as --reproducible is not set")
+		}
+		return time.Time{}, nil
+	}
+
+	if epoch == "" {
+		return defaultSourceDate, nil
+	}
+
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: expected the number of seconds since 1970-01-01", epoch)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
 func printUsage() {
 	fmt.Fprint(os.Stdout, usageText)
 }
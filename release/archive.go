@@ -0,0 +1,238 @@
+package release
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/pivotal-cf/winfs-injector/tarstream"
+)
+
+// archiveEntry is a directory or file of a job, package or license archive.
+type archiveEntry struct {
+	header tar.Header
+	// file is nil for directories.
+	file *file
+}
+
+// writeArchive writes files as a gzipped tarball rooted at "./", the layout
+// the bosh cli uses for job, package and license archives.
+func writeArchive(w io.Writer, files []file, config Config) error {
+	entries, err := archiveEntries(files, config)
+	if err != nil {
+		return err
+	}
+
+	gw, err := newGzipWriter(w, config)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gw)
+
+	if err := writeEntries(tw, entries); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// writeStreamedArchive writes files the way writeArchive does, but gzipped in
+// stored blocks that do not compress, so that the size of the archive is known
+// up front. It returns
+// that size and a function writing the archive, which records the digest of
+// every blob in its file.
+func writeStreamedArchive(files []file, config Config) (int64, func(io.Writer) error, error) {
+	entries, err := archiveEntries(files, config)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	headers := make([]*tar.Header, len(entries))
+	for i := range entries {
+		headers[i] = &entries[i].header
+	}
+	size, err := tarstream.Size(headers)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	write := func(w io.Writer) error {
+		gw := tarstream.NewGzipWriter(w)
+		tw := tar.NewWriter(gw)
+
+		if err := writeEntries(tw, entries); err != nil {
+			return err
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gw.Close()
+	}
+
+	return tarstream.GzipSize(size), write, nil
+}
+
+// archiveEntries returns the entries of an archive of files in name order,
+// preceded by their parent directories.
+func archiveEntries(files []file, config Config) ([]archiveEntry, error) {
+	sorted := make([]*file, len(files))
+	for i := range files {
+		sorted[i] = &files[i]
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	var (
+		now     = config.modTime(time.Now())
+		entries = []archiveEntry{{header: dirHeader("./", now)}}
+		dirs    = map[string]bool{}
+	)
+
+	var addParents func(name string)
+	addParents = func(name string) {
+		dir := path.Dir(name)
+		if dir == "." || dirs[dir] {
+			return
+		}
+		addParents(dir)
+		dirs[dir] = true
+		entries = append(entries, archiveEntry{header: dirHeader("./"+dir+"/", now)})
+	}
+
+	for _, f := range sorted {
+		addParents(f.name)
+
+		header, err := fileHeader("./"+f.name, *f, now)
+		if err != nil {
+			return nil, err
+		}
+		header.ModTime = config.modTime(header.ModTime)
+		entries = append(entries, archiveEntry{header: header, file: f})
+	}
+
+	return entries, nil
+}
+
+func writeEntries(tw *tar.Writer, entries []archiveEntry) error {
+	for _, entry := range entries {
+		header := entry.header
+		if err := tw.WriteHeader(&header); err != nil {
+			return err
+		}
+
+		f := entry.file
+		switch {
+		case f == nil || header.Typeflag == tar.TypeSymlink:
+		case f.blob != nil:
+			hash := sha256.New()
+			if err := f.blob.writeTo(io.MultiWriter(tw, hash)); err != nil {
+				return err
+			}
+			f.digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+		default:
+			if err := copyContents(tw, f.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeDir(tw *tar.Writer, name string, config Config) error {
+	header := dirHeader(name, config.modTime(time.Now()))
+	return tw.WriteHeader(&header)
+}
+
+func dirHeader(name string, modTime time.Time) tar.Header {
+	return tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+		ModTime:  modTime,
+	}
+}
+
+func fileHeader(name string, f file, now time.Time) (tar.Header, error) {
+	if f.blob != nil {
+		return tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     f.blob.Size,
+			Mode:     0644,
+			ModTime:  now,
+		}, nil
+	}
+
+	info, err := os.Lstat(f.path)
+	if err != nil {
+		return tar.Header{}, err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !f.followSymlinks {
+			target, err := os.Readlink(f.path)
+			if err != nil {
+				return tar.Header{}, err
+			}
+			return tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     name,
+				Linkname: target,
+				Mode:     0777,
+				ModTime:  info.ModTime(),
+			}, nil
+		}
+
+		info, err = os.Stat(f.path)
+		if err != nil {
+			return tar.Header{}, err
+		}
+	}
+
+	return regularHeader(name, info), nil
+}
+
+func regularHeader(name string, info os.FileInfo) tar.Header {
+	mode := int64(0644)
+	if info.Mode()&0111 != 0 {
+		mode = 0755
+	}
+
+	return tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     info.Size(),
+		Mode:     mode,
+		ModTime:  info.ModTime(),
+	}
+}
+
+func copyIntoArchive(tw *tar.Writer, name, path string, info os.FileInfo, config Config) error {
+	header := regularHeader(name, info)
+	header.ModTime = config.modTime(header.ModTime)
+	if err := tw.WriteHeader(&header); err != nil {
+		return err
+	}
+
+	return copyContents(tw, path)
+}
+
+func copyContents(w io.Writer, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(w, src)
+	return err
+}
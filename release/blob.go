@@ -0,0 +1,44 @@
+package release
+
+import (
+	"fmt"
+	"io"
+)
+
+// Blob is a blob of the release that is produced while the release tarball is
+// written, rather than read from the blobs directory, so that it never lands
+// on disk. A package that includes a blob is gzipped in stored blocks, which
+// do not compress, because the size of its archive has to be known before its
+// contents are; the release tarball around it is still compressed.
+type Blob struct {
+	// Name is the path of the blob relative to the blobs directory. It is
+	// matched against the files of package specs, and takes precedence over a
+	// file with the same path in the blobs directory.
+	Name string
+	Size int64
+	// Write writes exactly Size bytes of the blob to w.
+	Write func(w io.Writer) error
+}
+
+func (b Blob) writeTo(w io.Writer) error {
+	counter := &countingWriter{w: w}
+	if err := b.Write(counter); err != nil {
+		return err
+	}
+
+	if counter.n != b.Size {
+		return fmt.Errorf("blob '%s' is %d bytes, expected %d", b.Name, counter.n, b.Size)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
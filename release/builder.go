@@ -0,0 +1,656 @@
+package release
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bmatcuk/doublestar"
+	semver "github.com/cppforlife/go-semi-semantic/version"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Builder packs a release directory into a release tarball without the bosh
+// cli. Jobs, packages and the license are fingerprinted the way the bosh cli
+// fingerprints them, and their archives are written straight into the
+// release tarball.
+type Builder struct {
+	logger *log.Logger
+	config Config
+}
+
+type Config struct {
+	// CompressionLevel is the gzip level of the release tarball and the
+	// archives in it, from 1 to 9. Zero selects the default level.
+	CompressionLevel int
+	// CompressionWorkers is the number of blocks compressed in parallel. It
+	// defaults to the number of CPUs; a single worker compresses the way
+	// compress/gzip does.
+	CompressionWorkers int
+	// SourceDate, when set, is the modification time of every entry of the
+	// release tarball and of the archives in it, and blocks are compressed
+	// the same way whatever the number of workers, so that the same release
+	// directory and blobs always produce the same tarball.
+	SourceDate time.Time
+}
+
+// modTime is the modification time recorded for an entry last modified at t.
+func (c Config) modTime(t time.Time) time.Time {
+	if c.SourceDate.IsZero() {
+		return t
+	}
+	return c.SourceDate
+}
+
+// resource is a job, package or license of the release directory.
+type resource struct {
+	name        string
+	fingerprint string
+	files       []file
+	// dependencies are the packages of a job, or the dependencies of a
+	// package.
+	dependencies []string
+}
+
+func NewBuilder(logger *log.Logger, config Config) Builder {
+	return Builder{
+		logger: logger,
+		config: config,
+	}
+}
+
+// Tarball is a release tarball written by Build.
+type Tarball struct {
+	Path string
+	Size int64
+	// SHA1 and SHA256 are the hex digests of the tarball.
+	SHA1     string
+	SHA256   string
+	Manifest Manifest
+}
+
+// Build writes the release in releaseDir to tarballPath with the given
+// version. Blobs are streamed into the packages that include them.
+func (b Builder) Build(releaseDir, version, tarballPath string, blobs ...Blob) (Tarball, error) {
+	if _, err := semver.NewVersionFromString(version); err != nil {
+		return Tarball{}, fmt.Errorf("invalid release version %q: %s", version, err)
+	}
+
+	name, err := ReadName(releaseDir)
+	if err != nil {
+		return Tarball{}, err
+	}
+
+	commit, err := commitHash(releaseDir)
+	if err != nil {
+		return Tarball{}, fmt.Errorf("unable to determine the commit of %s: %s", releaseDir, err)
+	}
+
+	packages, err := readPackages(releaseDir, blobs)
+	if err != nil {
+		return Tarball{}, err
+	}
+
+	jobs, err := readJobs(releaseDir, packages)
+	if err != nil {
+		return Tarball{}, err
+	}
+
+	license, err := readLicense(releaseDir)
+	if err != nil {
+		return Tarball{}, err
+	}
+
+	manifest := Manifest{
+		Name:       name,
+		Version:    version,
+		CommitHash: commit,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(tarballPath), 0755); err != nil {
+		return Tarball{}, err
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(tarballPath), filepath.Base(tarballPath)+".tmp")
+	if err != nil {
+		return Tarball{}, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	var (
+		sha1Hash   = sha1.New()
+		sha256Hash = sha256.New()
+		counter    = &countingWriter{w: io.MultiWriter(out, sha1Hash, sha256Hash)}
+	)
+
+	gw, err := newGzipWriter(counter, b.config)
+	if err != nil {
+		return Tarball{}, err
+	}
+	tw := tar.NewWriter(gw)
+	w := tarballWriter{tw: tw, scratchDir: filepath.Dir(tarballPath), config: b.config}
+
+	if len(jobs) > 0 {
+		if err := writeDir(tw, "jobs/", b.config); err != nil {
+			return Tarball{}, err
+		}
+	}
+	for _, job := range jobs {
+		digest, err := w.addArchive("jobs/"+job.name+".tgz", job.files)
+		if err != nil {
+			return Tarball{}, fmt.Errorf("unable to write job %s: %s", job.name, err)
+		}
+		b.logger.Printf("Added job '%s/%s'\n", job.name, job.fingerprint)
+
+		manifest.Jobs = append(manifest.Jobs, JobRef{
+			Name:        job.name,
+			Version:     job.fingerprint,
+			Fingerprint: job.fingerprint,
+			SHA1:        digest,
+			Packages:    job.dependencies,
+		})
+	}
+
+	if len(packages) > 0 {
+		if err := writeDir(tw, "packages/", b.config); err != nil {
+			return Tarball{}, err
+		}
+	}
+	for _, pkg := range packages {
+		var digest string
+		if pkg.fingerprint == "" {
+			// The fingerprint of a package with blobs depends on their
+			// digests, which are only known once they have been streamed.
+			digest, err = w.addStreamedArchive("packages/"+pkg.name+".tgz", pkg.files)
+			if err == nil {
+				pkg.fingerprint, err = fingerprint(pkg.files, pkg.dependencies)
+			}
+		} else {
+			digest, err = w.addArchive("packages/"+pkg.name+".tgz", pkg.files)
+		}
+		if err != nil {
+			return Tarball{}, fmt.Errorf("unable to write package %s: %s", pkg.name, err)
+		}
+		b.logger.Printf("Added package '%s/%s'\n", pkg.name, pkg.fingerprint)
+
+		manifest.Packages = append(manifest.Packages, PackageRef{
+			Name:         pkg.name,
+			Version:      pkg.fingerprint,
+			Fingerprint:  pkg.fingerprint,
+			SHA1:         digest,
+			Dependencies: pkg.dependencies,
+		})
+	}
+
+	if license != nil {
+		digest, err := w.addArchive("license.tgz", license.files)
+		if err != nil {
+			return Tarball{}, fmt.Errorf("unable to write license: %s", err)
+		}
+		for _, f := range license.files {
+			if err := w.addFile(f.name, f.path); err != nil {
+				return Tarball{}, err
+			}
+		}
+		b.logger.Printf("Added license '%s/%s'\n", license.name, license.fingerprint)
+
+		manifest.License = &LicenseRef{
+			Version:     license.fingerprint,
+			Fingerprint: license.fingerprint,
+			SHA1:        digest,
+		}
+	}
+
+	// The manifest is written last because it records the digests of the
+	// archives before it. Readers extract the whole tarball, so the order of
+	// its entries does not matter to them.
+	contents, err := yaml.Marshal(manifest)
+	if err != nil {
+		return Tarball{}, err
+	}
+	if err := w.addBytes("release.MF", contents); err != nil {
+		return Tarball{}, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return Tarball{}, err
+	}
+	if err := gw.Close(); err != nil {
+		return Tarball{}, err
+	}
+	if err := out.Close(); err != nil {
+		return Tarball{}, err
+	}
+
+	if err := os.Rename(out.Name(), tarballPath); err != nil {
+		return Tarball{}, err
+	}
+
+	b.logger.Printf("Release name: %s\nRelease version: %s\nRelease tarball: %s\n", name, version, tarballPath)
+
+	return Tarball{
+		Path:     tarballPath,
+		Size:     counter.n,
+		SHA1:     hex.EncodeToString(sha1Hash.Sum(nil)),
+		SHA256:   hex.EncodeToString(sha256Hash.Sum(nil)),
+		Manifest: manifest,
+	}, nil
+}
+
+// tarballWriter adds entries to the release tarball. Each job and package
+// archive is staged in scratchDir, one at a time, because its size has to be
+// known before it can be added. Archives of packages with streamed blobs are
+// the exception: they are gzipped in stored blocks, which do not compress, so
+// their size is known up front.
+type tarballWriter struct {
+	tw         *tar.Writer
+	scratchDir string
+	config     Config
+}
+
+// addArchive packs files into an archive added to the tarball under name, and
+// returns the digest of the archive.
+func (w tarballWriter) addArchive(name string, files []file) (string, error) {
+	scratch, err := ioutil.TempFile(w.scratchDir, "archive")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(scratch.Name())
+	defer scratch.Close()
+
+	hash := sha256.New()
+	if err := writeArchive(io.MultiWriter(scratch, hash), files, w.config); err != nil {
+		return "", err
+	}
+
+	if err := scratch.Close(); err != nil {
+		return "", err
+	}
+
+	if err := w.addFile(name, scratch.Name()); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// addStreamedArchive packs files into an archive gzipped in stored blocks and
+// written straight into the tarball, without staging it, and returns the
+// digest of the archive.
+func (w tarballWriter) addStreamedArchive(name string, files []file) (string, error) {
+	size, write, err := writeStreamedArchive(files, w.config)
+	if err != nil {
+		return "", err
+	}
+
+	err = w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  w.config.modTime(time.Now()),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if err := write(io.MultiWriter(w.tw, hash)); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (w tarballWriter) addFile(name, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	return copyIntoArchive(w.tw, name, path, info, w.config)
+}
+
+func (w tarballWriter) addBytes(name string, contents []byte) error {
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(contents)),
+		Mode:     0644,
+		ModTime:  w.config.modTime(time.Now()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.tw.Write(contents)
+	return err
+}
+
+func readJobs(releaseDir string, packages []resource) ([]resource, error) {
+	dirs, err := subdirectories(filepath.Join(releaseDir, "jobs"))
+	if err != nil {
+		return nil, err
+	}
+
+	packageNames := map[string]bool{}
+	for _, pkg := range packages {
+		packageNames[pkg.name] = true
+	}
+
+	var jobs []resource
+	for _, dir := range dirs {
+		job, err := readJob(dir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read job from %s: %s", dir, err)
+		}
+
+		for _, pkg := range job.dependencies {
+			if !packageNames[pkg] {
+				return nil, fmt.Errorf("expected to find package '%s' since it's a dependency of job '%s'", pkg, job.name)
+			}
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].name < jobs[j].name })
+	return jobs, nil
+}
+
+func readJob(dir string) (resource, error) {
+	specPath := filepath.Join(dir, "spec")
+
+	var spec jobSpec
+	if err := readYAML(specPath, &spec); err != nil {
+		return resource{}, err
+	}
+
+	if filepath.Base(dir) != spec.Name {
+		return resource{}, fmt.Errorf("job directory '%s' does not match job name '%s' in spec", filepath.Base(dir), spec.Name)
+	}
+
+	// The spec is included as job.MF, unlike the spec of a package, so that
+	// changes to the job metadata change its fingerprint.
+	files := []file{{path: specPath, name: "job.MF", followSymlinks: true}}
+
+	monitPath := filepath.Join(dir, "monit")
+	if _, err := os.Stat(monitPath); err == nil {
+		files = append(files, file{path: monitPath, name: "monit", followSymlinks: true})
+	}
+
+	for src := range spec.Templates {
+		files = append(files, file{
+			path:           filepath.Join(dir, "templates", src),
+			name:           "templates/" + filepath.ToSlash(src),
+			followSymlinks: true,
+		})
+	}
+
+	fp, err := fingerprint(files, nil)
+	if err != nil {
+		return resource{}, err
+	}
+
+	return resource{name: spec.Name, fingerprint: fp, files: files, dependencies: spec.Packages}, nil
+}
+
+func readPackages(releaseDir string, blobs []Blob) ([]resource, error) {
+	dirs, err := subdirectories(filepath.Join(releaseDir, "packages"))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sources  = packageSources{src: filepath.Join(releaseDir, "src"), blobs: filepath.Join(releaseDir, "blobs"), streamed: blobs}
+		names    = map[string]bool{}
+		packages []resource
+	)
+
+	for _, dir := range dirs {
+		pkg, err := readPackage(dir, sources)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read package from %s: %s", dir, err)
+		}
+		names[pkg.name] = true
+		packages = append(packages, pkg)
+	}
+
+	for _, pkg := range packages {
+		for _, dependency := range pkg.dependencies {
+			if !names[dependency] {
+				return nil, fmt.Errorf("expected to find package '%s' since it's a dependency of package '%s'", dependency, pkg.name)
+			}
+		}
+	}
+
+	sort.Slice(packages, func(i, j int) bool { return packages[i].name < packages[j].name })
+	return packages, nil
+}
+
+func readPackage(dir string, sources packageSources) (resource, error) {
+	if _, err := os.Stat(filepath.Join(dir, "spec.lock")); err == nil {
+		return resource{}, fmt.Errorf("vendored packages (spec.lock) are not supported")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "pre_packaging")); err == nil {
+		return resource{}, fmt.Errorf("pre_packaging scripts are not supported")
+	}
+
+	var spec packageSpec
+	if err := readYAML(filepath.Join(dir, "spec"), &spec); err != nil {
+		return resource{}, err
+	}
+
+	packagingPath := filepath.Join(dir, "packaging")
+	if _, err := os.Stat(packagingPath); err != nil {
+		return resource{}, fmt.Errorf("expected to find '%s' for package '%s'", packagingPath, spec.Name)
+	}
+
+	included, err := matchFiles(spec.Files, sources, true)
+	if err != nil {
+		return resource{}, fmt.Errorf("package '%s': %s", spec.Name, err)
+	}
+
+	excluded, err := matchFiles(spec.ExcludedFiles, sources, false)
+	if err != nil {
+		return resource{}, fmt.Errorf("package '%s': %s", spec.Name, err)
+	}
+
+	// The spec itself is not part of a package; its dependencies are part of
+	// the fingerprint instead.
+	files := []file{{path: packagingPath, name: "packaging", excludeMode: true}}
+	streamed := false
+	for name, f := range included {
+		if name == "packaging" || name == "pre_packaging" {
+			return resource{}, fmt.Errorf("expected special '%s' file to not be included via 'files' key for package '%s'", name, spec.Name)
+		}
+		if _, ok := excluded[name]; !ok {
+			files = append(files, f)
+			streamed = streamed || f.blob != nil
+		}
+	}
+
+	var fp string
+	if !streamed {
+		fp, err = fingerprint(files, spec.Dependencies)
+		if err != nil {
+			return resource{}, err
+		}
+	}
+
+	return resource{name: spec.Name, fingerprint: fp, files: files, dependencies: spec.Dependencies}, nil
+}
+
+// packageSources are where the files of a package spec are looked up, in
+// order of precedence.
+type packageSources struct {
+	src      string
+	streamed []Blob
+	blobs    string
+}
+
+// matchFiles expands the globs of a package spec against the release's src
+// directory, the streamed blobs and the blobs directory. A file found in src
+// takes precedence over a blob with the same path.
+func matchFiles(globs []string, sources packageSources, required bool) (map[string]file, error) {
+	files := map[string]file{}
+
+	for _, glob := range globs {
+		found := false
+
+		add := func(name string, f file) {
+			found = true
+			if _, ok := files[name]; !ok {
+				files[name] = f
+			}
+		}
+
+		if err := matchDir(glob, sources.src, add); err != nil {
+			return nil, err
+		}
+
+		for i, blob := range sources.streamed {
+			matched, err := doublestar.Match(glob, blob.Name)
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				add(blob.Name, file{name: blob.Name, blob: &sources.streamed[i]})
+			}
+		}
+
+		if err := matchDir(glob, sources.blobs, add); err != nil {
+			return nil, err
+		}
+
+		if required && !found {
+			return nil, fmt.Errorf("missing files for pattern '%s'", glob)
+		}
+	}
+
+	return files, nil
+}
+
+func matchDir(glob, source string, add func(name string, f file)) error {
+	matches, err := doublestar.Glob(filepath.Join(source, glob))
+	if err != nil {
+		return err
+	}
+
+	for _, match := range matches {
+		packageable, err := isPackageable(match, source)
+		if err != nil {
+			return err
+		}
+		if !packageable {
+			continue
+		}
+
+		rel, err := filepath.Rel(source, match)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		add(name, file{path: match, name: name})
+	}
+
+	return nil
+}
+
+// isPackageable reports whether path is a file that can be packed. Files
+// reached through a symlinked directory are skipped, as the bosh cli does.
+func isPackageable(path, source string) (bool, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+
+	if info.IsDir() {
+		return false, nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return true, nil
+	}
+
+	resolvedSource, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return false, err
+	}
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(source, path)
+	if err != nil {
+		return false, err
+	}
+	resolvedRel, err := filepath.Rel(resolvedSource, resolvedPath)
+	if err != nil {
+		return false, err
+	}
+
+	return rel == resolvedRel, nil
+}
+
+func readLicense(releaseDir string) (*resource, error) {
+	var files []file
+
+	for _, pattern := range []string{"LICENSE*", "NOTICE*"} {
+		matches, err := filepath.Glob(filepath.Join(releaseDir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, match := range matches {
+			files = append(files, file{
+				path:        match,
+				name:        filepath.Base(match),
+				useBasename: true,
+				excludeMode: true,
+			})
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	fp, err := fingerprint(files, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resource{name: "license", fingerprint: fp, files: files}, nil
+}
+
+func subdirectories(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return dirs, nil
+}
@@ -0,0 +1,302 @@
+package release_test
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/winfs-injector/internal/testhelpers"
+	"github.com/pivotal-cf/winfs-injector/release"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _ = Describe("Builder", func() {
+	var (
+		tmpDir      string
+		releaseDir  string
+		tarballPath string
+		builder     release.Builder
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		releaseDir = filepath.Join(tmpDir, "windowsfs-release")
+		Expect(testhelpers.CopyDir("fixtures/windowsfs-release", releaseDir)).To(Succeed())
+
+		tarballPath = filepath.Join(tmpDir, "releases", "windows2019fs-9.3.6.tgz")
+		builder = release.NewBuilder(log.New(GinkgoWriter, "", 0), release.Config{})
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("computes the same fingerprints as the bosh cli", func() {
+		tarball, err := builder.Build(releaseDir, "9.3.6", tarballPath)
+		Expect(err).NotTo(HaveOccurred())
+		manifest := tarball.Manifest
+
+		Expect(manifest.Name).To(Equal("windows2019fs"))
+		Expect(manifest.Version).To(Equal("9.3.6"))
+		Expect(manifest.CommitHash).To(Equal("non-git"))
+
+		Expect(manifest.Jobs).To(HaveLen(1))
+		Expect(manifest.Jobs[0].Name).To(Equal("windows2019fs"))
+		Expect(manifest.Jobs[0].Fingerprint).To(Equal("146c47469b4f9c2ebf4c83195c7f1f50af7f73d8e897932f6956f94c3a548bab"))
+		Expect(manifest.Jobs[0].Version).To(Equal(manifest.Jobs[0].Fingerprint))
+		Expect(manifest.Jobs[0].Packages).To(Equal([]string{"windows2019fs"}))
+
+		Expect(manifest.Packages).To(HaveLen(2))
+		Expect(manifest.Packages[0].Name).To(Equal("hwc-helper"))
+		Expect(manifest.Packages[0].Fingerprint).To(Equal("4eba18650abe2fa5512efc2f20fd300c2139799ff6d59afdffbefc59047f3e3e"))
+		Expect(manifest.Packages[1].Name).To(Equal("windows2019fs"))
+		Expect(manifest.Packages[1].Fingerprint).To(Equal("ebc91fda0febe6ad264e0fcd3b1c727241a7e1ddc3eeb360c3ff47fba01ba827"))
+		Expect(manifest.Packages[1].Dependencies).To(Equal([]string{"hwc-helper"}))
+
+		Expect(manifest.License).NotTo(BeNil())
+		Expect(manifest.License.Fingerprint).To(Equal("5340acb6b4b5d0af755765f5d778f6788e7f0819114fa0e892fa95f0b876a724"))
+	})
+
+	It("writes release.MF and the job and package archives into the tarball", func() {
+		tarball, err := builder.Build(releaseDir, "9.3.6", tarballPath)
+		Expect(err).NotTo(HaveOccurred())
+		manifest := tarball.Manifest
+
+		contents, err := ioutil.ReadFile(tarballPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tarball.Path).To(Equal(tarballPath))
+		Expect(tarball.Size).To(Equal(int64(len(contents))))
+		Expect(tarball.SHA1).To(Equal(fmt.Sprintf("%x", sha1.Sum(contents))))
+		Expect("sha256:" + tarball.SHA256).To(Equal(sha256Digest(contents)))
+
+		entries := testhelpers.ReadTgzFile(tarballPath)
+		Expect(entries).To(HaveKey("license.tgz"))
+		Expect(entries).To(HaveKeyWithValue("LICENSE", []byte("Apache License 2.0\n")))
+
+		expected, err := yaml.Marshal(manifest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveKeyWithValue("release.MF", expected))
+
+		job := entries["jobs/windows2019fs.tgz"]
+		Expect(manifest.Jobs[0].SHA1).To(Equal(sha256Digest(job)))
+		jobEntries := testhelpers.ReadTgz(job)
+		Expect(jobEntries).To(HaveKey("./job.MF"))
+		Expect(jobEntries).To(HaveKey("./monit"))
+		Expect(jobEntries).To(HaveKey("./templates/pre-start.ps1.erb"))
+
+		pkg := entries["packages/windows2019fs.tgz"]
+		Expect(manifest.Packages[1].SHA1).To(Equal(sha256Digest(pkg)))
+		pkgEntries := testhelpers.ReadTgz(pkg)
+		Expect(pkgEntries).To(HaveKey("./packaging"))
+		Expect(pkgEntries).To(HaveKeyWithValue("./windows2019fs/windows2016fs-2019.0.43.tgz", []byte("fake-rootfs-image\n")))
+
+		helperEntries := testhelpers.ReadTgz(entries["packages/hwc-helper.tgz"])
+		Expect(helperEntries).To(HaveKey("./hwc-helper/bin/helper"))
+		Expect(helperEntries).To(HaveKey("./hwc-helper/config.txt"))
+	})
+
+	Context("when the tarball is compressed in parallel", func() {
+		BeforeEach(func() {
+			level, err := release.ParseCompressionLevel("fastest")
+			Expect(err).NotTo(HaveOccurred())
+
+			builder = release.NewBuilder(log.New(GinkgoWriter, "", 0), release.Config{
+				CompressionLevel:   level,
+				CompressionWorkers: 4,
+			})
+		})
+
+		It("writes standard gzip archives with the same fingerprints", func() {
+			tarball, err := builder.Build(releaseDir, "9.3.6", tarballPath)
+			Expect(err).NotTo(HaveOccurred())
+			manifest := tarball.Manifest
+
+			Expect(manifest.Packages[1].Fingerprint).To(Equal("ebc91fda0febe6ad264e0fcd3b1c727241a7e1ddc3eeb360c3ff47fba01ba827"))
+
+			entries := testhelpers.ReadTgzFile(tarballPath)
+			pkgEntries := testhelpers.ReadTgz(entries["packages/windows2019fs.tgz"])
+			Expect(pkgEntries).To(HaveKeyWithValue("./windows2019fs/windows2016fs-2019.0.43.tgz", []byte("fake-rootfs-image\n")))
+		})
+	})
+
+	Context("when a source date is set", func() {
+		var sourceDate time.Time
+
+		BeforeEach(func() {
+			sourceDate = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+			builder = release.NewBuilder(log.New(GinkgoWriter, "", 0), release.Config{
+				CompressionWorkers: 1,
+				SourceDate:         sourceDate,
+			})
+		})
+
+		It("writes the same tarball whenever the release directory was written and however many workers compress it", func() {
+			first, err := builder.Build(releaseDir, "9.3.6", tarballPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			modified := time.Now().Add(-time.Hour)
+			err = filepath.Walk(releaseDir, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				return os.Chtimes(path, modified, modified)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			builder = release.NewBuilder(log.New(GinkgoWriter, "", 0), release.Config{
+				CompressionWorkers: 4,
+				SourceDate:         sourceDate,
+			})
+			second, err := builder.Build(releaseDir, "9.3.6", filepath.Join(tmpDir, "other", "windows2019fs-9.3.6.tgz"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(second.SHA256).To(Equal(first.SHA256))
+		})
+
+		It("fingerprints and archives files the same as a build without a source date", func() {
+			packaging := filepath.Join(releaseDir, "packages", "windows2019fs", "packaging")
+			Expect(os.Chmod(packaging, 0755)).To(Succeed())
+
+			dated, err := builder.Build(releaseDir, "9.3.6", tarballPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			builder = release.NewBuilder(log.New(GinkgoWriter, "", 0), release.Config{})
+			undated, err := builder.Build(releaseDir, "9.3.6", filepath.Join(tmpDir, "other", "windows2019fs-9.3.6.tgz"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(dated.Manifest.Packages).To(HaveLen(len(undated.Manifest.Packages)))
+			for i, pkg := range dated.Manifest.Packages {
+				Expect(pkg.Fingerprint).To(Equal(undated.Manifest.Packages[i].Fingerprint), pkg.Name)
+			}
+			Expect(dated.Manifest.Jobs).To(HaveLen(len(undated.Manifest.Jobs)))
+			for i, job := range dated.Manifest.Jobs {
+				Expect(job.Fingerprint).To(Equal(undated.Manifest.Jobs[i].Fingerprint), job.Name)
+			}
+
+			modes := map[string]int64{}
+			pkg := testhelpers.ReadTgzFile(tarballPath)["packages/windows2019fs.tgz"]
+			for _, archived := range readTgzInOrder(writeTemp(tmpDir, pkg)) {
+				modes[archived.header.Name] = archived.header.Mode
+			}
+			Expect(modes).To(HaveKeyWithValue("./packaging", int64(0755)))
+		})
+
+		It("dates every entry of the tarball and of its archives", func() {
+			_, err := builder.Build(releaseDir, "9.3.6", tarballPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, entry := range readTgzInOrder(tarballPath) {
+				Expect(entry.header.ModTime.Equal(sourceDate)).To(BeTrue(), entry.header.Name)
+
+				if filepath.Ext(entry.header.Name) == ".tgz" {
+					for _, archived := range readTgzInOrder(writeTemp(tmpDir, entry.contents)) {
+						Expect(archived.header.ModTime.Equal(sourceDate)).To(BeTrue(), entry.header.Name+": "+archived.header.Name)
+					}
+				}
+			}
+		})
+	})
+
+	Context("when a blob is streamed into the release", func() {
+		var blob release.Blob
+
+		BeforeEach(func() {
+			Expect(os.RemoveAll(filepath.Join(releaseDir, "blobs"))).To(Succeed())
+
+			contents := []byte("fake-rootfs-image\n")
+			blob = release.Blob{
+				Name: "windows2019fs/windows2016fs-2019.0.43.tgz",
+				Size: int64(len(contents)),
+				Write: func(w io.Writer) error {
+					_, err := w.Write(contents)
+					return err
+				},
+			}
+		})
+
+		It("writes it into the package with the same fingerprint as a blob on disk", func() {
+			tarball, err := builder.Build(releaseDir, "9.3.6", tarballPath, blob)
+			Expect(err).NotTo(HaveOccurred())
+			manifest := tarball.Manifest
+
+			Expect(manifest.Packages[1].Fingerprint).To(Equal("ebc91fda0febe6ad264e0fcd3b1c727241a7e1ddc3eeb360c3ff47fba01ba827"))
+
+			entries := testhelpers.ReadTgzFile(tarballPath)
+			pkg := entries["packages/windows2019fs.tgz"]
+			Expect(manifest.Packages[1].SHA1).To(Equal(sha256Digest(pkg)))
+
+			pkgEntries := testhelpers.ReadTgz(pkg)
+			Expect(pkgEntries).To(HaveKey("./packaging"))
+			Expect(pkgEntries).To(HaveKeyWithValue("./windows2019fs/windows2016fs-2019.0.43.tgz", []byte("fake-rootfs-image\n")))
+		})
+
+		It("returns an error when the blob is not as large as it claims", func() {
+			blob.Size++
+
+			_, err := builder.Build(releaseDir, "9.3.6", tarballPath, blob)
+			Expect(err).To(MatchError(ContainSubstring("blob 'windows2019fs/windows2016fs-2019.0.43.tgz' is 18 bytes, expected 19")))
+			Expect(tarballPath).NotTo(BeAnExistingFile())
+		})
+	})
+
+	It("records the commit the release directory is checked out at", func() {
+		gitDir := filepath.Join(releaseDir, ".git")
+		Expect(os.MkdirAll(filepath.Join(gitDir, "refs", "heads"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(gitDir, "HEAD"), []byte("ref: refs/heads/main\n"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(gitDir, "refs", "heads", "main"), []byte("6f2c1d0e9b8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e\n"), 0644)).To(Succeed())
+
+		tarball, err := builder.Build(releaseDir, "9.3.6", tarballPath)
+		Expect(err).NotTo(HaveOccurred())
+		manifest := tarball.Manifest
+
+		Expect(manifest.CommitHash).To(Equal("6f2c1d0"))
+	})
+
+	It("returns an error when a job depends on a missing package", func() {
+		Expect(os.RemoveAll(filepath.Join(releaseDir, "packages", "windows2019fs"))).To(Succeed())
+
+		_, err := builder.Build(releaseDir, "9.3.6", tarballPath)
+		Expect(err).To(MatchError("expected to find package 'windows2019fs' since it's a dependency of job 'windows2019fs'"))
+		Expect(tarballPath).NotTo(BeAnExistingFile())
+	})
+
+	It("returns an error when a package file pattern matches nothing", func() {
+		Expect(os.RemoveAll(filepath.Join(releaseDir, "blobs"))).To(Succeed())
+
+		_, err := builder.Build(releaseDir, "9.3.6", tarballPath)
+		Expect(err).To(MatchError(ContainSubstring("missing files for pattern 'windows2019fs/windows2016fs-*.tgz'")))
+	})
+
+	It("returns an error when the release version is invalid", func() {
+		_, err := builder.Build(releaseDir, "not a version", tarballPath)
+		Expect(err).To(MatchError(ContainSubstring(`invalid release version "not a version"`)))
+	})
+})
+
+func writeTemp(dir string, contents []byte) string {
+	f, err := ioutil.TempFile(dir, "")
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+
+	_, err = f.Write(contents)
+	Expect(err).NotTo(HaveOccurred())
+
+	return f.Name()
+}
+
+func sha256Digest(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
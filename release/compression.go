@@ -0,0 +1,64 @@
+package release
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+
+	"github.com/klauspost/pgzip"
+)
+
+// compressionBlockSize is the amount of data each worker compresses at a
+// time. Every block is compressed independently, at the cost of slightly
+// larger output than single-threaded gzip.
+const compressionBlockSize = 1 << 20
+
+// ParseCompressionLevel accepts a gzip level from 1 to 9, or one of the
+// presets fastest, default and best.
+func ParseCompressionLevel(s string) (int, error) {
+	switch s {
+	case "fastest":
+		return gzip.BestSpeed, nil
+	case "default", "":
+		return gzip.DefaultCompression, nil
+	case "best":
+		return gzip.BestCompression, nil
+	}
+
+	level, err := strconv.Atoi(s)
+	if err != nil || level < gzip.BestSpeed || level > gzip.BestCompression {
+		return 0, fmt.Errorf("invalid compression level %q: expected 1-9, fastest, default or best", s)
+	}
+	return level, nil
+}
+
+// newGzipWriter compresses to w with the configured level. With more than one
+// worker, blocks are compressed in parallel; the output is still a standard
+// gzip stream. With a source date, blocks are always compressed separately,
+// so the output does not depend on the number of workers.
+func newGzipWriter(w io.Writer, config Config) (io.WriteCloser, error) {
+	level := config.CompressionLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	workers := config.CompressionWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	if workers == 1 && config.SourceDate.IsZero() {
+		return gzip.NewWriterLevel(w, level)
+	}
+
+	gw, err := pgzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	if err := gw.SetConcurrency(compressionBlockSize, workers); err != nil {
+		return nil, err
+	}
+	return gw, nil
+}
@@ -0,0 +1,79 @@
+package release_test
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/winfs-injector/release"
+)
+
+var _ = Describe("ParseCompressionLevel", func() {
+	DescribeTable("levels",
+		func(s string, expected int) {
+			level, err := release.ParseCompressionLevel(s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(level).To(Equal(expected))
+		},
+		Entry("fastest", "fastest", gzip.BestSpeed),
+		Entry("default", "default", gzip.DefaultCompression),
+		Entry("best", "best", gzip.BestCompression),
+		Entry("a number", "6", 6),
+	)
+
+	It("returns an error for levels gzip does not support", func() {
+		_, err := release.ParseCompressionLevel("10")
+		Expect(err).To(MatchError(`invalid compression level "10": expected 1-9, fastest, default or best`))
+	})
+})
+
+// The benchmarks compress a 64MB blob, the way the release tarball and its
+// packages are compressed. compress/gzip at the default level is the path
+// releases were built with before.
+func BenchmarkCompressGzip(b *testing.B) {
+	benchmarkCompress(b, func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	})
+}
+
+func BenchmarkCompressParallel(b *testing.B) {
+	benchmarkCompress(b, func(w io.Writer) (io.WriteCloser, error) {
+		return release.NewGzipWriter(w, release.Config{})
+	})
+}
+
+func BenchmarkCompressParallelFastest(b *testing.B) {
+	benchmarkCompress(b, func(w io.Writer) (io.WriteCloser, error) {
+		return release.NewGzipWriter(w, release.Config{CompressionLevel: gzip.BestSpeed})
+	})
+}
+
+func benchmarkCompress(b *testing.B, newWriter func(io.Writer) (io.WriteCloser, error)) {
+	// Repeated runs of random bytes compress about as well as image layers.
+	blob := make([]byte, 64<<20)
+	chunk := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(chunk)
+	for i := 0; i < len(blob); i += len(chunk) {
+		copy(blob[i:], chunk[:len(chunk)/2+i%(len(chunk)/2)])
+	}
+
+	b.SetBytes(int64(len(blob)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w, err := newWriter(ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(blob); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package release
+
+import "io"
+
+func NewGzipWriter(w io.Writer, config Config) (io.WriteCloser, error) {
+	return newGzipWriter(w, config)
+}
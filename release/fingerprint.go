@@ -0,0 +1,133 @@
+package release
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// file is a file packed into a job, package or license archive.
+type file struct {
+	// path is where the file is read from.
+	path string
+	// name is the path of the file inside of the archive.
+	name string
+
+	// The fingerprinting options below mirror the ones of the bosh cli, so
+	// that fingerprints stay stable when switching between the two.
+	useBasename    bool
+	excludeMode    bool
+	followSymlinks bool
+
+	// blob is set for a file that is streamed into the archive instead of
+	// being read from path. Its digest is only known once it is written.
+	blob   *Blob
+	digest string
+}
+
+// fingerprint computes the content fingerprint of a job, package or license
+// the same way the bosh cli does: a sha256 over a version marker, every file's
+// name, digest and git-style mode in name order, and the additional chunks,
+// such as package dependencies.
+func fingerprint(files []file, additionalChunks []string) (string, error) {
+	sorted := append([]file{}, files...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	chunks := []string{"v2"}
+	for _, f := range sorted {
+		chunk, err := fingerprintFile(f)
+		if err != nil {
+			return "", err
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	if len(additionalChunks) > 0 {
+		sortedChunks := append([]string{}, additionalChunks...)
+		sort.Strings(sortedChunks)
+		chunks = append(chunks, strings.Join(sortedChunks, ","))
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(chunks, "")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func fingerprintFile(f file) (string, error) {
+	chunk := f.name
+	if f.useBasename {
+		chunk = filepath.Base(f.path)
+	}
+
+	if f.blob != nil {
+		if f.digest == "" {
+			return "", fmt.Errorf("blob '%s' has not been written yet", f.blob.Name)
+		}
+		return chunk + f.digest + "100644", nil
+	}
+
+	info, err := os.Lstat(f.path)
+	if err != nil {
+		return "", err
+	}
+	isSymlink := info.Mode()&os.ModeSymlink != 0
+
+	if isSymlink && !f.followSymlinks {
+		target, err := os.Readlink(f.path)
+		if err != nil {
+			return "", err
+		}
+		chunk += digestString(target)
+	} else {
+		digest, err := digestFile(f.path)
+		if err != nil {
+			return "", err
+		}
+		chunk += digest
+	}
+
+	if f.excludeMode {
+		return chunk, nil
+	}
+
+	// Git only tracks the executable bit, so modes are normalized the way git
+	// reports them to keep fingerprints stable across checkouts.
+	switch {
+	case info.IsDir():
+		chunk += "40755"
+	case isSymlink && !f.followSymlinks:
+		chunk += "symlink"
+	case info.Mode()&0111 != 0:
+		chunk += "100755"
+	default:
+		chunk += "100644"
+	}
+
+	return chunk, nil
+}
+
+// digestFile returns the sha256 of the file in the "sha256:<hex>" form used
+// throughout release manifests.
+func digestFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func digestString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,132 @@
+package release
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	nonGitCommitHash = "non-git"
+	emptyCommitHash  = "empty"
+	shortHashLength  = 7
+)
+
+// commitHash returns the abbreviated hash of the commit checked out in the
+// release directory, read straight from its .git directory. Like the bosh
+// cli, it returns "non-git" for directories that are not repositories and
+// "empty" for repositories without commits.
+func commitHash(releaseDir string) (string, error) {
+	gitDir, err := findGitDir(releaseDir)
+	if err != nil {
+		return "", err
+	}
+	if gitDir == "" {
+		return nonGitCommitHash, nil
+	}
+
+	head, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+
+	hash := strings.TrimSpace(string(head))
+	if ref := strings.TrimPrefix(hash, "ref: "); ref != hash {
+		hash, err = resolveRef(gitDir, ref)
+		if err != nil {
+			return "", err
+		}
+		if hash == "" {
+			return emptyCommitHash, nil
+		}
+	}
+
+	if len(hash) > shortHashLength {
+		hash = hash[:shortHashLength]
+	}
+	return hash, nil
+}
+
+// findGitDir returns the git directory of the repository releaseDir belongs
+// to, following the "gitdir:" files used by submodules and worktrees.
+func findGitDir(releaseDir string) (string, error) {
+	dir, err := filepath.Abs(releaseDir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		gitPath := filepath.Join(dir, ".git")
+		info, err := os.Stat(gitPath)
+		switch {
+		case err == nil && info.IsDir():
+			return gitPath, nil
+		case err == nil:
+			contents, err := ioutil.ReadFile(gitPath)
+			if err != nil {
+				return "", err
+			}
+			gitDir := strings.TrimSpace(strings.TrimPrefix(string(contents), "gitdir:"))
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return gitDir, nil
+		case !os.IsNotExist(err):
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+func resolveRef(gitDir, ref string) (string, error) {
+	for _, dir := range []string{gitDir, commonGitDir(gitDir)} {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(ref)))
+		if err == nil {
+			return strings.TrimSpace(string(contents)), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	packedRefs, err := os.Open(filepath.Join(commonGitDir(gitDir), "packed-refs"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer packedRefs.Close()
+
+	scanner := bufio.NewScanner(packedRefs)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == ref {
+			return fields[0], nil
+		}
+	}
+
+	return "", scanner.Err()
+}
+
+// commonGitDir returns the directory holding the refs shared by all the
+// worktrees of a repository.
+func commonGitDir(gitDir string) string {
+	contents, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+
+	common := strings.TrimSpace(string(contents))
+	if !filepath.IsAbs(common) {
+		common = filepath.Join(gitDir, common)
+	}
+	return common
+}
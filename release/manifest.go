@@ -0,0 +1,100 @@
+package release
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Manifest is the release.MF at the root of a release tarball. Its layout
+// matches the one written by the bosh cli, so that the director and
+// `bosh inspect-release` read both the same way.
+type Manifest struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+
+	CommitHash         string `yaml:"commit_hash"`
+	UncommittedChanges bool   `yaml:"uncommitted_changes"`
+
+	Jobs     []JobRef     `yaml:"jobs,omitempty"`
+	Packages []PackageRef `yaml:"packages,omitempty"`
+	License  *LicenseRef  `yaml:"license,omitempty"`
+}
+
+type JobRef struct {
+	Name        string   `yaml:"name"`
+	Version     string   `yaml:"version"`
+	Fingerprint string   `yaml:"fingerprint"`
+	SHA1        string   `yaml:"sha1"`
+	Packages    []string `yaml:"packages"`
+}
+
+type PackageRef struct {
+	Name         string   `yaml:"name"`
+	Version      string   `yaml:"version"`
+	Fingerprint  string   `yaml:"fingerprint"`
+	SHA1         string   `yaml:"sha1"`
+	Dependencies []string `yaml:"dependencies"`
+}
+
+type LicenseRef struct {
+	Version     string `yaml:"version"`
+	Fingerprint string `yaml:"fingerprint"`
+	SHA1        string `yaml:"sha1"`
+}
+
+type jobSpec struct {
+	Name      string            `yaml:"name"`
+	Templates map[string]string `yaml:"templates"`
+	Packages  []string          `yaml:"packages"`
+}
+
+type packageSpec struct {
+	Name          string   `yaml:"name"`
+	Dependencies  []string `yaml:"dependencies"`
+	Files         []string `yaml:"files"`
+	ExcludedFiles []string `yaml:"excluded_files"`
+}
+
+type finalConfig struct {
+	Name      string `yaml:"name"`
+	FinalName string `yaml:"final_name"`
+}
+
+// ReadName returns the release name from config/final.yml, which may be given
+// as either name or final_name.
+func ReadName(releaseDir string) (string, error) {
+	path := filepath.Join(releaseDir, "config", "final.yml")
+
+	var config finalConfig
+	if err := readYAML(path, &config); err != nil {
+		return "", err
+	}
+
+	switch {
+	case config.Name != "" && config.FinalName != "":
+		return "", fmt.Errorf("expected 'name' or 'final_name' but not both in %s", path)
+	case config.Name != "":
+		return config.Name, nil
+	case config.FinalName != "":
+		return config.FinalName, nil
+	default:
+		return "", errors.New("release name is missing from " + path)
+	}
+}
+
+func readYAML(path string, out interface{}) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.Unmarshal(contents, out); err != nil {
+		return fmt.Errorf("unable to parse %s: %s", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package release
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ReadManifest returns the release.MF of a release tarball, whether it was
+// built by this package or by the bosh cli, which prefixes entries with "./".
+func ReadManifest(tarballPath string) (Manifest, error) {
+	f, err := os.Open(tarballPath)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("unable to read release tarball %s: %s", tarballPath, err)
+	}
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return Manifest{}, fmt.Errorf("release tarball %s does not contain release.MF", tarballPath)
+		}
+		if err != nil {
+			return Manifest{}, fmt.Errorf("unable to read release tarball %s: %s", tarballPath, err)
+		}
+
+		if path.Clean(hdr.Name) != "release.MF" {
+			continue
+		}
+
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return Manifest{}, err
+		}
+
+		var manifest Manifest
+		if err := yaml.Unmarshal(contents, &manifest); err != nil {
+			return Manifest{}, fmt.Errorf("unable to parse release.MF of %s: %s", tarballPath, err)
+		}
+		return manifest, nil
+	}
+}
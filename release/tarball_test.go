@@ -0,0 +1,77 @@
+package release_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/winfs-injector/internal/testhelpers"
+	"github.com/pivotal-cf/winfs-injector/release"
+)
+
+var _ = Describe("ReadManifest", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("reads the manifest of a built release", func() {
+		releaseDir := filepath.Join(tmpDir, "windowsfs-release")
+		Expect(testhelpers.CopyDir("fixtures/windowsfs-release", releaseDir)).To(Succeed())
+
+		tarballPath := filepath.Join(tmpDir, "windows2019fs-9.3.6.tgz")
+		built, err := release.NewBuilder(log.New(GinkgoWriter, "", 0), release.Config{}).Build(releaseDir, "9.3.6", tarballPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		manifest, err := release.ReadManifest(tarballPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Name).To(Equal("windows2019fs"))
+		Expect(manifest.Version).To(Equal("9.3.6"))
+		Expect(manifest.Packages).To(HaveLen(len(built.Manifest.Packages)))
+	})
+
+	It("reads the manifest of a tarball with entries prefixed by ./", func() {
+		tarballPath := writeTarball(tmpDir, "./release.MF", "name: windows2019fs\nversion: 9.3.6\n")
+
+		manifest, err := release.ReadManifest(tarballPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Name).To(Equal("windows2019fs"))
+		Expect(manifest.Version).To(Equal("9.3.6"))
+	})
+
+	It("returns an error when the tarball has no release.MF", func() {
+		tarballPath := writeTarball(tmpDir, "./jobs/", "")
+
+		_, err := release.ReadManifest(tarballPath)
+		Expect(err).To(MatchError(ContainSubstring("does not contain release.MF")))
+	})
+})
+
+func writeTarball(dir, name, contents string) string {
+	path := filepath.Join(dir, "release.tgz")
+	f, err := os.Create(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))})).To(Succeed())
+	_, err = tw.Write([]byte(contents))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(tw.Close()).To(Succeed())
+	Expect(gw.Close()).To(Succeed())
+
+	return path
+}
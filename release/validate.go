@@ -0,0 +1,267 @@
+package release
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+	semver "github.com/cppforlife/go-semi-semantic/version"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SourceError lists the problems found in the source of a release.
+type SourceError struct {
+	Dir      string
+	Findings []string
+}
+
+func (e SourceError) Error() string {
+	return fmt.Sprintf("release source %s is invalid:\n- %s", e.Dir, strings.Join(e.Findings, "\n- "))
+}
+
+// ValidateSource returns the problems that would make Build fail on the
+// release in releaseDir, without reading any blob: specs that do not parse,
+// missing templates, packaging scripts and dependencies, package files that
+// Build would not find, an invalid VERSION and a missing name in
+// config/final.yml. producedBlobs are the blobs passed to Build, which need
+// not be in the blobs directory.
+func ValidateSource(releaseDir string, producedBlobs ...string) []string {
+	v := sourceValidator{dir: releaseDir}
+
+	v.validateVersion()
+	v.validateName()
+
+	blobs := v.readBlobs()
+	packages := v.validatePackages(blobs, producedBlobs)
+	v.validateJobs(packages)
+
+	return v.findings
+}
+
+type sourceValidator struct {
+	dir      string
+	findings []string
+}
+
+func (v *sourceValidator) findingf(format string, args ...interface{}) {
+	v.findings = append(v.findings, fmt.Sprintf(format, args...))
+}
+
+// readYAML parses the file at rel, a path relative to the release directory,
+// and tells whether it could.
+func (v *sourceValidator) readYAML(rel string, out interface{}) bool {
+	contents, err := ioutil.ReadFile(filepath.Join(v.dir, rel))
+	if os.IsNotExist(err) {
+		v.findingf("%s is missing", rel)
+		return false
+	}
+	if err != nil {
+		v.findingf("unable to read %s: %s", rel, err)
+		return false
+	}
+
+	if err := yaml.Unmarshal(contents, out); err != nil {
+		v.findingf("unable to parse %s: %s", rel, err)
+		return false
+	}
+
+	return true
+}
+
+func (v *sourceValidator) exists(rel string) bool {
+	_, err := os.Stat(filepath.Join(v.dir, rel))
+	return err == nil
+}
+
+func (v *sourceValidator) validateVersion() {
+	contents, err := ioutil.ReadFile(filepath.Join(v.dir, "VERSION"))
+	if os.IsNotExist(err) {
+		v.findingf("VERSION is missing")
+		return
+	}
+	if err != nil {
+		v.findingf("unable to read VERSION: %s", err)
+		return
+	}
+
+	version := strings.TrimSuffix(string(contents), "\n")
+	if version == "" {
+		v.findingf("VERSION is empty")
+		return
+	}
+
+	if _, err := semver.NewVersionFromString(version); err != nil {
+		v.findingf("VERSION %q is not a valid bosh version: %s", version, err)
+	}
+}
+
+func (v *sourceValidator) validateName() {
+	var config finalConfig
+	if !v.readYAML("config/final.yml", &config) {
+		return
+	}
+
+	switch {
+	case config.Name != "" && config.FinalName != "":
+		v.findingf("config/final.yml has both 'name' and 'final_name'")
+	case config.Name == "" && config.FinalName == "":
+		v.findingf("config/final.yml has no 'name'")
+	}
+}
+
+// readBlobs returns the paths of the blobs listed in config/blobs.yml, which
+// a release without blobs may omit.
+func (v *sourceValidator) readBlobs() []string {
+	if !v.exists("config/blobs.yml") {
+		return nil
+	}
+
+	var blobs map[string]interface{}
+	if !v.readYAML("config/blobs.yml", &blobs) {
+		return nil
+	}
+
+	var paths []string
+	for path := range blobs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// validatePackages returns the names of the packages, or nil when a spec does
+// not parse, as the dependencies on packages cannot be checked then.
+func (v *sourceValidator) validatePackages(blobs, producedBlobs []string) map[string]bool {
+	dirs, err := subdirectories(filepath.Join(v.dir, "packages"))
+	if err != nil {
+		v.findingf("unable to list packages: %s", err)
+		return nil
+	}
+
+	var (
+		names    = map[string]bool{}
+		specs    []packageSpec
+		complete = true
+	)
+	for _, dir := range dirs {
+		rel := filepath.Join("packages", filepath.Base(dir))
+
+		var spec packageSpec
+		if !v.readYAML(filepath.Join(rel, "spec"), &spec) {
+			complete = false
+			continue
+		}
+
+		if spec.Name == "" {
+			v.findingf("%s/spec has no name", rel)
+			complete = false
+			continue
+		}
+		names[spec.Name] = true
+		specs = append(specs, spec)
+
+		if v.exists(filepath.Join(rel, "spec.lock")) {
+			v.findingf("package '%s' is vendored (spec.lock), which is not supported", spec.Name)
+		}
+		if v.exists(filepath.Join(rel, "pre_packaging")) {
+			v.findingf("package '%s' has a pre_packaging script, which is not supported", spec.Name)
+		}
+		if !v.exists(filepath.Join(rel, "packaging")) {
+			v.findingf("package '%s' has no packaging script", spec.Name)
+		}
+
+		for _, glob := range spec.Files {
+			v.validatePackageFiles(spec.Name, glob, blobs, producedBlobs)
+		}
+	}
+
+	if !complete {
+		return nil
+	}
+
+	for _, spec := range specs {
+		for _, dependency := range spec.Dependencies {
+			if !names[dependency] {
+				v.findingf("package '%s' depends on package '%s', which does not exist", spec.Name, dependency)
+			}
+		}
+	}
+
+	return names
+}
+
+// validatePackageFiles checks that the glob of a package spec matches a file
+// the way Build looks them up: in src, among the produced blobs or in the
+// blobs directory. Build does not download blobs from the blobstore, so a blob
+// of config/blobs.yml that has not been synced to the blobs directory is
+// reported as missing.
+func (v *sourceValidator) validatePackageFiles(pkg, glob string, blobs, producedBlobs []string) {
+	sources := packageSources{src: filepath.Join(v.dir, "src"), blobs: filepath.Join(v.dir, "blobs")}
+	for _, blob := range producedBlobs {
+		sources.streamed = append(sources.streamed, Blob{Name: blob})
+	}
+
+	files, err := matchFiles([]string{glob}, sources, false)
+	if err != nil {
+		v.findingf("package '%s' file pattern '%s' is invalid: %s", pkg, glob, err)
+		return
+	}
+	if len(files) > 0 {
+		return
+	}
+
+	listed := false
+	for _, blob := range blobs {
+		if matched, _ := doublestar.Match(glob, blob); matched {
+			listed = true
+			v.findingf("package '%s' needs blob %s, which is listed in config/blobs.yml but missing from blobs/ (blobs are not downloaded from the blobstore)", pkg, blob)
+		}
+	}
+
+	if !listed {
+		v.findingf("package '%s' file pattern '%s' matches no file in src/ or blobs/", pkg, glob)
+	}
+}
+
+func (v *sourceValidator) validateJobs(packages map[string]bool) {
+	dirs, err := subdirectories(filepath.Join(v.dir, "jobs"))
+	if err != nil {
+		v.findingf("unable to list jobs: %s", err)
+		return
+	}
+
+	for _, dir := range dirs {
+		rel := filepath.Join("jobs", filepath.Base(dir))
+
+		var spec jobSpec
+		if !v.readYAML(filepath.Join(rel, "spec"), &spec) {
+			continue
+		}
+
+		if filepath.Base(dir) != spec.Name {
+			v.findingf("job directory '%s' does not match job name '%s' in spec", filepath.Base(dir), spec.Name)
+		}
+
+		var templates []string
+		for src := range spec.Templates {
+			templates = append(templates, src)
+		}
+		sort.Strings(templates)
+
+		for _, src := range templates {
+			if !v.exists(filepath.Join(rel, "templates", src)) {
+				v.findingf("job '%s' template %s is missing from %s/templates", spec.Name, src, rel)
+			}
+		}
+
+		for _, pkg := range spec.Packages {
+			if packages != nil && !packages[pkg] {
+				v.findingf("job '%s' depends on package '%s', which does not exist", spec.Name, pkg)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package release_test
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/winfs-injector/internal/testhelpers"
+	"github.com/pivotal-cf/winfs-injector/release"
+)
+
+var _ = Describe("ValidateSource", func() {
+	var (
+		tmpDir     string
+		releaseDir string
+	)
+
+	const producedBlob = "windows2019fs/windows2016fs-2019.0.43.tgz"
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		releaseDir = filepath.Join(tmpDir, "windowsfs-release")
+		Expect(testhelpers.CopyDir("fixtures/windowsfs-release", releaseDir)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	write := func(rel, contents string) {
+		path := filepath.Join(releaseDir, rel)
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+	}
+
+	It("finds nothing wrong with a release that builds", func() {
+		Expect(release.ValidateSource(releaseDir, producedBlob)).To(BeEmpty())
+	})
+
+	It("does not need the blobs produced by the image fetch in the blobs directory", func() {
+		Expect(os.RemoveAll(filepath.Join(releaseDir, "blobs"))).To(Succeed())
+
+		Expect(release.ValidateSource(releaseDir, producedBlob)).To(BeEmpty())
+	})
+
+	It("reports blobs that are listed but neither in the blobs directory nor produced", func() {
+		Expect(os.RemoveAll(filepath.Join(releaseDir, "blobs"))).To(Succeed())
+
+		Expect(release.ValidateSource(releaseDir)).To(ConsistOf(
+			"package 'windows2019fs' needs blob windows2019fs/windows2016fs-2019.0.43.tgz, which is listed in config/blobs.yml but missing from blobs/ (blobs are not downloaded from the blobstore)",
+		))
+	})
+
+	It("reports package files that are neither in src nor a blob", func() {
+		write("packages/hwc-helper/spec", "name: hwc-helper\nfiles:\n- hwc-helper/**/*\n- agent/agent-*.zip\n")
+
+		Expect(release.ValidateSource(releaseDir, producedBlob)).To(ConsistOf(
+			"package 'hwc-helper' file pattern 'agent/agent-*.zip' matches no file in src/ or blobs/",
+		))
+	})
+
+	It("accepts package files that are in the blobs directory without being listed in config/blobs.yml", func() {
+		write("packages/hwc-helper/spec", "name: hwc-helper\nfiles:\n- hwc-helper/**/*\n- agent/agent-*.zip\n")
+		write("blobs/agent/agent-1.0.zip", "agent")
+
+		Expect(release.ValidateSource(releaseDir, producedBlob)).To(BeEmpty())
+
+		_, err := release.NewBuilder(log.New(GinkgoWriter, "", 0), release.Config{}).Build(releaseDir, "1.0.0", filepath.Join(tmpDir, "release.tgz"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports every problem it finds", func() {
+		write("VERSION", "9.3.6-")
+		write("config/final.yml", "final_name: windows2019fs\nname: windows2019fs\n")
+		write("jobs/windows2019fs/spec", "name: windows2019fs\ntemplates: [\n")
+		write("packages/hwc-helper/spec", "name: hwc-helper\ndependencies:\n- golang\nfiles:\n- hwc-helper/**/*\n")
+		Expect(os.Remove(filepath.Join(releaseDir, "packages", "windows2019fs", "packaging"))).To(Succeed())
+
+		findings := release.ValidateSource(releaseDir, producedBlob)
+		Expect(findings).To(HaveLen(5))
+		Expect(findings[0]).To(HavePrefix(`VERSION "9.3.6-" is not a valid bosh version`))
+		Expect(findings[1]).To(Equal("config/final.yml has both 'name' and 'final_name'"))
+		Expect(findings[2]).To(Equal("package 'windows2019fs' has no packaging script"))
+		Expect(findings[3]).To(Equal("package 'hwc-helper' depends on package 'golang', which does not exist"))
+		Expect(findings[4]).To(HavePrefix("unable to parse jobs/windows2019fs/spec: "))
+	})
+
+	It("reports a missing VERSION and a release without a name", func() {
+		Expect(os.Remove(filepath.Join(releaseDir, "VERSION"))).To(Succeed())
+		write("config/final.yml", "blobstore:\n  provider: local\n")
+
+		Expect(release.ValidateSource(releaseDir, producedBlob)).To(ConsistOf(
+			"VERSION is missing",
+			"config/final.yml has no 'name'",
+		))
+	})
+
+	It("reports missing job templates and packages", func() {
+		write("jobs/windows2019fs/spec", "name: windows2019fs\ntemplates:\n  drain.erb: bin/drain\npackages:\n- windows2019fs\n- hwc\n")
+
+		Expect(release.ValidateSource(releaseDir, producedBlob)).To(ConsistOf(
+			"job 'windows2019fs' template drain.erb is missing from jobs/windows2019fs/templates",
+			"job 'windows2019fs' depends on package 'hwc', which does not exist",
+		))
+	})
+
+	It("does not report the dependencies of jobs on packages whose specs do not parse", func() {
+		write("packages/windows2019fs/spec", "name: [windows2019fs\n")
+
+		findings := release.ValidateSource(releaseDir, producedBlob)
+		Expect(findings).To(HaveLen(1))
+		Expect(findings[0]).To(HavePrefix("unable to parse packages/windows2019fs/spec: "))
+	})
+
+	Describe("SourceError", func() {
+		It("lists the findings", func() {
+			err := release.SourceError{Dir: "/tile/embed/windowsfs-release", Findings: []string{"VERSION is missing", "config/final.yml has no 'name'"}}
+			Expect(err).To(MatchError("release source /tile/embed/windowsfs-release is invalid:\n- VERSION is missing\n- config/final.yml has no 'name'"))
+		})
+	})
+})
@@ -0,0 +1,203 @@
+package release
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Expectations are what Verify checks a release tarball against.
+type Expectations struct {
+	Name    string
+	Version string
+	// Blobs checks the contents of package files by their path inside of
+	// the package, such as the blobs streamed into it. Every one of them has
+	// to be found in a package.
+	Blobs map[string]func(io.Reader) error
+}
+
+// archiveDigests are the hex digests of a job, package or license archive.
+// Manifests written by the bosh cli record either of them.
+type archiveDigests struct {
+	sha1   string
+	sha256 string
+}
+
+func (d archiveDigests) matches(expected string) bool {
+	if digest := strings.TrimPrefix(expected, "sha256:"); digest != expected {
+		return digest == d.sha256
+	}
+	return expected == d.sha1
+}
+
+// Verify reads the release tarball in a single pass and checks that its
+// release.MF names the expected release, that every job, package and license
+// archive matches the digest the manifest records for it, and that the
+// expected blobs are in its packages. It returns the manifest.
+func Verify(tarballPath string, expected Expectations) (Manifest, error) {
+	f, err := os.Open(tarballPath)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("unable to read release tarball %s: %s", tarballPath, err)
+	}
+
+	var (
+		manifest *Manifest
+		archives = map[string]archiveDigests{}
+		found    = map[string]bool{}
+		blobErrs []error
+	)
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Manifest{}, fmt.Errorf("unable to read release tarball %s: %s", tarballPath, err)
+		}
+
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == "release.MF":
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return Manifest{}, err
+			}
+			manifest = &Manifest{}
+			if err := yaml.Unmarshal(contents, manifest); err != nil {
+				return Manifest{}, fmt.Errorf("unable to parse release.MF of %s: %s", tarballPath, err)
+			}
+
+		case isArchive(name):
+			var (
+				sha1Hash   = sha1.New()
+				sha256Hash = sha256.New()
+				r          = io.TeeReader(tr, io.MultiWriter(sha1Hash, sha256Hash))
+			)
+
+			// A package whose blobs fail their checks is only reported once
+			// its digest is known to match, which points at the corruption
+			// more precisely.
+			if path.Dir(name) == "packages" && len(expected.Blobs) > 0 {
+				if err := checkBlobs(r, expected.Blobs, found); err != nil {
+					blobErrs = append(blobErrs, fmt.Errorf("%s: %s", name, err))
+				}
+			}
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				return Manifest{}, err
+			}
+
+			archives[name] = archiveDigests{
+				sha1:   hex.EncodeToString(sha1Hash.Sum(nil)),
+				sha256: hex.EncodeToString(sha256Hash.Sum(nil)),
+			}
+		}
+	}
+
+	if manifest == nil {
+		return Manifest{}, fmt.Errorf("release tarball %s does not contain release.MF", tarballPath)
+	}
+
+	if manifest.Name != expected.Name || manifest.Version != expected.Version {
+		return Manifest{}, fmt.Errorf("release tarball %s contains release %s/%s, expected %s/%s", tarballPath, manifest.Name, manifest.Version, expected.Name, expected.Version)
+	}
+
+	for _, job := range manifest.Jobs {
+		if err := checkArchive(archives, "jobs/"+job.Name+".tgz", job.SHA1); err != nil {
+			return Manifest{}, err
+		}
+	}
+	for _, pkg := range manifest.Packages {
+		if err := checkArchive(archives, "packages/"+pkg.Name+".tgz", pkg.SHA1); err != nil {
+			return Manifest{}, err
+		}
+	}
+	if manifest.License != nil {
+		if err := checkArchive(archives, "license.tgz", manifest.License.SHA1); err != nil {
+			return Manifest{}, err
+		}
+	}
+
+	if len(blobErrs) > 0 {
+		return Manifest{}, blobErrs[0]
+	}
+
+	var missing []string
+	for name := range expected.Blobs {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return Manifest{}, fmt.Errorf("release tarball %s is missing %s from its packages", tarballPath, strings.Join(missing, ", "))
+	}
+
+	return *manifest, nil
+}
+
+func isArchive(name string) bool {
+	dir := path.Dir(name)
+	return name == "license.tgz" || (dir == "jobs" || dir == "packages") && path.Ext(name) == ".tgz"
+}
+
+func checkArchive(archives map[string]archiveDigests, name, expected string) error {
+	digests, ok := archives[name]
+	if !ok {
+		return fmt.Errorf("%s is listed in release.MF but missing from the tarball", name)
+	}
+
+	if !digests.matches(expected) {
+		return fmt.Errorf("%s does not match its digest %s in release.MF", name, expected)
+	}
+	return nil
+}
+
+// checkBlobs runs the checks of the blobs found in a package archive and
+// records them as found.
+func checkBlobs(r io.Reader, blobs map[string]func(io.Reader) error, found map[string]bool) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(hdr.Name)
+		check, ok := blobs[name]
+		if !ok {
+			continue
+		}
+
+		if err := check(tr); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		found[name] = true
+	}
+}
@@ -0,0 +1,167 @@
+package release_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/winfs-injector/internal/testhelpers"
+	"github.com/pivotal-cf/winfs-injector/release"
+)
+
+var _ = Describe("Verify", func() {
+	var (
+		tmpDir      string
+		tarballPath string
+		blob        release.Blob
+		expected    release.Expectations
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		releaseDir := filepath.Join(tmpDir, "windowsfs-release")
+		Expect(testhelpers.CopyDir("fixtures/windowsfs-release", releaseDir)).To(Succeed())
+		Expect(os.RemoveAll(filepath.Join(releaseDir, "blobs"))).To(Succeed())
+
+		contents := []byte("fake-rootfs-image\n")
+		blob = release.Blob{
+			Name: "windows2019fs/windows2016fs-2019.0.43.tgz",
+			Size: int64(len(contents)),
+			Write: func(w io.Writer) error {
+				_, err := w.Write(contents)
+				return err
+			},
+		}
+
+		tarballPath = filepath.Join(tmpDir, "windows2019fs-9.3.6.tgz")
+		_, err = release.NewBuilder(log.New(GinkgoWriter, "", 0), release.Config{}).Build(releaseDir, "9.3.6", tarballPath, blob)
+		Expect(err).NotTo(HaveOccurred())
+
+		expected = release.Expectations{
+			Name:    "windows2019fs",
+			Version: "9.3.6",
+			Blobs: map[string]func(io.Reader) error{
+				blob.Name: func(r io.Reader) error {
+					contents, err := ioutil.ReadAll(r)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(contents)).To(Equal("fake-rootfs-image\n"))
+					return nil
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("returns the manifest of a release that matches its expectations", func() {
+		manifest, err := release.Verify(tarballPath, expected)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest.Name).To(Equal("windows2019fs"))
+		Expect(manifest.Packages).To(HaveLen(2))
+	})
+
+	It("returns an error when the release has another version", func() {
+		expected.Version = "9.3.5"
+
+		_, err := release.Verify(tarballPath, expected)
+		Expect(err).To(MatchError(ContainSubstring("contains release windows2019fs/9.3.6, expected windows2019fs/9.3.5")))
+	})
+
+	It("returns an error when an archive does not match its digest", func() {
+		replaceEntry(tarballPath, "packages/hwc-helper.tgz", []byte("tampered"))
+
+		_, err := release.Verify(tarballPath, expected)
+		Expect(err).To(MatchError(ContainSubstring("packages/hwc-helper.tgz does not match its digest sha256:")))
+	})
+
+	It("returns an error when an archive listed in release.MF is missing", func() {
+		replaceEntry(tarballPath, "jobs/windows2019fs.tgz", nil)
+
+		_, err := release.Verify(tarballPath, expected)
+		Expect(err).To(MatchError("jobs/windows2019fs.tgz is listed in release.MF but missing from the tarball"))
+	})
+
+	It("returns the error of a blob check", func() {
+		expected.Blobs[blob.Name] = func(io.Reader) error { return errors.New("layer mismatch") }
+
+		_, err := release.Verify(tarballPath, expected)
+		Expect(err).To(MatchError("packages/windows2019fs.tgz: windows2019fs/windows2016fs-2019.0.43.tgz: layer mismatch"))
+	})
+
+	It("returns an error when an expected blob is not in any package", func() {
+		expected.Blobs["windows2019fs/other.tgz"] = func(io.Reader) error { return nil }
+
+		_, err := release.Verify(tarballPath, expected)
+		Expect(err).To(MatchError(ContainSubstring("is missing windows2019fs/other.tgz from its packages")))
+	})
+})
+
+// replaceEntry rewrites the tarball with the contents of an entry replaced,
+// or the entry removed when contents is nil.
+func replaceEntry(path, name string, contents []byte) {
+	entries := readTgzInOrder(path)
+
+	f, err := os.Create(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, entry := range entries {
+		if entry.header.Name == name {
+			if contents == nil {
+				continue
+			}
+			entry.header.Size = int64(len(contents))
+			entry.contents = contents
+		}
+
+		Expect(tw.WriteHeader(&entry.header)).To(Succeed())
+		_, err := tw.Write(entry.contents)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	Expect(gw.Close()).To(Succeed())
+}
+
+type tgzEntry struct {
+	header   tar.Header
+	contents []byte
+}
+
+func readTgzInOrder(path string) []tgzEntry {
+	f, err := os.Open(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	Expect(err).NotTo(HaveOccurred())
+
+	var entries []tgzEntry
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		Expect(err).NotTo(HaveOccurred())
+
+		contents, err := ioutil.ReadAll(tr)
+		Expect(err).NotTo(HaveOccurred())
+		entries = append(entries, tgzEntry{header: *hdr, contents: contents})
+	}
+
+	return entries
+}
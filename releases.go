@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/pivotal-cf/jhanda"
+	"github.com/pivotal-cf/winfs-injector/tile"
+	"github.com/pivotal-cf/winfs-injector/winfsinjector"
+)
+
+const addReleaseUsageText = `winfs-injector add-release adds a bosh release to a tile, or replaces the version of it the tile lists.
+
+Usage: winfs-injector add-release --tile <tile> --release <release tarball>
+  --tile, -t         path to the tile (example: /path/to/tile.pivotal)
+  --release          release tarball, named and versioned after its release.MF (example: /path/to/agent-1.2.3.tgz)
+  --output-tile, -o  path to the edited tile (default: the tile itself)
+  --metadata-file    product metadata inside the tile, instead of discovering it in metadata/ (example: metadata/windows.yml)
+  --reproducible     identical inputs produce a byte-identical tile, dated $SOURCE_DATE_EPOCH (default: 1980-01-01)
+  --help, -h         prints this usage information
+`
+
+const removeReleaseUsageText = `winfs-injector remove-release removes a bosh release from a tile.
+
+Usage: winfs-injector remove-release --tile <tile> --release <release name>
+  --tile, -t         path to the tile (example: /path/to/tile.pivotal)
+  --release          name of the release to remove (example: monitoring-agent)
+  --output-tile, -o  path to the edited tile (default: the tile itself)
+  --metadata-file    product metadata inside the tile, instead of discovering it in metadata/ (example: metadata/windows.yml)
+  --reproducible     identical inputs produce a byte-identical tile, dated $SOURCE_DATE_EPOCH (default: 1980-01-01)
+  --help, -h         prints this usage information
+`
+
+// runReleaseCommand adds a release to a tile or removes one from it,
+// depending on the command.
+func runReleaseCommand(command string, args []string) error {
+	var arguments struct {
+		Tile         string `short:"t" long:"tile"`
+		Release      string `long:"release"`
+		OutputTile   string `short:"o" long:"output-tile"`
+		MetadataFile string `long:"metadata-file"`
+		Reproducible bool   `long:"reproducible"`
+		Help         bool   `short:"h" long:"help"`
+	}
+
+	_, err := jhanda.Parse(&arguments, args)
+	if err != nil {
+		return err
+	}
+
+	if arguments.Help {
+		if command == "add-release" {
+			fmt.Fprint(os.Stdout, addReleaseUsageText)
+		} else {
+			fmt.Fprint(os.Stdout, removeReleaseUsageText)
+		}
+		return nil
+	}
+
+	sourceDate, err := sourceDate(arguments.Reproducible)
+	if err != nil {
+		return err
+	}
+
+	wd, err := ioutil.TempDir("", "")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(wd)
+
+	tileInjector := tile.NewTileInjector(log.New(os.Stdout, "", 0))
+	tileInjector.MetadataFile = arguments.MetadataFile
+	tileInjector.ExistingRelease = tile.ExistingReleaseReplace
+	zipper := tile.NewZipper()
+	zipper.SourceDate = sourceDate
+
+	editor := winfsinjector.NewReleaseEditor(tileInjector, zipper)
+	if command == "add-release" {
+		return editor.AddRelease(arguments.Tile, arguments.OutputTile, arguments.Release, wd)
+	}
+	return editor.RemoveRelease(arguments.Tile, arguments.OutputTile, arguments.Release, wd)
+}
@@ -0,0 +1,165 @@
+// Package tarstream writes gzipped tarballs whose size is known before any of
+// their contents are, so that they can be nested in another tarball while
+// their contents are still being produced.
+package tarstream
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	blockSize = 512
+
+	// The gzip stream is framed here rather than by compress/gzip, so that its
+	// size does not depend on how compress/flate happens to store data. It is
+	// a 10 byte header, deflate stored blocks of at most 65535 bytes that each
+	// start with a 5 byte header, an empty final block of 2 bytes and an 8
+	// byte trailer.
+	gzipHeaderSize  = 10
+	gzipTrailerSize = 8
+	storedBlockMax  = 65535
+	storedBlockHdr  = 5
+)
+
+var (
+	// gzipHeader has no modification time and names no OS, as compress/gzip
+	// writes it.
+	gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+	// finalBlock is an empty block with fixed Huffman codes and the final bit
+	// set: 3 header bits and a 7 bit end-of-block code.
+	finalBlock = []byte{0x03, 0x00}
+)
+
+// NewGzipWriter returns a gzip writer that stores its input in deflate stored
+// blocks without compressing it, so that its output is exactly GzipSize bytes
+// long. It is meant for content that is already compressed, such as image
+// layers.
+func NewGzipWriter(w io.Writer) io.WriteCloser {
+	return &gzipWriter{w: w, crc: crc32.NewIEEE()}
+}
+
+// GzipSize returns the size of the output of NewGzipWriter for n bytes of
+// input.
+func GzipSize(n int64) int64 {
+	blocks := (n + storedBlockMax - 1) / storedBlockMax
+	return gzipHeaderSize + n + blocks*storedBlockHdr + int64(len(finalBlock)) + gzipTrailerSize
+}
+
+type gzipWriter struct {
+	w           io.Writer
+	crc         hash.Hash32
+	size        uint32
+	buf         []byte
+	wroteHeader bool
+	closed      bool
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if g.closed {
+		return 0, errors.New("write to closed gzip writer")
+	}
+
+	if err := g.writeHeader(); err != nil {
+		return 0, err
+	}
+
+	n := len(p)
+	g.crc.Write(p)
+	g.size += uint32(n)
+
+	for len(p) > 0 {
+		chunk := storedBlockMax - len(g.buf)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		g.buf = append(g.buf, p[:chunk]...)
+		p = p[chunk:]
+
+		if len(g.buf) == storedBlockMax {
+			if err := g.writeBlock(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Close writes the data that does not fill a block, the final block and the
+// trailer. It does not close the underlying writer.
+func (g *gzipWriter) Close() error {
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+
+	if err := g.writeHeader(); err != nil {
+		return err
+	}
+
+	if len(g.buf) > 0 {
+		if err := g.writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	trailer := make([]byte, gzipTrailerSize)
+	binary.LittleEndian.PutUint32(trailer[:4], g.crc.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:], g.size)
+
+	_, err := g.w.Write(append(append([]byte{}, finalBlock...), trailer...))
+	return err
+}
+
+func (g *gzipWriter) writeHeader() error {
+	if g.wroteHeader {
+		return nil
+	}
+	g.wroteHeader = true
+
+	_, err := g.w.Write(gzipHeader)
+	return err
+}
+
+// writeBlock writes the buffered data as a stored block that is not final.
+func (g *gzipWriter) writeBlock() error {
+	header := make([]byte, storedBlockHdr)
+	binary.LittleEndian.PutUint16(header[1:3], uint16(len(g.buf)))
+	binary.LittleEndian.PutUint16(header[3:5], ^uint16(len(g.buf)))
+
+	if _, err := g.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := g.w.Write(g.buf); err != nil {
+		return err
+	}
+
+	g.buf = g.buf[:0]
+	return nil
+}
+
+// Size returns the size of a tarball written by archive/tar with the given
+// entries, each followed by Size bytes of contents.
+func Size(headers []*tar.Header) (int64, error) {
+	var size int64
+	for _, hdr := range headers {
+		var buf bytes.Buffer
+		if err := tar.NewWriter(&buf).WriteHeader(hdr); err != nil {
+			return 0, err
+		}
+		size += int64(buf.Len()) + padded(hdr.Size)
+	}
+
+	// The tarball ends with two empty blocks.
+	return size + 2*blockSize, nil
+}
+
+func padded(n int64) int64 {
+	return (n + blockSize - 1) / blockSize * blockSize
+}
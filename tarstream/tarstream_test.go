@@ -0,0 +1,85 @@
+package tarstream_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/winfs-injector/tarstream"
+)
+
+var _ = Describe("tarstream", func() {
+	DescribeTable("GzipSize",
+		func(n int) {
+			contents := bytes.Repeat([]byte{'x'}, n)
+
+			var buf bytes.Buffer
+			gw := tarstream.NewGzipWriter(&buf)
+			// Odd write sizes make sure the output does not depend on how the
+			// input is split up.
+			for rest := contents; len(rest) > 0; {
+				chunk := 1000
+				if chunk > len(rest) {
+					chunk = len(rest)
+				}
+				_, err := gw.Write(rest[:chunk])
+				Expect(err).NotTo(HaveOccurred())
+				rest = rest[chunk:]
+			}
+			Expect(gw.Close()).To(Succeed())
+
+			Expect(int64(buf.Len())).To(Equal(tarstream.GzipSize(int64(n))))
+
+			// The output is what compress/gzip writes without compression, so
+			// archives keep the digests they had when it was used.
+			var stdlib bytes.Buffer
+			sw, err := gzip.NewWriterLevel(&stdlib, gzip.NoCompression)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = sw.Write(contents)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sw.Close()).To(Succeed())
+			Expect(int64(stdlib.Len())).To(Equal(tarstream.GzipSize(int64(n))))
+			Expect(buf.Bytes()).To(Equal(stdlib.Bytes()))
+
+			gr, err := gzip.NewReader(&buf)
+			Expect(err).NotTo(HaveOccurred())
+			decompressed, err := ioutil.ReadAll(gr)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decompressed).To(Equal(contents))
+		},
+		Entry("empty", 0),
+		Entry("one byte", 1),
+		Entry("one byte short of a block", 65534),
+		Entry("a full block", 65535),
+		Entry("one byte over a block", 65536),
+		Entry("two full blocks", 2*65535),
+		Entry("several blocks", 200000),
+	)
+
+	It("computes the size of a tarball", func() {
+		headers := []*tar.Header{
+			{Typeflag: tar.TypeDir, Name: "./", Mode: 0755},
+			{Typeflag: tar.TypeReg, Name: "./empty", Mode: 0644},
+			{Typeflag: tar.TypeReg, Name: "./file", Mode: 0644, Size: 513},
+			{Typeflag: tar.TypeReg, Name: "./" + strings.Repeat("long/", 40) + "name", Mode: 0755, Size: 10},
+		}
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range headers {
+			Expect(tw.WriteHeader(hdr)).To(Succeed())
+			_, err := tw.Write(bytes.Repeat([]byte{'x'}, int(hdr.Size)))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(tw.Close()).To(Succeed())
+
+		size, err := tarstream.Size(headers)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(size).To(Equal(int64(buf.Len())))
+	})
+})
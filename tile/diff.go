@@ -0,0 +1,330 @@
+package tile
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ChangeKind tells how something differs between two tiles.
+type ChangeKind string
+
+const (
+	Added   ChangeKind = "+"
+	Removed ChangeKind = "-"
+	Changed ChangeKind = "~"
+)
+
+// Change is a difference between two tiles. Path names a file of the tiles or
+// a key of their product metadata, and Old and New describe it in each tile.
+type Change struct {
+	Kind ChangeKind
+	Path string
+	Old  string
+	New  string
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("+ %s: %s", c.Path, c.New)
+	case Removed:
+		return fmt.Sprintf("- %s: %s", c.Path, c.Old)
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", c.Path, c.Old, c.New)
+	}
+}
+
+// TileDiff lists the differences between two tiles.
+type TileDiff struct {
+	Files []Change
+
+	// OldMetadataFile and NewMetadataFile are the product templates of the
+	// tiles, whose differences Metadata lists.
+	OldMetadataFile string
+	NewMetadataFile string
+	Metadata        []Change
+}
+
+// Empty tells whether the tiles have the same files and metadata.
+func (d TileDiff) Empty() bool {
+	return len(d.Files) == 0 && len(d.Metadata) == 0
+}
+
+// Diff compares the files of two tiles by size and CRC, and their product
+// templates key by key. Items of lists whose items all have a name, such as
+// releases and job types, are matched by name.
+func (z Zipper) Diff(oldTile, newTile string) (TileDiff, error) {
+	oldEntries, err := z.List(oldTile)
+	if err != nil {
+		return TileDiff{}, err
+	}
+
+	newEntries, err := z.List(newTile)
+	if err != nil {
+		return TileDiff{}, err
+	}
+
+	diff := TileDiff{Files: diffFiles(oldEntries, newEntries)}
+
+	var oldMetadata, newMetadata interface{}
+	diff.OldMetadataFile, oldMetadata, err = z.productTemplate(oldTile, oldEntries)
+	if err != nil {
+		return TileDiff{}, err
+	}
+
+	diff.NewMetadataFile, newMetadata, err = z.productTemplate(newTile, newEntries)
+	if err != nil {
+		return TileDiff{}, err
+	}
+
+	diff.Metadata = diffValues("", oldMetadata, newMetadata)
+	return diff, nil
+}
+
+// productTemplate finds the product template of the zipped tile the way
+// metadataFile does in an extracted one, and decodes it.
+func (z Zipper) productTemplate(tile string, entries []ZipEntry) (string, interface{}, error) {
+	var (
+		names     []string
+		templates []interface{}
+	)
+	for _, entry := range entries {
+		yml, _ := path.Match("metadata/*.yml", entry.Name)
+		yamlExt, _ := path.Match("metadata/*.yaml", entry.Name)
+		if !yml && !yamlExt {
+			continue
+		}
+
+		contents, err := z.ReadFile(tile, entry.Name)
+		if err != nil {
+			return "", nil, err
+		}
+		if productTemplateContentsRejection(contents) != "" {
+			continue
+		}
+
+		var template interface{}
+		if err := yaml.Unmarshal(contents, &template); err != nil {
+			return "", nil, err
+		}
+		names = append(names, entry.Name)
+		templates = append(templates, template)
+	}
+
+	if len(names) != 1 {
+		return "", nil, fmt.Errorf("expected to find a single product metadata file in the metadata directory of %s, but found %d", tile, len(names))
+	}
+	return names[0], templates[0], nil
+}
+
+func diffFiles(oldEntries, newEntries []ZipEntry) []Change {
+	oldFiles := map[string]ZipEntry{}
+	for _, entry := range oldEntries {
+		oldFiles[entry.Name] = entry
+	}
+
+	newFiles := map[string]ZipEntry{}
+	for _, entry := range newEntries {
+		newFiles[entry.Name] = entry
+	}
+
+	var changes []Change
+	for _, name := range sortedKeys(oldFiles, newFiles) {
+		oldEntry, inOld := oldFiles[name]
+		newEntry, inNew := newFiles[name]
+
+		switch {
+		case !inNew:
+			changes = append(changes, Change{Kind: Removed, Path: name, Old: describeEntry(oldEntry)})
+		case !inOld:
+			changes = append(changes, Change{Kind: Added, Path: name, New: describeEntry(newEntry)})
+		case oldEntry.Size != newEntry.Size || oldEntry.CRC32 != newEntry.CRC32:
+			changes = append(changes, Change{Kind: Changed, Path: name, Old: describeEntry(oldEntry), New: describeEntry(newEntry)})
+		}
+	}
+	return changes
+}
+
+func describeEntry(entry ZipEntry) string {
+	return fmt.Sprintf("%d bytes, crc32 %08x", entry.Size, entry.CRC32)
+}
+
+// diffValues lists the differences between two decoded yaml values.
+func diffValues(keyPath string, oldValue, newValue interface{}) []Change {
+	if reflect.DeepEqual(oldValue, newValue) {
+		return nil
+	}
+
+	oldMap, oldIsMap := stringMap(oldValue)
+	newMap, newIsMap := stringMap(newValue)
+	if oldIsMap && newIsMap {
+		var changes []Change
+		for _, key := range sortedKeys(oldMap, newMap) {
+			itemPath := joinKey(keyPath, key)
+			oldItem, inOld := oldMap[key]
+			newItem, inNew := newMap[key]
+
+			switch {
+			case !inNew:
+				changes = append(changes, Change{Kind: Removed, Path: itemPath, Old: describeValue(oldItem)})
+			case !inOld:
+				changes = append(changes, Change{Kind: Added, Path: itemPath, New: describeValue(newItem)})
+			default:
+				changes = append(changes, diffValues(itemPath, oldItem, newItem)...)
+			}
+		}
+		return changes
+	}
+
+	oldList, oldIsList := oldValue.([]interface{})
+	newList, newIsList := newValue.([]interface{})
+	if oldIsList && newIsList {
+		oldNamed, oldIsNamed := namedItems(oldList)
+		newNamed, newIsNamed := namedItems(newList)
+		if oldIsNamed && newIsNamed {
+			return diffNamedItems(keyPath, oldList, newList, oldNamed, newNamed)
+		}
+
+		if len(oldList) == len(newList) {
+			var changes []Change
+			for i := range oldList {
+				changes = append(changes, diffValues(fmt.Sprintf("%s[%d]", keyPath, i), oldList[i], newList[i])...)
+			}
+			return changes
+		}
+	}
+
+	return []Change{{Kind: Changed, Path: keyPath, Old: describeValue(oldValue), New: describeValue(newValue)}}
+}
+
+// diffNamedItems matches the items of two lists by name, in the order of the
+// old list followed by the items only the new list has.
+func diffNamedItems(keyPath string, oldList, newList []interface{}, oldNamed, newNamed map[string]interface{}) []Change {
+	var changes []Change
+	for _, item := range oldList {
+		name := itemName(item)
+		itemPath := fmt.Sprintf("%s[%s]", keyPath, name)
+		if newItem, ok := newNamed[name]; ok {
+			changes = append(changes, diffValues(itemPath, item, newItem)...)
+			continue
+		}
+		changes = append(changes, Change{Kind: Removed, Path: itemPath, Old: describeValue(item)})
+	}
+
+	for _, item := range newList {
+		name := itemName(item)
+		if _, ok := oldNamed[name]; !ok {
+			changes = append(changes, Change{Kind: Added, Path: fmt.Sprintf("%s[%s]", keyPath, name), New: describeValue(item)})
+		}
+	}
+	return changes
+}
+
+// namedItems indexes the items of the list by name, when every item is a map
+// with a name of its own.
+func namedItems(list []interface{}) (map[string]interface{}, bool) {
+	named := map[string]interface{}{}
+	for _, item := range list {
+		name := itemName(item)
+		if name == "" {
+			return nil, false
+		}
+		if _, ok := named[name]; ok {
+			return nil, false
+		}
+		named[name] = item
+	}
+	return named, true
+}
+
+func itemName(item interface{}) string {
+	m, ok := stringMap(item)
+	if !ok {
+		return ""
+	}
+	name, _ := m["name"].(string)
+	return name
+}
+
+// stringMap returns a decoded yaml map with its keys as strings.
+func stringMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for key, item := range m {
+			converted[fmt.Sprint(key)] = item
+		}
+		return converted, true
+	default:
+		return nil, false
+	}
+}
+
+// describeValue renders a scalar, or a map of scalars, on a single line, and
+// summarizes anything else.
+func describeValue(value interface{}) string {
+	if m, ok := stringMap(value); ok {
+		fields := make([]string, 0, len(m))
+		for _, key := range sortedKeys(m) {
+			if _, isScalar := scalar(m[key]); !isScalar {
+				return fmt.Sprintf("{%d keys}", len(m))
+			}
+			fields = append(fields, fmt.Sprintf("%s: %s", key, describeValue(m[key])))
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+
+	if list, ok := value.([]interface{}); ok {
+		return fmt.Sprintf("[%d items]", len(list))
+	}
+
+	s, _ := scalar(value)
+	return s
+}
+
+func scalar(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "null", true
+	case string:
+		if strings.Contains(strings.TrimSuffix(v, "\n"), "\n") {
+			return fmt.Sprintf("(%d lines)", strings.Count(strings.TrimSuffix(v, "\n"), "\n")+1), true
+		}
+		return v, true
+	case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+func joinKey(keyPath, key string) string {
+	if keyPath == "" {
+		return key
+	}
+	return keyPath + "." + key
+}
+
+// sortedKeys returns the keys of the maps, each once, in order.
+func sortedKeys(maps ...interface{}) []string {
+	seen := map[string]bool{}
+	for _, m := range maps {
+		for _, key := range reflect.ValueOf(m).MapKeys() {
+			seen[key.String()] = true
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,159 @@
+package tile_test
+
+import (
+	"archive/zip"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/winfs-injector/tile"
+)
+
+var _ = Describe("Diff", func() {
+	var (
+		zipper  tile.Zipper
+		tmpDir  string
+		oldTile string
+		newTile string
+
+		oldMetadata string
+	)
+
+	BeforeEach(func() {
+		zipper = tile.NewZipper()
+
+		var err error
+		tmpDir, err = ioutil.TempDir("", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		oldTile = filepath.Join(tmpDir, "old.pivotal")
+		newTile = filepath.Join(tmpDir, "new.pivotal")
+
+		oldMetadata = `name: windows2019
+product_version: 2.11.0
+stemcell_criteria:
+  os: windows2019
+  version: "2019.41"
+releases:
+- name: hwc-buildpack
+  file: hwc-buildpack-3.1.1.tgz
+  version: 3.1.1
+job_types:
+- name: windows_diego_cell
+  templates: [{name: hwc-buildpack, release: hwc-buildpack}]
+`
+		writeZip(oldTile, map[string]string{
+			"metadata/windows.yml":                     oldMetadata,
+			"metadata/notes.yml":                       "name: release notes\n",
+			"releases/hwc-buildpack-3.1.1.tgz":         "hwc",
+			"embed/windowsfs-release/config/final.yml": "name: windows2019fs\n",
+			"embed/windowsfs-release/config/blobs.yml": "{}\n",
+			"migrations/v1/201901010000_migration.js":  "migration",
+		})
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("finds no differences between identical tiles", func() {
+		contents, err := ioutil.ReadFile(oldTile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(newTile, contents, 0644)).To(Succeed())
+
+		diff, err := zipper.Diff(oldTile, newTile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(diff.Empty()).To(BeTrue())
+		Expect(diff.OldMetadataFile).To(Equal("metadata/windows.yml"))
+	})
+
+	It("lists the files and metadata the injection changes", func() {
+		newMetadata := strings.Replace(oldMetadata, "version: 3.1.1\n", `version: 3.1.1
+- name: windows2019fs
+  file: windows2019fs-9.3.6.tgz
+  version: 9.3.6
+  sha1: abc
+`, 1)
+		newMetadata = strings.Replace(newMetadata, "2.11.0", "2.11.0+winfs", 1)
+		writeZip(newTile, map[string]string{
+			"metadata/windows.yml":                    newMetadata,
+			"metadata/notes.yml":                      "name: release notes\n",
+			"releases/hwc-buildpack-3.1.1.tgz":        "hwc",
+			"releases/windows2019fs-9.3.6.tgz":        "windowsfs",
+			"migrations/v1/201901010000_migration.js": "migration",
+		})
+
+		diff, err := zipper.Diff(oldTile, newTile)
+		Expect(err).NotTo(HaveOccurred())
+
+		var files []string
+		for _, change := range diff.Files {
+			files = append(files, change.String())
+		}
+		Expect(files).To(Equal([]string{
+			"- embed/windowsfs-release/config/blobs.yml: 3 bytes, crc32 " + crc("{}\n"),
+			"- embed/windowsfs-release/config/final.yml: 20 bytes, crc32 " + crc("name: windows2019fs\n"),
+			fmt.Sprintf("~ metadata/windows.yml: %d bytes, crc32 %s -> %d bytes, crc32 %s", len(oldMetadata), crc(oldMetadata), len(newMetadata), crc(newMetadata)),
+			"+ releases/windows2019fs-9.3.6.tgz: 9 bytes, crc32 " + crc("windowsfs"),
+		}))
+
+		Expect(diff.Metadata).To(Equal([]tile.Change{
+			{Kind: tile.Changed, Path: "product_version", Old: "2.11.0", New: "2.11.0+winfs"},
+			{Kind: tile.Added, Path: "releases[windows2019fs]", New: "{file: windows2019fs-9.3.6.tgz, name: windows2019fs, sha1: abc, version: 9.3.6}"},
+		}))
+	})
+
+	It("lists changes of releases and other keys", func() {
+		newMetadata := strings.Replace(oldMetadata, "3.1.1", "3.1.2", 2)
+		newMetadata = strings.Replace(newMetadata, `"2019.41"`, `"2019.43"`, 1)
+		newMetadata = strings.Replace(newMetadata, "release: hwc-buildpack}", "release: hwc}", 1)
+		newMetadata += "label: Windows Runtime\n"
+		writeZip(newTile, map[string]string{"metadata/windows.yml": newMetadata})
+
+		diff, err := zipper.Diff(oldTile, newTile)
+		Expect(err).NotTo(HaveOccurred())
+
+		var changes []string
+		for _, change := range diff.Metadata {
+			changes = append(changes, change.String())
+		}
+		Expect(changes).To(Equal([]string{
+			"~ job_types[windows_diego_cell].templates[hwc-buildpack].release: hwc-buildpack -> hwc",
+			"+ label: Windows Runtime",
+			"~ releases[hwc-buildpack].file: hwc-buildpack-3.1.1.tgz -> hwc-buildpack-3.1.2.tgz",
+			"~ releases[hwc-buildpack].version: 3.1.1 -> 3.1.2",
+			"~ stemcell_criteria.version: 2019.41 -> 2019.43",
+		}))
+	})
+
+	It("returns an error when a tile has no product template", func() {
+		writeZip(newTile, map[string]string{"metadata/notes.yml": "name: release notes\n"})
+
+		_, err := zipper.Diff(oldTile, newTile)
+		Expect(err).To(MatchError("expected to find a single product metadata file in the metadata directory of " + newTile + ", but found 0"))
+	})
+})
+
+func writeZip(path string, files map[string]string) {
+	f, err := os.Create(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for name, contents := range files {
+		w, err := zw.Create(name)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = w.Write([]byte(contents))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(zw.Close()).To(Succeed())
+}
+
+func crc(contents string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(contents)))
+}
@@ -0,0 +1,100 @@
+package tile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// productTemplateKeys are the keys that tell the product template apart from
+// other yaml files in the metadata directory.
+var productTemplateKeys = []string{"name", "product_version", "releases"}
+
+// metadataFile returns the product template of the tile: the configured
+// metadata file, or else the single yaml file of the metadata directory that
+// has the keys of a product template. Yaml files that are not product
+// templates are reported along with the reason they were rejected.
+func (i TileInjector) metadataFile(tileDir string) (string, error) {
+	if i.MetadataFile != "" {
+		path := filepath.Join(tileDir, i.MetadataFile)
+		if _, err := ioutil.ReadFile(path); err != nil {
+			return "", fmt.Errorf("unable to read product metadata file '%s': %s", path, err)
+		}
+		return path, nil
+	}
+
+	metadataDir := filepath.Join(tileDir, "metadata")
+
+	var candidates []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(metadataDir, pattern))
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, matches...)
+	}
+	sort.Strings(candidates)
+
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("expected to find a product metadata file matching path '%s', but found none", filepath.Join(metadataDir, "*.{yml,yaml}"))
+	}
+
+	var accepted, rejected []string
+	for _, candidate := range candidates {
+		if reason := productTemplateRejection(candidate); reason != "" {
+			rejected = append(rejected, fmt.Sprintf("%s: %s", filepath.Base(candidate), reason))
+			continue
+		}
+		accepted = append(accepted, candidate)
+	}
+
+	switch len(accepted) {
+	case 0:
+		return "", fmt.Errorf("expected to find a product metadata file in '%s', but none of its yaml files is a product template:\n- %s", metadataDir, strings.Join(rejected, "\n- "))
+	case 1:
+		for _, r := range rejected {
+			i.logger.Printf("Ignoring metadata file %s\n", r)
+		}
+		return accepted[0], nil
+	default:
+		names := make([]string, len(accepted))
+		for j, path := range accepted {
+			names[j] = filepath.Base(path)
+		}
+		return "", fmt.Errorf("expected to find a single product metadata file in '%s', but found multiple: %s", metadataDir, strings.Join(names, ", "))
+	}
+}
+
+// productTemplateRejection returns why the yaml file is not a product
+// template, or nothing when it is one.
+func productTemplateRejection(path string) string {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Sprintf("unable to read it: %s", err)
+	}
+	return productTemplateContentsRejection(contents)
+}
+
+// productTemplateContentsRejection returns why the yaml contents are not a
+// product template, or nothing when they are one.
+func productTemplateContentsRejection(contents []byte) string {
+	var template map[string]interface{}
+	if err := yaml.Unmarshal(contents, &template); err != nil {
+		return fmt.Sprintf("not a yaml map: %s", err)
+	}
+
+	var missing []string
+	for _, key := range productTemplateKeys {
+		if _, ok := template[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Sprintf("missing %s", strings.Join(missing, ", "))
+	}
+	return ""
+}
@@ -1,12 +1,82 @@
 package tile
 
+// Metadata is the product template of a tile, in its metadata directory. The
+// parts of it the injector works with are typed; every other key, here and in
+// the typed parts, is kept in Other, so that decoding and encoding the
+// metadata loses nothing.
 type Metadata struct {
-	Releases []Release
-	Other    map[string]interface{} `yaml:",inline"`
+	Name                     string              `yaml:"name,omitempty"`
+	ProductVersion           string              `yaml:"product_version,omitempty"`
+	MinimumVersionForUpgrade string              `yaml:"minimum_version_for_upgrade,omitempty"`
+	StemcellCriteria         *StemcellCriteria   `yaml:"stemcell_criteria,omitempty"`
+	Releases                 []Release           `yaml:"releases"`
+	JobTypes                 []JobType           `yaml:"job_types,omitempty"`
+	PropertyBlueprints       []PropertyBlueprint `yaml:"property_blueprints,omitempty"`
+	FormTypes                []FormType          `yaml:"form_types,omitempty"`
+	RuntimeConfigs           []RuntimeConfig     `yaml:"runtime_configs,omitempty"`
+
+	Other map[string]interface{} `yaml:",inline"`
 }
 
+// Release is an entry of the releases of the product metadata. File is the
+// name of the release tarball in the releases directory of the tile, and SHA1
+// its hex digest, which Ops Manager verifies when it is given.
 type Release struct {
 	Name    string
 	File    string
 	Version string
+	SHA1    string `yaml:"sha1,omitempty"`
+
+	Other map[string]interface{} `yaml:",inline"`
+}
+
+// StemcellCriteria selects the stemcell the jobs of the product run on.
+type StemcellCriteria struct {
+	OS      string `yaml:"os,omitempty"`
+	Version string `yaml:"version,omitempty"`
+
+	Other map[string]interface{} `yaml:",inline"`
+}
+
+// JobType is a job of the product, deployed from the templates of its
+// releases.
+type JobType struct {
+	Name      string        `yaml:"name,omitempty"`
+	Label     string        `yaml:"label,omitempty"`
+	Templates []JobTemplate `yaml:"templates,omitempty"`
+
+	Other map[string]interface{} `yaml:",inline"`
+}
+
+// JobTemplate is a bosh job of a job type, taken from one of the releases of
+// the product.
+type JobTemplate struct {
+	Name    string `yaml:"name,omitempty"`
+	Release string `yaml:"release,omitempty"`
+
+	Other map[string]interface{} `yaml:",inline"`
+}
+
+// PropertyBlueprint declares a property of the product.
+type PropertyBlueprint struct {
+	Name string `yaml:"name,omitempty"`
+	Type string `yaml:"type,omitempty"`
+
+	Other map[string]interface{} `yaml:",inline"`
+}
+
+// FormType is a form of the product configuration pages.
+type FormType struct {
+	Name  string `yaml:"name,omitempty"`
+	Label string `yaml:"label,omitempty"`
+
+	Other map[string]interface{} `yaml:",inline"`
+}
+
+// RuntimeConfig is a bosh runtime config that comes with the product.
+type RuntimeConfig struct {
+	Name          string `yaml:"name,omitempty"`
+	RuntimeConfig string `yaml:"runtime_config,omitempty"`
+
+	Other map[string]interface{} `yaml:",inline"`
 }
@@ -0,0 +1,484 @@
+package tile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// metadataReleases locates the releases in the text of product metadata, so
+// that they can be edited without touching the rest of it. The metadata is
+// only parsed to find where the releases are; entries are spliced into its
+// text, so every other byte of it, including comments, anchors, key order and
+// fields of other releases, is kept.
+type metadataReleases struct {
+	text metadataText
+	root *yamlv3.Node
+	// key and value of the releases, nil when the metadata has none.
+	key, value *yamlv3.Node
+	// next is the key following the releases, if any.
+	next *yamlv3.Node
+}
+
+func parseReleases(contents []byte) (metadataReleases, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(contents, &doc); err != nil {
+		return metadataReleases{}, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return metadataReleases{}, errors.New("product metadata is not a map")
+	}
+	root := doc.Content[0]
+	if root.Style&yamlv3.FlowStyle != 0 {
+		return metadataReleases{}, errors.New("product metadata written as a flow mapping cannot be edited")
+	}
+
+	m := metadataReleases{text: metadataText(contents), root: root}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "releases" {
+			continue
+		}
+
+		m.key, m.value = root.Content[i], root.Content[i+1]
+		if i+2 < len(root.Content) {
+			m.next = root.Content[i+2]
+		}
+
+		isList := m.value.Kind == yamlv3.SequenceNode || m.value.Kind == yamlv3.ScalarNode && m.value.Tag == "!!null"
+		if !isList {
+			return metadataReleases{}, fmt.Errorf("releases of the product metadata is not a list, found %s", m.value.Tag)
+		}
+		break
+	}
+
+	return m, nil
+}
+
+// find returns the indexes and entries of the releases with the name.
+func (m metadataReleases) find(name string) ([]int, []Release, error) {
+	if m.value == nil || m.value.Kind != yamlv3.SequenceNode {
+		return nil, nil, nil
+	}
+
+	var (
+		indexes  []int
+		releases []Release
+	)
+	for i, item := range m.value.Content {
+		var release Release
+		if err := item.Decode(&release); err != nil {
+			return nil, nil, fmt.Errorf("release %d of the product metadata is invalid: %s", i, err)
+		}
+		if release.Name == name {
+			indexes = append(indexes, i)
+			releases = append(releases, release)
+		}
+	}
+	return indexes, releases, nil
+}
+
+// appendRelease adds the release to the end of the releases.
+func (m metadataReleases) appendRelease(release Release) ([]byte, error) {
+	switch {
+	case m.value == nil:
+		entry, err := blockEntry(release, m.root.Column-1)
+		if err != nil {
+			return nil, err
+		}
+		indent := strings.Repeat(" ", m.root.Column-1)
+		return m.text.insert(len(m.text), []byte(indent+"releases:\n"+string(entry))), nil
+	case m.value.Kind == yamlv3.ScalarNode:
+		return m.text.replaceNull(m.key, m.value, release)
+	case m.value.Style&yamlv3.FlowStyle != 0:
+		return m.text.appendToFlowSequence(m.value, release)
+	default:
+		return m.text.appendToBlockSequence(m.value, m.next, release)
+	}
+}
+
+// replaceRelease replaces the entry at index of the releases.
+func (m metadataReleases) replaceRelease(index int, release Release) ([]byte, error) {
+	item := m.value.Content[index]
+
+	if m.value.Style&yamlv3.FlowStyle != 0 {
+		entry, err := flowEntry(release)
+		if err != nil {
+			return nil, err
+		}
+
+		start := m.text.offset(item.Line, item.Column)
+		end, err := m.text.closingBracket(start)
+		if err != nil {
+			return nil, err
+		}
+		return m.text.replace(start, end+1, entry), nil
+	}
+
+	entry, err := blockEntry(release, m.value.Column-1)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := m.blockItem(index)
+	return m.text.replace(start, end, entry), nil
+}
+
+// removeRelease removes the entry at index of the releases, leaving an empty
+// list when it is the only one.
+func (m metadataReleases) removeRelease(index int) ([]byte, error) {
+	item := m.value.Content[index]
+
+	if m.value.Style&yamlv3.FlowStyle != 0 {
+		start := m.text.offset(item.Line, item.Column)
+		end, err := m.text.closingBracket(start)
+		if err != nil {
+			return nil, err
+		}
+		end++
+
+		// The entry goes with the comma that separates it from the next
+		// entry, or else from the previous one.
+		if next := m.text.skipSpaces(end); next < len(m.text) && m.text[next] == ',' {
+			end = m.text.skipSpaces(next + 1)
+		} else if index > 0 {
+			for start > 0 && m.text[start-1] != ',' {
+				start--
+			}
+			start--
+		}
+		return m.text.replace(start, end, nil), nil
+	}
+
+	start, end := m.blockItem(index)
+	contents := m.text.replace(start, end, nil)
+	if len(m.value.Content) > 1 {
+		return contents, nil
+	}
+
+	colon := bytes.IndexByte(m.text[m.text.offset(m.key.Line, m.key.Column):], ':')
+	if colon < 0 {
+		return nil, errors.New("releases of the product metadata have no value")
+	}
+	return metadataText(contents).insert(m.text.offset(m.key.Line, m.key.Column)+colon+1, []byte(" []")), nil
+}
+
+// blockItem returns the offsets of the lines of the entry at index of the
+// releases written as a block sequence.
+func (m metadataReleases) blockItem(index int) (int, int) {
+	indent := m.value.Column - 1
+	lines := m.text.lines()
+
+	first := m.value.Content[index].Line
+	for first > m.value.Line && !isSequenceItem(lines[first-1], indent) {
+		first--
+	}
+
+	var last int
+	if index+1 < len(m.value.Content) {
+		next := m.value.Content[index+1].Line
+		for next > first+1 && !isSequenceItem(lines[next-1], indent) {
+			next--
+		}
+		last = m.text.trimComments(first, next-1, indent)
+	} else {
+		last = m.text.lastLine(m.value, m.next)
+	}
+
+	return m.text.offset(first, 1), m.text.offset(last+1, 1)
+}
+
+// skipSpaces returns the offset of the first byte from offset on that is not
+// a space.
+func (t metadataText) skipSpaces(offset int) int {
+	for offset < len(t) && t[offset] == ' ' {
+		offset++
+	}
+	return offset
+}
+
+// isSequenceItem tells whether the line starts an item of a block sequence
+// whose dashes are indented by indent spaces.
+func isSequenceItem(line string, indent int) bool {
+	return len(line) > indent && strings.TrimLeft(line[:indent], " ") == "" && strings.HasPrefix(line[indent:], "-")
+}
+
+// metadataText is the text of a metadata file, addressed by the lines and
+// columns the yaml parser reports.
+type metadataText []byte
+
+// offset returns the byte offset of the 1-based line and column.
+func (t metadataText) offset(line, column int) int {
+	offset := 0
+	for l := 1; l < line; l++ {
+		i := bytes.IndexByte(t[offset:], '\n')
+		if i < 0 {
+			return len(t)
+		}
+		offset += i + 1
+	}
+
+	for c := 1; c < column && offset < len(t); c++ {
+		_, size := utf8.DecodeRune(t[offset:])
+		offset += size
+	}
+	return offset
+}
+
+// lines returns the lines of the text without their line breaks.
+func (t metadataText) lines() []string {
+	lines := strings.Split(string(t), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// insert returns the text with s inserted at offset, on a line of its own
+// when it is inserted at the end of a text without a final line break.
+func (t metadataText) insert(offset int, s []byte) []byte {
+	var out []byte
+	out = append(out, t[:offset]...)
+	if offset == len(t) && offset > 0 && t[offset-1] != '\n' {
+		out = append(out, '\n')
+	}
+	out = append(out, s...)
+	return append(out, t[offset:]...)
+}
+
+// replace returns the text with the bytes from start to end replaced by s.
+func (t metadataText) replace(start, end int, s []byte) []byte {
+	var out []byte
+	out = append(out, t[:start]...)
+	out = append(out, s...)
+	return append(out, t[end:]...)
+}
+
+// appendToBlockSequence inserts the entry after the last line of the
+// sequence.
+func (t metadataText) appendToBlockSequence(sequence, next *yamlv3.Node, release Release) ([]byte, error) {
+	entry, err := blockEntry(release, sequence.Column-1)
+	if err != nil {
+		return nil, err
+	}
+
+	last := t.lastLine(sequence, next)
+	return t.insert(t.offset(last+1, 1), entry), nil
+}
+
+// lastLine returns the last line of a block sequence, which precedes the
+// blank lines and comments before the next key.
+func (t metadataText) lastLine(sequence, next *yamlv3.Node) int {
+	last := len(t.lines())
+	if next != nil {
+		last = next.Line - 1
+	}
+	return t.trimComments(sequence.Line, last, sequence.Column-1)
+}
+
+// trimComments moves the last line of an item of a block sequence, starting
+// at first, above the blank lines and the comments that are not indented
+// deeper than its dash, since those precede what follows the item.
+func (t metadataText) trimComments(first, last, indent int) int {
+	lines := t.lines()
+	for last > first {
+		line := lines[last-1]
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed != "" && (!strings.HasPrefix(trimmed, "#") || len(line)-len(trimmed) > indent) {
+			break
+		}
+		last--
+	}
+
+	return last
+}
+
+// appendToFlowSequence inserts the entry before the closing bracket of the
+// sequence.
+func (t metadataText) appendToFlowSequence(sequence *yamlv3.Node, release Release) ([]byte, error) {
+	entry, err := flowEntry(release)
+	if err != nil {
+		return nil, err
+	}
+
+	start := t.offset(sequence.Line, sequence.Column)
+	end, err := t.closingBracket(start)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sequence.Content) > 0 {
+		entry = append([]byte(", "), entry...)
+	}
+	return t.insert(end, entry), nil
+}
+
+// closingBracket returns the offset of the bracket closing the flow
+// collection opened at start.
+func (t metadataText) closingBracket(start int) (int, error) {
+	var (
+		depth int
+		quote byte
+	)
+
+	for i := start; i < len(t); i++ {
+		c := t[i]
+		switch {
+		case quote == '\'' && c == '\'':
+			if i+1 < len(t) && t[i+1] == '\'' {
+				i++
+				continue
+			}
+			quote = 0
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '"' && c == '"':
+			quote = 0
+		case quote != 0:
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+
+	return 0, errors.New("releases of the product metadata are not terminated")
+}
+
+// replaceNull turns releases without a value into a list holding the entry.
+func (t metadataText) replaceNull(key, value *yamlv3.Node, release Release) ([]byte, error) {
+	if value.Value == "" {
+		entry, err := blockEntry(release, key.Column-1)
+		if err != nil {
+			return nil, err
+		}
+		return t.insert(t.offset(key.Line+1, 1), entry), nil
+	}
+
+	entry, err := flowEntry(release)
+	if err != nil {
+		return nil, err
+	}
+
+	start := t.offset(value.Line, value.Column)
+	entry = append(append([]byte("["), entry...), ']')
+	return t.replace(start, start+len(value.Value), entry), nil
+}
+
+// blockEntry renders the release as an item of a block sequence whose dashes
+// are indented by indent spaces.
+func blockEntry(release Release, indent int) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yamlv3.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode([]Release{release}); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Repeat(" ", indent)
+	var entry []byte
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line != "" {
+			entry = append(entry, prefix+line...)
+		}
+	}
+	return entry, nil
+}
+
+// flowEntry renders the release as a flow mapping.
+func flowEntry(release Release) ([]byte, error) {
+	var node yamlv3.Node
+	if err := node.Encode(release); err != nil {
+		return nil, err
+	}
+	node.Style = yamlv3.FlowStyle
+
+	contents, err := yamlv3.Marshal(&node)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(contents, []byte("\n")), nil
+}
+
+// setProductVersion replaces the product_version of the metadata, in the
+// style it is written in, and keeps the rest of the text as it is.
+func setProductVersion(contents []byte, version string) ([]byte, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(contents, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return nil, errors.New("product metadata is not a map")
+	}
+	root := doc.Content[0]
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "product_version" {
+			continue
+		}
+
+		value := root.Content[i+1]
+		if value.Kind != yamlv3.ScalarNode || value.Anchor != "" || value.Style&(yamlv3.LiteralStyle|yamlv3.FoldedStyle) != 0 {
+			return nil, errors.New("product_version of the product metadata cannot be edited")
+		}
+
+		text := metadataText(contents)
+		start := text.offset(value.Line, value.Column)
+		end, err := text.scalarEnd(start, value)
+		if err != nil {
+			return nil, err
+		}
+
+		scalar, err := yamlv3.Marshal(&yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Style: value.Style, Value: version})
+		if err != nil {
+			return nil, err
+		}
+		return text.replace(start, end, bytes.TrimSuffix(scalar, []byte("\n"))), nil
+	}
+
+	return nil, errors.New("product metadata has no product_version")
+}
+
+// scalarEnd returns the offset following the scalar written on a single line
+// at start.
+func (t metadataText) scalarEnd(start int, scalar *yamlv3.Node) (int, error) {
+	switch {
+	case scalar.Style&yamlv3.SingleQuotedStyle != 0:
+		for i := start + 1; i < len(t); i++ {
+			if t[i] != '\'' {
+				continue
+			}
+			if i+1 < len(t) && t[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1, nil
+		}
+	case scalar.Style&yamlv3.DoubleQuotedStyle != 0:
+		for i := start + 1; i < len(t); i++ {
+			switch t[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, nil
+			}
+		}
+	default:
+		if end := start + len(scalar.Value); end <= len(t) && string(t[start:end]) == scalar.Value {
+			return end, nil
+		}
+	}
+
+	return 0, errors.New("product_version of the product metadata spans several lines")
+}
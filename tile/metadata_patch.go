@@ -0,0 +1,450 @@
+package tile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	yaml "gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// errNotSpliceable tells that a change cannot be spliced into the text of the
+// node it is found in, so that the text of the entry holding the node is
+// rewritten instead.
+var errNotSpliceable = errors.New("change cannot be spliced into the text of the product metadata")
+
+// spliceMetadata returns the text of the product metadata in contents with
+// the differences between old, the metadata decoded from contents, and
+// patched spliced into it. Only the entries of block mappings and sequences
+// that differ are rewritten, so comments, anchors, key order and formatting
+// are kept everywhere else. It fails when the result would not decode to
+// patched.
+func spliceMetadata(contents []byte, old, patched interface{}) ([]byte, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(contents, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, errNotSpliceable
+	}
+
+	s := newMetadataSplicer(contents)
+	oldRoot, ok := old.(map[interface{}]interface{})
+	if !ok {
+		return nil, errNotSpliceable
+	}
+	newRoot, ok := patched.(map[interface{}]interface{})
+	if !ok {
+		return nil, errNotSpliceable
+	}
+	if err := s.mapping(doc.Content[0], oldRoot, newRoot, len(s.lines)); err != nil {
+		return nil, err
+	}
+
+	spliced := s.apply()
+
+	var check interface{}
+	if err := yaml.Unmarshal(spliced, &check); err != nil || !reflect.DeepEqual(check, patched) {
+		return nil, errNotSpliceable
+	}
+	return spliced, nil
+}
+
+type textEdit struct {
+	start, end int
+	text       []byte
+}
+
+// metadataSplicer collects the edits that turn the text of the metadata into
+// the patched metadata. Lines are 1-based, like the positions of yaml nodes.
+type metadataSplicer struct {
+	text       metadataText
+	lines      []string
+	lineStarts []int
+	edits      []textEdit
+}
+
+func newMetadataSplicer(contents []byte) *metadataSplicer {
+	s := &metadataSplicer{text: metadataText(contents)}
+	s.lines = s.text.lines()
+
+	offset := 0
+	for _, line := range s.lines {
+		s.lineStarts = append(s.lineStarts, offset)
+		offset += len(line) + 1
+	}
+	return s
+}
+
+// lineOffset returns the offset of the start of the line, or the end of the
+// text after the last line.
+func (s *metadataSplicer) lineOffset(line int) int {
+	if line-1 < len(s.lineStarts) {
+		return s.lineStarts[line-1]
+	}
+	return len(s.text)
+}
+
+func (s *metadataSplicer) offset(line, column int) int {
+	offset := s.lineOffset(line)
+	for c := 1; c < column && offset < len(s.text); c++ {
+		_, size := utf8.DecodeRune(s.text[offset:])
+		offset += size
+	}
+	return offset
+}
+
+func (s *metadataSplicer) edit(start, end int, text []byte) {
+	s.edits = append(s.edits, textEdit{start: start, end: end, text: text})
+}
+
+// apply returns the text with the edits made, from the last one in the text
+// to the first, so that their offsets stay valid. Edits at the same offset
+// are made in reverse, so that insertions keep their order.
+func (s *metadataSplicer) apply() []byte {
+	edits := make([]int, len(s.edits))
+	for i := range edits {
+		edits[i] = i
+	}
+	sort.SliceStable(edits, func(i, j int) bool {
+		a, b := s.edits[edits[i]], s.edits[edits[j]]
+		if a.start != b.start {
+			return a.start > b.start
+		}
+		if a.end != b.end {
+			return a.end > b.end
+		}
+		return edits[i] > edits[j]
+	})
+
+	text := append([]byte{}, s.text...)
+	for _, i := range edits {
+		e := s.edits[i]
+		text = metadataText(text).replace(e.start, e.end, e.text)
+	}
+	return text
+}
+
+// trimComments moves the last line of an entry, starting at first, above the
+// blank lines and the comments that are not indented deeper than the entry,
+// since those precede what follows it.
+func (s *metadataSplicer) trimComments(first, last, indent int) int {
+	for last > first {
+		line := s.lines[last-1]
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed != "" && (!strings.HasPrefix(trimmed, "#") || len(line)-len(trimmed) > indent) {
+			break
+		}
+		last--
+	}
+	return last
+}
+
+// sharesLine tells whether the node follows something else on its line, such
+// as the dash of a sequence item.
+func (s *metadataSplicer) sharesLine(node *yamlv3.Node) bool {
+	return strings.TrimLeft(string(s.text[s.lineOffset(node.Line):s.offset(node.Line, node.Column)]), " ") != ""
+}
+
+// value splices the change of a node from old to patched, whose entry ends
+// at the line last.
+func (s *metadataSplicer) value(node *yamlv3.Node, old, patched interface{}, last int) error {
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		oldMap, oldOK := old.(map[interface{}]interface{})
+		newMap, newOK := patched.(map[interface{}]interface{})
+		if oldOK && newOK {
+			return s.mapping(node, oldMap, newMap, last)
+		}
+	case yamlv3.SequenceNode:
+		oldList, oldOK := old.([]interface{})
+		newList, newOK := patched.([]interface{})
+		if oldOK && newOK {
+			return s.sequence(node, oldList, newList, last)
+		}
+	case yamlv3.ScalarNode:
+		return s.scalar(node, patched)
+	}
+	return errNotSpliceable
+}
+
+// mapping splices the changes of a block mapping: removed keys are deleted,
+// changed values are spliced or rewritten, and added keys are written after
+// the last entry, in name order.
+func (s *metadataSplicer) mapping(node *yamlv3.Node, old, patched map[interface{}]interface{}, last int) error {
+	if node.Kind != yamlv3.MappingNode || node.Style&yamlv3.FlowStyle != 0 || len(patched) == 0 {
+		return errNotSpliceable
+	}
+
+	var (
+		indent   = node.Column - 1
+		oldKeys  = keyed(old)
+		newKeys  = keyed(patched)
+		seen     = map[string]bool{}
+		entryEnd int
+	)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Kind != yamlv3.ScalarNode || key.Value == "<<" {
+			return errNotSpliceable
+		}
+
+		end := last
+		if i+2 < len(node.Content) {
+			end = node.Content[i+2].Line - 1
+		}
+		end = s.trimComments(key.Line, end, indent)
+		entryEnd = end
+
+		oldEntry, ok := oldKeys[key.Value]
+		if !ok {
+			return errNotSpliceable
+		}
+		seen[key.Value] = true
+
+		newEntry, ok := newKeys[key.Value]
+		switch {
+		case !ok:
+			if s.sharesLine(key) {
+				return errNotSpliceable
+			}
+			s.edit(s.lineOffset(key.Line), s.lineOffset(end+1), nil)
+		case reflect.DeepEqual(oldEntry.value, newEntry.value):
+		default:
+			err := s.value(value, oldEntry.value, newEntry.value, end)
+			if err == errNotSpliceable {
+				entry, err := renderEntry(newEntry.key, newEntry.value, indent)
+				if err != nil {
+					return err
+				}
+				s.edit(s.offset(key.Line, key.Column), s.lineOffset(end+1), entry)
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	var added []string
+	for name := range newKeys {
+		if !seen[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+
+	var entries []byte
+	for _, name := range added {
+		entry, err := renderEntry(newKeys[name].key, newKeys[name].value, indent)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, strings.Repeat(" ", indent)...)
+		entries = append(entries, entry...)
+	}
+	if len(entries) > 0 {
+		offset := s.lineOffset(entryEnd + 1)
+		if offset == len(s.text) && offset > 0 && s.text[offset-1] != '\n' {
+			entries = append([]byte("\n"), entries...)
+		}
+		s.edit(offset, offset, entries)
+	}
+
+	return nil
+}
+
+// sequence splices the changes of a block sequence. Items are matched by
+// value, so that inserting or removing an item leaves the others as they are;
+// the unmatched items in between are spliced or rewritten in order.
+func (s *metadataSplicer) sequence(node *yamlv3.Node, old, patched []interface{}, last int) error {
+	if node.Style&yamlv3.FlowStyle != 0 || len(patched) == 0 || len(node.Content) != len(old) {
+		return errNotSpliceable
+	}
+
+	var (
+		indent = node.Column - 1
+		firsts = make([]int, len(old))
+		ends   = make([]int, len(old))
+	)
+	for i, item := range node.Content {
+		first := item.Line
+		for first > node.Line && !isSequenceItem(s.lines[first-1], indent) {
+			first--
+		}
+		firsts[i] = first
+	}
+	for i := range node.Content {
+		end := last
+		if i+1 < len(node.Content) {
+			end = firsts[i+1] - 1
+		}
+		ends[i] = s.trimComments(firsts[i], end, indent)
+	}
+
+	insertAt := s.lineOffset(firsts[0])
+	insert := func(value interface{}) error {
+		item, err := renderValue(value, indent+2)
+		if err != nil {
+			return err
+		}
+		s.edit(insertAt, insertAt, append([]byte(strings.Repeat(" ", indent)+"- "), item...))
+		return nil
+	}
+
+	oi, nj := 0, 0
+	for _, match := range append(matchItems(old, patched), [2]int{len(old), len(patched)}) {
+		for ; oi < match[0] && nj < match[1]; oi, nj = oi+1, nj+1 {
+			err := s.value(node.Content[oi], old[oi], patched[nj], ends[oi])
+			if err == errNotSpliceable {
+				item, err := renderValue(patched[nj], indent+2)
+				if err != nil {
+					return err
+				}
+				s.edit(s.offset(firsts[oi], indent+1), s.lineOffset(ends[oi]+1), append([]byte("- "), item...))
+			} else if err != nil {
+				return err
+			}
+			insertAt = s.lineOffset(ends[oi] + 1)
+		}
+		for ; oi < match[0]; oi++ {
+			s.edit(s.lineOffset(firsts[oi]), s.lineOffset(ends[oi]+1), nil)
+			insertAt = s.lineOffset(ends[oi] + 1)
+		}
+		for ; nj < match[1]; nj++ {
+			if err := insert(patched[nj]); err != nil {
+				return err
+			}
+		}
+
+		if oi < len(old) {
+			insertAt = s.lineOffset(ends[oi] + 1)
+			oi, nj = oi+1, nj+1
+		}
+	}
+
+	return nil
+}
+
+// scalar replaces a scalar written on a single line, in the style it is
+// written in when the new value is a string too.
+func (s *metadataSplicer) scalar(node *yamlv3.Node, patched interface{}) error {
+	if node.Value == "" || node.Anchor != "" || node.Style&(yamlv3.LiteralStyle|yamlv3.FoldedStyle) != 0 {
+		return errNotSpliceable
+	}
+
+	var scalar yamlv3.Node
+	if err := scalar.Encode(patched); err != nil || scalar.Kind != yamlv3.ScalarNode {
+		return errNotSpliceable
+	}
+	if scalar.Tag == "!!str" && node.Style&(yamlv3.SingleQuotedStyle|yamlv3.DoubleQuotedStyle) != 0 {
+		scalar.Style = node.Style
+	}
+
+	text, err := yamlv3.Marshal(&scalar)
+	if err != nil {
+		return err
+	}
+	text = bytes.TrimSuffix(text, []byte("\n"))
+	if bytes.Contains(text, []byte("\n")) {
+		return errNotSpliceable
+	}
+
+	start := s.offset(node.Line, node.Column)
+	end, err := s.text.scalarEnd(start, node)
+	if err != nil {
+		return errNotSpliceable
+	}
+
+	s.edit(start, end, text)
+	return nil
+}
+
+// matchItems returns the indexes of the longest run of items that are in
+// both lists, in order.
+func matchItems(old, patched []interface{}) [][2]int {
+	lengths := make([][]int, len(old)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(patched)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(patched) - 1; j >= 0; j-- {
+			switch {
+			case reflect.DeepEqual(old[i], patched[j]):
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] >= lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	var matches [][2]int
+	for i, j := 0, 0; i < len(old) && j < len(patched); {
+		switch {
+		case reflect.DeepEqual(old[i], patched[j]):
+			matches = append(matches, [2]int{i, j})
+			i, j = i+1, j+1
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return matches
+}
+
+type keyedValue struct {
+	key, value interface{}
+}
+
+// keyed indexes the entries of a decoded mapping by the text of their keys,
+// which is how the keys of the nodes are known.
+func keyed(m map[interface{}]interface{}) map[string]keyedValue {
+	entries := map[string]keyedValue{}
+	for key, value := range m {
+		entries[fmt.Sprint(key)] = keyedValue{key: key, value: value}
+	}
+	return entries
+}
+
+// renderEntry renders a key and its value as an entry of a block mapping
+// indented by indent spaces, without the indentation of its first line.
+func renderEntry(key, value interface{}, indent int) ([]byte, error) {
+	return render(map[interface{}]interface{}{key: value}, indent)
+}
+
+// renderValue renders a value in block style indented by indent spaces,
+// without the indentation of its first line.
+func renderValue(value interface{}, indent int) ([]byte, error) {
+	return render(value, indent)
+}
+
+func render(value interface{}, indent int) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yamlv3.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Repeat(" ", indent)
+	var out []byte
+	for i, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		if i > 0 && line != "\n" {
+			out = append(out, prefix...)
+		}
+		out = append(out, line...)
+	}
+	return out, nil
+}
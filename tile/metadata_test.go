@@ -0,0 +1,140 @@
+package tile_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/winfs-injector/tile"
+)
+
+const productTemplate = `---
+name: windows2019
+product_version: 2.11.0
+minimum_version_for_upgrade: 2.10.0
+label: Windows Runtime
+stemcell_criteria:
+  os: windows2019
+  version: "2019.41"
+  enable_patch_security_updates: true
+releases:
+- name: hwc-buildpack
+  file: hwc-buildpack-3.1.1.tgz
+  version: 3.1.1
+  url: https://example.com/hwc-buildpack-3.1.1.tgz
+job_types:
+- name: windows_diego_cell
+  label: Windows Diego Cell
+  instance_definition:
+    name: instances
+    type: integer
+  templates:
+  - name: hwc-buildpack
+    release: hwc-buildpack
+    manifest: |
+      enabled: true
+property_blueprints:
+- name: hwc_buildpack_enabled
+  type: boolean
+  default: true
+form_types:
+- name: buildpacks
+  label: Buildpacks
+  property_inputs:
+  - reference: .properties.hwc_buildpack_enabled
+runtime_configs:
+- name: windows-addons
+  runtime_config: |
+    releases: []
+`
+
+var _ = Describe("Metadata", func() {
+	It("decodes the typed parts of the product template", func() {
+		var metadata tile.Metadata
+		Expect(yaml.Unmarshal([]byte(productTemplate), &metadata)).To(Succeed())
+
+		Expect(metadata.Name).To(Equal("windows2019"))
+		Expect(metadata.ProductVersion).To(Equal("2.11.0"))
+		Expect(metadata.MinimumVersionForUpgrade).To(Equal("2.10.0"))
+		Expect(metadata.StemcellCriteria.OS).To(Equal("windows2019"))
+		Expect(metadata.StemcellCriteria.Version).To(Equal("2019.41"))
+		Expect(metadata.Releases).To(HaveLen(1))
+		Expect(metadata.JobTypes[0].Templates[0]).To(Equal(tile.JobTemplate{
+			Name:    "hwc-buildpack",
+			Release: "hwc-buildpack",
+			Other:   map[string]interface{}{"manifest": "enabled: true\n"},
+		}))
+		Expect(metadata.PropertyBlueprints[0].Type).To(Equal("boolean"))
+		Expect(metadata.FormTypes[0].Label).To(Equal("Buildpacks"))
+		Expect(metadata.RuntimeConfigs[0].RuntimeConfig).To(Equal("releases: []\n"))
+	})
+
+	It("round-trips the keys it does not model", func() {
+		var metadata tile.Metadata
+		Expect(yaml.Unmarshal([]byte(productTemplate), &metadata)).To(Succeed())
+
+		contents, err := yaml.Marshal(metadata)
+		Expect(err).NotTo(HaveOccurred())
+
+		var original, roundTripped interface{}
+		Expect(yaml.Unmarshal([]byte(productTemplate), &original)).To(Succeed())
+		Expect(yaml.Unmarshal(contents, &roundTripped)).To(Succeed())
+		Expect(roundTripped).To(Equal(original))
+	})
+
+	Describe("Validate", func() {
+		var (
+			tileDir  string
+			metadata tile.Metadata
+		)
+
+		BeforeEach(func() {
+			var err error
+			tileDir, err = ioutil.TempDir("", "")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(os.Mkdir(filepath.Join(tileDir, "releases"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(tileDir, "releases", "hwc-buildpack-3.1.1.tgz"), nil, 0644)).To(Succeed())
+
+			metadata = tile.Metadata{}
+			Expect(yaml.Unmarshal([]byte(productTemplate), &metadata)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(tileDir)).To(Succeed())
+		})
+
+		It("finds no problems in a valid product template", func() {
+			Expect(metadata.Validate(tileDir)).To(BeEmpty())
+		})
+
+		DescribeTable("reports structural problems",
+			func(breakMetadata func(*tile.Metadata), problem string) {
+				breakMetadata(&metadata)
+				Expect(metadata.Validate(tileDir)).To(ConsistOf(problem))
+			},
+			Entry("missing name", func(m *tile.Metadata) { m.Name = "" }, "name is missing"),
+			Entry("missing product version", func(m *tile.Metadata) { m.ProductVersion = "" }, "product_version is missing"),
+			Entry("incomplete stemcell criteria", func(m *tile.Metadata) { m.StemcellCriteria.Version = "" }, "stemcell_criteria.version is missing"),
+			Entry("missing release file",
+				func(m *tile.Metadata) { m.Releases[0].File = "hwc-buildpack-3.1.2.tgz" },
+				"release hwc-buildpack refers to releases/hwc-buildpack-3.1.2.tgz, which is not in the tile"),
+			Entry("release listed twice",
+				func(m *tile.Metadata) { m.Releases = append(m.Releases, m.Releases[0]) },
+				"release hwc-buildpack is listed more than once"),
+			Entry("template of an unknown release",
+				func(m *tile.Metadata) { m.JobTypes[0].Templates[0].Release = "hwc" },
+				`job type windows_diego_cell: template hwc-buildpack refers to release "hwc", which is not in releases`),
+			Entry("property blueprint without type",
+				func(m *tile.Metadata) { m.PropertyBlueprints[0].Type = "" },
+				"property blueprint hwc_buildpack_enabled has no type"),
+			Entry("unnamed form type", func(m *tile.Metadata) { m.FormTypes[0].Name = "" }, "form_types[0].name is missing"),
+			Entry("unnamed runtime config", func(m *tile.Metadata) { m.RuntimeConfigs[0].Name = "" }, "runtime_configs[0].name is missing"),
+		)
+	})
+})
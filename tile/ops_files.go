@@ -0,0 +1,86 @@
+package tile
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cppforlife/go-patch/patch"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ApplyMetadataOpsFiles applies the MetadataOpsFiles to the product metadata
+// of the tile, in order, the way `bosh interpolate -o` applies ops files. Only
+// the entries the ops files change are rewritten, so that comments, anchors
+// and key order are kept; when the changes cannot be spliced into the text,
+// the metadata is written back as a whole. Nothing is written when there are
+// no ops files.
+func (i TileInjector) ApplyMetadataOpsFiles(tileDir string) error {
+	if len(i.MetadataOpsFiles) == 0 {
+		return nil
+	}
+
+	metadataFilePath, err := i.metadataFile(tileDir)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(metadataFilePath)
+	if err != nil {
+		return err
+	}
+
+	var original, doc interface{}
+	if err := yaml.Unmarshal(data, &original); err != nil {
+		return fmt.Errorf("unable to parse product metadata %s: %s", metadataFilePath, err)
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	for _, opsFile := range i.MetadataOpsFiles {
+		doc, err = applyOpsFile(opsFile, doc)
+		if err != nil {
+			return err
+		}
+		i.logger.Printf("Applied ops file %s to product metadata\n", opsFile)
+	}
+
+	contents, err := spliceMetadata(data, original, doc)
+	if err != nil {
+		i.logger.Printf("Warning: rewriting product metadata %s as a whole, without its comments and key order, as the ops files change it in ways that cannot be spliced in\n", metadataFilePath)
+
+		contents, err = yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(metadataFilePath, contents, 0644)
+}
+
+// applyOpsFile applies the operations of the ops file to doc one at a time,
+// so that a failure names the operation and its path.
+func applyOpsFile(opsFile string, doc interface{}) (interface{}, error) {
+	data, err := ioutil.ReadFile(opsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ops file %s: %s", opsFile, err)
+	}
+
+	var definitions []patch.OpDefinition
+	if err := yaml.Unmarshal(data, &definitions); err != nil {
+		return nil, fmt.Errorf("unable to parse ops file %s: %s", opsFile, err)
+	}
+
+	ops, err := patch.NewOpsFromDefinitions(definitions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ops file %s: %s", opsFile, err)
+	}
+
+	for j, op := range ops {
+		doc, err = op.Apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("ops file %s: %s operation [%d] on path '%s' failed: %s", opsFile, definitions[j].Type, j, *definitions[j].Path, err)
+		}
+	}
+	return doc, nil
+}
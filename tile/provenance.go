@@ -0,0 +1,88 @@
+package tile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ProvenanceFile is where the injector records what it did to a tile,
+// relative to its root. It is out of the metadata directory, which Ops
+// Manager reads.
+const ProvenanceFile = "winfs-injector/provenance.yml"
+
+// Provenance records the injection of a release into a tile.
+type Provenance struct {
+	InjectorVersion string `yaml:"injector_version"`
+	// InjectedAt is the time of the injection, in RFC 3339 format.
+	InjectedAt      string `yaml:"injected_at"`
+	InputTileSHA256 string `yaml:"input_tile_sha256"`
+	// ProductVersion is the product_version of the output tile.
+	ProductVersion string `yaml:"product_version"`
+
+	// Image is the rootfs image the release was built from, unless a
+	// prebuilt release was injected.
+	Image   *ProvenanceImage  `yaml:"image,omitempty"`
+	Release ProvenanceRelease `yaml:"release"`
+}
+
+// ProvenanceImage identifies the rootfs image by its reference and the digest
+// the reference resolved to.
+type ProvenanceImage struct {
+	Name   string `yaml:"name"`
+	Tag    string `yaml:"tag"`
+	Digest string `yaml:"digest"`
+}
+
+// ProvenanceRelease identifies the injected release tarball.
+type ProvenanceRelease struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+	File    string `yaml:"file"`
+	SHA1    string `yaml:"sha1"`
+	SHA256  string `yaml:"sha256"`
+}
+
+// RecordProvenance writes the provenance to the ProvenanceFile of the tile,
+// after appending the ProductVersionSuffix to the product_version of its
+// metadata. The suffix is not appended twice to a tile injected again.
+func (i TileInjector) RecordProvenance(provenance Provenance, tileDir string) error {
+	metadataFilePath, metadata, err := i.readMetadata(tileDir)
+	if err != nil {
+		return err
+	}
+
+	provenance.ProductVersion = metadata.ProductVersion
+	if i.ProductVersionSuffix != "" && !strings.HasSuffix(metadata.ProductVersion, i.ProductVersionSuffix) {
+		provenance.ProductVersion += i.ProductVersionSuffix
+
+		contents, err := ioutil.ReadFile(metadataFilePath)
+		if err != nil {
+			return err
+		}
+
+		contents, err = setProductVersion(contents, provenance.ProductVersion)
+		if err != nil {
+			return fmt.Errorf("unable to edit product metadata %s: %s", metadataFilePath, err)
+		}
+
+		if err := ioutil.WriteFile(metadataFilePath, contents, 0644); err != nil {
+			return err
+		}
+	}
+
+	contents, err := yaml.Marshal(provenance)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(tileDir, ProvenanceFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, contents, 0644)
+}
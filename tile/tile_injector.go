@@ -3,33 +3,71 @@ package tile
 import (
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
-type TileInjector struct{}
+// ExistingReleasePolicy controls what AddReleaseToMetadata does when the
+// metadata already lists a release with the same name but another version,
+// file or digest.
+type ExistingReleasePolicy string
 
-func NewTileInjector() TileInjector {
-	return TileInjector{}
+const (
+	// ExistingReleaseFail returns a ReleaseConflictError.
+	ExistingReleaseFail ExistingReleasePolicy = "fail"
+	// ExistingReleaseReplace replaces the listed release.
+	ExistingReleaseReplace ExistingReleasePolicy = "replace"
+)
+
+// ReleaseConflictError is returned when the metadata already lists another
+// version of a release.
+type ReleaseConflictError struct {
+	Existing Release
+	Release  Release
+}
+
+func (e ReleaseConflictError) Error() string {
+	return fmt.Sprintf("product metadata already lists release %s version %s (%s), which conflicts with version %s (%s)", e.Existing.Name, e.Existing.Version, e.Existing.File, e.Release.Version, e.Release.File)
+}
+
+type TileInjector struct {
+	logger *log.Logger
+
+	// ExistingRelease is the policy for a release the metadata already
+	// lists. It defaults to ExistingReleaseFail.
+	ExistingRelease ExistingReleasePolicy
+	// MetadataFile is the path of the product metadata relative to the root
+	// of the tile. By default it is discovered in the metadata directory.
+	MetadataFile string
+	// ProductVersionSuffix is appended to the product_version of the metadata
+	// by RecordProvenance, so that injected tiles can be told apart.
+	ProductVersionSuffix string
+	// MetadataOpsFiles are the paths of go-patch ops files, applied to the
+	// product metadata by ApplyMetadataOpsFiles.
+	MetadataOpsFiles []string
 }
 
-func (i TileInjector) AddReleaseToMetadata(releasePath, releaseName, releaseVersion, tileDir string) error {
-	releaseFileName := filepath.Base(releasePath)
+func NewTileInjector(logger *log.Logger) TileInjector {
+	return TileInjector{logger: logger}
+}
+
+// AddReleaseToMetadata lists the release in the product metadata of the tile,
+// whose releases directory has to contain its file. Adding a release that is
+// already listed with the same version, file and digest does nothing.
+func (i TileInjector) AddReleaseToMetadata(release Release, tileDir string) error {
+	releaseFile := filepath.Join(tileDir, "releases", release.File)
+	info, err := os.Stat(releaseFile)
+	if err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("expected to find the file of release %s at '%s', but found none", release.Name, releaseFile)
+	}
 
-	metadataGlob := filepath.Join(tileDir, "metadata", "*.yml")
-	yamlFiles, err := filepath.Glob(metadataGlob)
+	metadataFilePath, err := i.metadataFile(tileDir)
 	if err != nil {
 		return err
 	}
-	if yamlFiles == nil {
-		return fmt.Errorf("expected to find a product metadata file matching path '%s', but found none", metadataGlob)
-	}
-	if len(yamlFiles) > 1 {
-		return fmt.Errorf("expected to find a single metadata file matching path '%s', but found multiple", metadataGlob)
-	}
-	metadataFilePath := yamlFiles[0]
 
 	f, err := os.Open(metadataFilePath)
 	if err != nil {
@@ -42,22 +80,117 @@ func (i TileInjector) AddReleaseToMetadata(releasePath, releaseName, releaseVers
 		return err
 	}
 
-	var originalMetadata Metadata
-	err = yaml.Unmarshal(data, &originalMetadata)
+	releases, err := parseReleases(data)
 	if err != nil {
 		return err
 	}
 
-	originalMetadata.Releases = append(originalMetadata.Releases, Release{
-		Name:    releaseName,
-		Version: releaseVersion,
-		File:    releaseFileName,
-	})
+	indexes, existing, err := releases.find(release.Name)
+	if err != nil {
+		return err
+	}
 
-	contents, err := yaml.Marshal(&originalMetadata)
+	var contents []byte
+	switch {
+	case len(indexes) == 0:
+		contents, err = releases.appendRelease(release)
+	case len(indexes) > 1:
+		return fmt.Errorf("product metadata lists release %s %d times", release.Name, len(indexes))
+	case sameRelease(existing[0], release):
+		return nil
+	case i.ExistingRelease == ExistingReleaseReplace:
+		contents, err = releases.replaceRelease(indexes[0], release)
+	default:
+		return ReleaseConflictError{Existing: existing[0], Release: release}
+	}
 	if err != nil {
 		return err
 	}
 
 	return ioutil.WriteFile(metadataFilePath, contents, 0644)
 }
+
+// RemoveReleaseFromMetadata removes the release with the name from the
+// product metadata of the tile, and returns the entry it removed. Its file is
+// left in the releases directory.
+func (i TileInjector) RemoveReleaseFromMetadata(name, tileDir string) (Release, error) {
+	metadataFilePath, err := i.metadataFile(tileDir)
+	if err != nil {
+		return Release{}, err
+	}
+
+	data, err := ioutil.ReadFile(metadataFilePath)
+	if err != nil {
+		return Release{}, err
+	}
+
+	releases, err := parseReleases(data)
+	if err != nil {
+		return Release{}, err
+	}
+
+	indexes, existing, err := releases.find(name)
+	if err != nil {
+		return Release{}, err
+	}
+
+	if len(indexes) == 0 {
+		return Release{}, fmt.Errorf("product metadata does not list release %s", name)
+	}
+	if len(indexes) > 1 {
+		return Release{}, fmt.Errorf("product metadata lists release %s %d times", name, len(indexes))
+	}
+
+	contents, err := releases.removeRelease(indexes[0])
+	if err != nil {
+		return Release{}, err
+	}
+
+	return existing[0], ioutil.WriteFile(metadataFilePath, contents, 0644)
+}
+
+// sameRelease tells whether the listed release is the release being added. A
+// listed release without a digest matches any digest.
+func sameRelease(listed, release Release) bool {
+	return listed.Version == release.Version &&
+		listed.File == release.File &&
+		(listed.SHA1 == "" || listed.SHA1 == release.SHA1)
+}
+
+// ValidateMetadata checks the product metadata of the tile for structural
+// errors, and returns a MetadataError listing them.
+func (i TileInjector) ValidateMetadata(tileDir string) error {
+	metadataFilePath, metadata, err := i.readMetadata(tileDir)
+	if err != nil {
+		return err
+	}
+
+	if problems := metadata.Validate(tileDir); len(problems) > 0 {
+		return MetadataError{Path: metadataFilePath, Problems: problems}
+	}
+	return nil
+}
+
+// ReadMetadata returns the product template of a tile extracted to tileDir.
+func (i TileInjector) ReadMetadata(tileDir string) (Metadata, error) {
+	_, metadata, err := i.readMetadata(tileDir)
+	return metadata, err
+}
+
+func (i TileInjector) readMetadata(tileDir string) (string, Metadata, error) {
+	metadataFilePath, err := i.metadataFile(tileDir)
+	if err != nil {
+		return "", Metadata{}, err
+	}
+
+	data, err := ioutil.ReadFile(metadataFilePath)
+	if err != nil {
+		return "", Metadata{}, err
+	}
+
+	var metadata Metadata
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		return "", Metadata{}, fmt.Errorf("unable to parse product metadata %s: %s", metadataFilePath, err)
+	}
+	return metadataFilePath, metadata, nil
+}
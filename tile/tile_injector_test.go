@@ -2,13 +2,16 @@ package tile_test
 
 import (
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 
 	yaml "gopkg.in/yaml.v2"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/pivotal-cf/winfs-injector/tile"
 )
 
@@ -18,25 +21,22 @@ var _ = Describe("TileInjector", func() {
 
 		baseTmpDir       string
 		tileDir          string
-		releasePath      string
-		releaseName      string
-		releaseVersion   string
+		release          tile.Release
 		metadataPath     string
 		expectedMetadata tile.Metadata
 	)
 
 	BeforeEach(func() {
-		releaseName = "some-release"
-		releaseVersion = "1.2.3"
+		release = tile.Release{
+			Name:    "some-release",
+			File:    "some-release.tgz",
+			Version: "1.2.3",
+		}
 
 		var err error
 		baseTmpDir, err = ioutil.TempDir("", "")
 		Expect(err).NotTo(HaveOccurred())
 
-		releasePath = filepath.Join(baseTmpDir, "some-release.tgz")
-		err = ioutil.WriteFile(releasePath, []byte("something"), 0644)
-		Expect(err).NotTo(HaveOccurred())
-
 		tileDir = filepath.Join(baseTmpDir, "some-tile")
 		err = os.Mkdir(tileDir, 0755)
 		Expect(err).NotTo(HaveOccurred())
@@ -48,6 +48,12 @@ var _ = Describe("TileInjector", func() {
 		err = os.Mkdir(filepath.Join(tileDir, "metadata"), 0755)
 		Expect(err).NotTo(HaveOccurred())
 
+		err = os.Mkdir(filepath.Join(tileDir, "releases"), 0755)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = ioutil.WriteFile(filepath.Join(tileDir, "releases", "some-release.tgz"), []byte("release"), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
 		metadataPath = filepath.Join(tileDir, "metadata", "some-product-metadata.yml")
 		err = ioutil.WriteFile(metadataPath, initialMetadataContents, 0644)
 		Expect(err).NotTo(HaveOccurred())
@@ -59,16 +65,26 @@ var _ = Describe("TileInjector", func() {
 		err = yaml.Unmarshal(expectedMetadataContents, &expectedMetadata)
 		Expect(err).NotTo(HaveOccurred())
 
-		tileInjector = tile.NewTileInjector()
+		tileInjector = tile.NewTileInjector(log.New(GinkgoWriter, "", 0))
 	})
 
 	AfterEach(func() {
 		Expect(os.RemoveAll(baseTmpDir)).To(Succeed())
 	})
 
+	// writeProductMetadata writes the product template with a name and a
+	// product_version, which discovery looks for among the metadata files.
+	writeProductMetadata := func() {
+		contents, err := ioutil.ReadFile(filepath.Join("fixtures", "initial_product_metadata.yml"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(metadataPath, contents, 0644)).To(Succeed())
+	}
+
 	Describe("AddReleaseToMetadata", func() {
 		It("adds the release to the tile metadata", func() {
-			err := tileInjector.AddReleaseToMetadata(releasePath, releaseName, releaseVersion, tileDir)
+			tileInjector.MetadataFile = filepath.Join("metadata", "some-product-metadata.yml")
+
+			err := tileInjector.AddReleaseToMetadata(release, tileDir)
 			Expect(err).NotTo(HaveOccurred())
 
 			rawMetadata, err := ioutil.ReadFile(metadataPath)
@@ -80,11 +96,222 @@ var _ = Describe("TileInjector", func() {
 			Expect(actualMetadata).To(Equal(expectedMetadata))
 		})
 
+		It("adds the release to the product template it finds among the metadata files", func() {
+			writeProductMetadata()
+
+			err := tileInjector.AddReleaseToMetadata(release, tileDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			rawMetadata, err := ioutil.ReadFile(metadataPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			expectedContents, err := ioutil.ReadFile(filepath.Join("fixtures", "expected_product_metadata.yml"))
+			Expect(err).NotTo(HaveOccurred())
+
+			var actualMetadata, expectedProductMetadata tile.Metadata
+			Expect(yaml.Unmarshal(rawMetadata, &actualMetadata)).To(Succeed())
+			Expect(yaml.Unmarshal(expectedContents, &expectedProductMetadata)).To(Succeed())
+			Expect(actualMetadata).To(Equal(expectedProductMetadata))
+		})
+
+		It("records the digest of the release", func() {
+			release.SHA1 = "e2f5a2a5b3c6a9a3c0c1e9f9d7c8b1a4f3e2d1c0"
+			tileInjector.MetadataFile = filepath.Join("metadata", "some-product-metadata.yml")
+
+			err := tileInjector.AddReleaseToMetadata(release, tileDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			rawMetadata, err := ioutil.ReadFile(metadataPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(rawMetadata)).To(ContainSubstring(`- name: some-release
+  file: some-release.tgz
+  version: 1.2.3
+  sha1: e2f5a2a5b3c6a9a3c0c1e9f9d7c8b1a4f3e2d1c0
+`))
+		})
+
+		DescribeTable("keeps every other byte of the metadata",
+			func(initial, expected string) {
+				Expect(ioutil.WriteFile(metadataPath, []byte(initial), 0644)).To(Succeed())
+				tileInjector.MetadataFile = filepath.Join("metadata", "some-product-metadata.yml")
+
+				err := tileInjector.AddReleaseToMetadata(release, tileDir)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ioutil.ReadFile(metadataPath)).To(Equal([]byte(expected)))
+			},
+			Entry("comments, anchors, key order and unknown release fields",
+				`---
+# the product
+name: windows2019 # trailing
+product_version: &version 2.11.0
+releases:
+  - name: hwc-buildpack
+    file: hwc-buildpack-3.1.1.tgz
+    version: 3.1.1
+    url: https://example.com/hwc-buildpack-3.1.1.tgz
+    sha1: 1f0e5c6d7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d
+  - name: "quoted"
+    file: 'quoted.tgz'
+    version:   *version    # odd spacing
+    # a comment about the last release
+
+# head comment of the next key
+stemcell_criteria: {os: windows2019, version: "2019.41"}
+`,
+				`---
+# the product
+name: windows2019 # trailing
+product_version: &version 2.11.0
+releases:
+  - name: hwc-buildpack
+    file: hwc-buildpack-3.1.1.tgz
+    version: 3.1.1
+    url: https://example.com/hwc-buildpack-3.1.1.tgz
+    sha1: 1f0e5c6d7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d
+  - name: "quoted"
+    file: 'quoted.tgz'
+    version:   *version    # odd spacing
+    # a comment about the last release
+  - name: some-release
+    file: some-release.tgz
+    version: 1.2.3
+
+# head comment of the next key
+stemcell_criteria: {os: windows2019, version: "2019.41"}
+`),
+			Entry("releases ending the file without a line break",
+				"name: windows2019\nreleases:\n- name: a\n  file: a.tgz\n  version: |\n    1.0.0",
+				"name: windows2019\nreleases:\n- name: a\n  file: a.tgz\n  version: |\n    1.0.0\n- name: some-release\n  file: some-release.tgz\n  version: 1.2.3\n"),
+			Entry("an empty flow sequence",
+				"name: windows2019\nreleases: [] # none yet\n",
+				"name: windows2019\nreleases: [{name: some-release, file: some-release.tgz, version: 1.2.3}] # none yet\n"),
+			Entry("a flow sequence with brackets in its values",
+				"releases: [{name: a, file: \"a].tgz\", version: 'it''s]'}]\nname: windows2019\n",
+				"releases: [{name: a, file: \"a].tgz\", version: 'it''s]'}, {name: some-release, file: some-release.tgz, version: 1.2.3}]\nname: windows2019\n"),
+			Entry("releases without a value",
+				"releases:\nname: windows2019\n",
+				"releases:\n- name: some-release\n  file: some-release.tgz\n  version: 1.2.3\nname: windows2019\n"),
+			Entry("null releases",
+				"releases: ~\nname: windows2019\n",
+				"releases: [{name: some-release, file: some-release.tgz, version: 1.2.3}]\nname: windows2019\n"),
+			Entry("no releases",
+				"name: windows2019",
+				"name: windows2019\nreleases:\n- name: some-release\n  file: some-release.tgz\n  version: 1.2.3\n"),
+		)
+
+		Context("when the metadata already lists the release", func() {
+			const listed = `releases:
+- name: other-release
+  file: other-release.tgz
+  version: 0.1.0
+- name: some-release
+  file: some-release-1.2.2.tgz
+  version: 1.2.2
+  url: https://example.com/some-release-1.2.2.tgz
+# head comment of the last release
+- name: last-release
+  file: last-release.tgz
+  version: 2.0.0
+name: some-product
+`
+
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(metadataPath, []byte(listed), 0644)).To(Succeed())
+				tileInjector.MetadataFile = filepath.Join("metadata", "some-product-metadata.yml")
+			})
+
+			It("does nothing when the same release is added again", func() {
+				Expect(ioutil.WriteFile(metadataPath, []byte("releases: # comment\n- name: other-release\n"), 0644)).To(Succeed())
+
+				err := tileInjector.AddReleaseToMetadata(release, tileDir)
+				Expect(err).NotTo(HaveOccurred())
+				added, err := ioutil.ReadFile(metadataPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = tileInjector.AddReleaseToMetadata(release, tileDir)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ioutil.ReadFile(metadataPath)).To(Equal(added))
+			})
+
+			It("returns a conflict error when another version is listed", func() {
+				err := tileInjector.AddReleaseToMetadata(release, tileDir)
+				Expect(err).To(MatchError("product metadata already lists release some-release version 1.2.2 (some-release-1.2.2.tgz), which conflicts with version 1.2.3 (some-release.tgz)"))
+				Expect(err).To(BeAssignableToTypeOf(tile.ReleaseConflictError{}))
+
+				Expect(ioutil.ReadFile(metadataPath)).To(Equal([]byte(listed)))
+			})
+
+			It("returns a conflict error when the same version is listed with another digest", func() {
+				Expect(ioutil.WriteFile(metadataPath, []byte("releases:\n- name: some-release\n  file: some-release.tgz\n  version: 1.2.3\n  sha1: abc\n"), 0644)).To(Succeed())
+				release.SHA1 = "def"
+
+				err := tileInjector.AddReleaseToMetadata(release, tileDir)
+				Expect(err).To(BeAssignableToTypeOf(tile.ReleaseConflictError{}))
+			})
+
+			It("replaces the listed release when the policy says so", func() {
+				tileInjector.ExistingRelease = tile.ExistingReleaseReplace
+
+				err := tileInjector.AddReleaseToMetadata(release, tileDir)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ioutil.ReadFile(metadataPath)).To(Equal([]byte(`releases:
+- name: other-release
+  file: other-release.tgz
+  version: 0.1.0
+- name: some-release
+  file: some-release.tgz
+  version: 1.2.3
+# head comment of the last release
+- name: last-release
+  file: last-release.tgz
+  version: 2.0.0
+name: some-product
+`)))
+			})
+
+			It("replaces a release listed last or in a flow sequence", func() {
+				tileInjector.ExistingRelease = tile.ExistingReleaseReplace
+
+				Expect(ioutil.WriteFile(metadataPath, []byte("releases:\n- name: some-release\n  file: old.tgz\n  version: 1.0.0 # old\n\n# next\nname: some-product\n"), 0644)).To(Succeed())
+				Expect(tileInjector.AddReleaseToMetadata(release, tileDir)).To(Succeed())
+				Expect(ioutil.ReadFile(metadataPath)).To(Equal([]byte("releases:\n- name: some-release\n  file: some-release.tgz\n  version: 1.2.3\n\n# next\nname: some-product\n")))
+
+				Expect(ioutil.WriteFile(metadataPath, []byte("releases: [{name: a}, {name: some-release, file: \"old}.tgz\"}, {name: b}]\n"), 0644)).To(Succeed())
+				Expect(tileInjector.AddReleaseToMetadata(release, tileDir)).To(Succeed())
+				Expect(ioutil.ReadFile(metadataPath)).To(Equal([]byte("releases: [{name: a}, {name: some-release, file: some-release.tgz, version: 1.2.3}, {name: b}]\n")))
+			})
+
+			It("returns an error when the release is listed more than once", func() {
+				Expect(ioutil.WriteFile(metadataPath, []byte("releases:\n- name: some-release\n- name: some-release\n"), 0644)).To(Succeed())
+
+				err := tileInjector.AddReleaseToMetadata(release, tileDir)
+				Expect(err).To(MatchError("product metadata lists release some-release 2 times"))
+			})
+		})
+
 		Context("failure cases", func() {
+			It("returns an error when the release file is not in the releases directory", func() {
+				release.File = "missing-release.tgz"
+
+				err := tileInjector.AddReleaseToMetadata(release, tileDir)
+				Expect(err).To(MatchError(ContainSubstring("expected to find the file of release some-release at '" + filepath.Join(tileDir, "releases", "missing-release.tgz") + "'")))
+			})
+
+			It("returns an error when the releases are not a list", func() {
+				Expect(ioutil.WriteFile(metadataPath, []byte("releases: {name: a}\n"), 0644)).To(Succeed())
+				tileInjector.MetadataFile = filepath.Join("metadata", "some-product-metadata.yml")
+
+				err := tileInjector.AddReleaseToMetadata(release, tileDir)
+				Expect(err).To(MatchError("releases of the product metadata is not a list, found !!map"))
+			})
+
 			It("returns an error when opening the metadata file fails", func() {
 				Expect(os.RemoveAll(metadataPath)).To(Succeed())
 
-				err := tileInjector.AddReleaseToMetadata(releasePath, releaseName, releaseVersion, tileDir)
+				err := tileInjector.AddReleaseToMetadata(release, tileDir)
 				Expect(err).To(MatchError(ContainSubstring("expected to find a product metadata file")))
 			})
 
@@ -92,7 +319,7 @@ var _ = Describe("TileInjector", func() {
 				Expect(os.RemoveAll(metadataPath)).To(Succeed())
 				Expect(os.MkdirAll(metadataPath, 0777)).To(Succeed())
 
-				err := tileInjector.AddReleaseToMetadata(releasePath, releaseName, releaseVersion, tileDir)
+				err := tileInjector.AddReleaseToMetadata(release, tileDir)
 				Expect(err).To(MatchError(ContainSubstring("is a directory")))
 			})
 
@@ -100,18 +327,365 @@ var _ = Describe("TileInjector", func() {
 				err := ioutil.WriteFile(metadataPath, []byte("%%%%"), 0644)
 				Expect(err).NotTo(HaveOccurred())
 
-				err = tileInjector.AddReleaseToMetadata(releasePath, releaseName, releaseVersion, tileDir)
+				err = tileInjector.AddReleaseToMetadata(release, tileDir)
 				Expect(err).To(MatchError(ContainSubstring("yaml: ")))
 			})
 
 			It("returns an error when multiple yaml files exist in the metadata directory", func() {
-				secondMetadataPath := filepath.Join(filepath.Dir(metadataPath), "second.yml")
-				err := ioutil.WriteFile(secondMetadataPath, []byte("{}"), 0644)
+				writeProductMetadata()
+				secondMetadataPath := filepath.Join(filepath.Dir(metadataPath), "second.yaml")
+				err := ioutil.WriteFile(secondMetadataPath, []byte("{name: other, product_version: 1.0.0, releases: []}"), 0644)
 				Expect(err).NotTo(HaveOccurred())
 
-				err = tileInjector.AddReleaseToMetadata(releasePath, releaseName, releaseVersion, tileDir)
-				Expect(err).To(MatchError(ContainSubstring("expected to find a single metadata file")))
+				err = tileInjector.AddReleaseToMetadata(release, tileDir)
+				Expect(err).To(MatchError(ContainSubstring("expected to find a single product metadata file in '" + filepath.Dir(metadataPath) + "', but found multiple: second.yaml, some-product-metadata.yml")))
 			})
 		})
 	})
+
+	Describe("RemoveReleaseFromMetadata", func() {
+		BeforeEach(func() {
+			tileInjector.MetadataFile = filepath.Join("metadata", "some-product-metadata.yml")
+		})
+
+		DescribeTable("removes the entry and keeps every other byte of the metadata",
+			func(initial, expected string) {
+				Expect(ioutil.WriteFile(metadataPath, []byte(initial), 0644)).To(Succeed())
+
+				removed, err := tileInjector.RemoveReleaseFromMetadata("some-release", tileDir)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(removed.File).To(Equal("some-release.tgz"))
+
+				Expect(ioutil.ReadFile(metadataPath)).To(Equal([]byte(expected)))
+			},
+			Entry("the first of a block sequence",
+				"name: p\nreleases:\n# agents\n- name: some-release\n  file: some-release.tgz\n  version: 1.2.3\n- name: a # kept\n  file: a.tgz\n  version: 1.0.0\n",
+				"name: p\nreleases:\n# agents\n- name: a # kept\n  file: a.tgz\n  version: 1.0.0\n"),
+			Entry("the last of a block sequence",
+				"releases:\n  - name: a\n    file: a.tgz\n    version: 1.0.0\n  - name: some-release\n    file: some-release.tgz\n    version: 1.2.3\n\n# next\nname: p\n",
+				"releases:\n  - name: a\n    file: a.tgz\n    version: 1.0.0\n\n# next\nname: p\n"),
+			Entry("the only one of a block sequence",
+				"name: p\nreleases: # all of them\n- name: some-release\n  file: some-release.tgz\n  version: 1.2.3\nproduct_version: 1.0.0\n",
+				"name: p\nreleases: [] # all of them\nproduct_version: 1.0.0\n"),
+			Entry("the first of a flow sequence",
+				"releases: [{name: some-release, file: some-release.tgz, version: 1.2.3}, {name: a, file: a.tgz, version: 1.0.0}]\n",
+				"releases: [{name: a, file: a.tgz, version: 1.0.0}]\n"),
+			Entry("the last of a flow sequence",
+				"releases: [{name: a, file: a.tgz, version: 1.0.0}, {name: some-release, file: some-release.tgz, version: 1.2.3}]\n",
+				"releases: [{name: a, file: a.tgz, version: 1.0.0}]\n"),
+			Entry("the only one of a flow sequence",
+				"releases: [{name: some-release, file: some-release.tgz, version: 1.2.3}] # none left\n",
+				"releases: [] # none left\n"),
+		)
+
+		It("returns an error when the metadata does not list the release", func() {
+			Expect(ioutil.WriteFile(metadataPath, []byte("name: p\nreleases: []\n"), 0644)).To(Succeed())
+
+			_, err := tileInjector.RemoveReleaseFromMetadata("some-release", tileDir)
+			Expect(err).To(MatchError("product metadata does not list release some-release"))
+		})
+	})
+
+	Describe("ApplyMetadataOpsFiles", func() {
+		var opsDir string
+
+		writeOpsFile := func(name, ops string) string {
+			path := filepath.Join(opsDir, name)
+			Expect(ioutil.WriteFile(path, []byte(ops), 0644)).To(Succeed())
+			return path
+		}
+
+		BeforeEach(func() {
+			tileInjector.MetadataFile = filepath.Join("metadata", "some-product-metadata.yml")
+			opsDir = filepath.Join(baseTmpDir, "ops")
+			Expect(os.Mkdir(opsDir, 0755)).To(Succeed())
+
+			Expect(ioutil.WriteFile(metadataPath, []byte(`name: some-product
+label: Windows Runtime
+product_version: 1.0.0
+property_blueprints:
+- name: enable_smb
+  type: boolean
+  default: false
+releases: []
+`), 0644)).To(Succeed())
+		})
+
+		It("applies the ops files in order", func() {
+			tileInjector.MetadataOpsFiles = []string{
+				writeOpsFile("label.yml", "- type: replace\n  path: /label\n  value: Windows Runtime (internal)\n"),
+				writeOpsFile("smb.yml", `- type: replace
+  path: /property_blueprints/name=enable_smb/default
+  value: true
+- type: replace
+  path: /label
+  value: Windows Runtime (internal build)
+`),
+			}
+
+			Expect(tileInjector.ApplyMetadataOpsFiles(tileDir)).To(Succeed())
+
+			var metadata tile.Metadata
+			contents, err := ioutil.ReadFile(metadataPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(yaml.Unmarshal(contents, &metadata)).To(Succeed())
+
+			Expect(metadata.Other).To(HaveKeyWithValue("label", "Windows Runtime (internal build)"))
+			Expect(metadata.PropertyBlueprints[0].Other).To(HaveKeyWithValue("default", true))
+			Expect(metadata.Name).To(Equal("some-product"))
+		})
+
+		It("rewrites only what the ops files change, keeping comments and key order", func() {
+			Expect(ioutil.WriteFile(metadataPath, []byte(`---
+# Windows Runtime
+product_version: 1.0.0
+name: some-product
+label: "Windows Runtime" # shown in Ops Manager
+property_blueprints:
+# SMB volume services
+- name: enable_smb
+  type: boolean
+  default: false # off until 2.0
+- type: string
+  name: smb_domain
+  optional: true
+job_types: &job_types
+- name: windows_diego_cell
+  label: Windows Diego Cell
+releases: []
+`), 0644)).To(Succeed())
+
+			tileInjector.MetadataOpsFiles = []string{
+				writeOpsFile("ops.yml", `- type: replace
+  path: /label
+  value: Windows Runtime (internal)
+- type: replace
+  path: /property_blueprints/name=enable_smb/default
+  value: true
+- type: remove
+  path: /property_blueprints/name=smb_domain
+- type: replace
+  path: /property_blueprints/-
+  value: {name: smb_password, type: secret}
+- type: replace
+  path: /icon_image?
+  value: some-icon
+`),
+			}
+
+			Expect(tileInjector.ApplyMetadataOpsFiles(tileDir)).To(Succeed())
+
+			Expect(ioutil.ReadFile(metadataPath)).To(BeEquivalentTo(`---
+# Windows Runtime
+product_version: 1.0.0
+name: some-product
+label: "Windows Runtime (internal)" # shown in Ops Manager
+property_blueprints:
+# SMB volume services
+- name: enable_smb
+  type: boolean
+  default: true # off until 2.0
+- type: secret
+  name: smb_password
+job_types: &job_types
+- name: windows_diego_cell
+  label: Windows Diego Cell
+releases: []
+icon_image: some-icon
+`))
+		})
+
+		It("rewrites the metadata as a whole when the changes cannot be spliced in", func() {
+			logs := gbytes.NewBuffer()
+			tileInjector = tile.NewTileInjector(log.New(logs, "", 0))
+			tileInjector.MetadataFile = filepath.Join("metadata", "some-product-metadata.yml")
+
+			Expect(ioutil.WriteFile(metadataPath, []byte(`name: some-product
+base: &base
+  type: boolean
+property_blueprints:
+- <<: *base
+  name: enable_smb
+`), 0644)).To(Succeed())
+			tileInjector.MetadataOpsFiles = []string{
+				writeOpsFile("ops.yml", "- type: replace\n  path: /base/type\n  value: string\n"),
+			}
+
+			Expect(tileInjector.ApplyMetadataOpsFiles(tileDir)).To(Succeed())
+
+			var metadata tile.Metadata
+			contents, err := ioutil.ReadFile(metadataPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(yaml.Unmarshal(contents, &metadata)).To(Succeed())
+			Expect(metadata.PropertyBlueprints[0].Type).To(Equal("boolean"))
+			Expect(metadata.Other).To(HaveKeyWithValue("base", HaveKeyWithValue("type", "string")))
+			Expect(logs).To(gbytes.Say("rewriting product metadata " + metadataPath + " as a whole"))
+		})
+
+		It("reports the path of an operation that fails", func() {
+			opsFile := writeOpsFile("typo.yml", "- type: replace\n  path: /property_blueprints/name=enable_smb/default\n  value: true\n- type: replace\n  path: /form_types/name=smb/label\n  value: SMB\n")
+			tileInjector.MetadataOpsFiles = []string{opsFile}
+
+			err := tileInjector.ApplyMetadataOpsFiles(tileDir)
+			Expect(err).To(MatchError(ContainSubstring("ops file " + opsFile + ": replace operation [1] on path '/form_types/name=smb/label' failed: ")))
+			Expect(err).To(MatchError(ContainSubstring("'/form_types'")))
+		})
+
+		It("leaves the metadata as it is without ops files", func() {
+			before, err := ioutil.ReadFile(metadataPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(tileInjector.ApplyMetadataOpsFiles(tileDir)).To(Succeed())
+
+			Expect(ioutil.ReadFile(metadataPath)).To(Equal(before))
+		})
+	})
+
+	Describe("ValidateMetadata", func() {
+		BeforeEach(func() {
+			tileInjector.MetadataFile = filepath.Join("metadata", "some-product-metadata.yml")
+		})
+
+		It("accepts the metadata with the injected release", func() {
+			Expect(ioutil.WriteFile(metadataPath, []byte("name: some-product\nproduct_version: 1.0.0\nreleases: []\n"), 0644)).To(Succeed())
+			Expect(tileInjector.AddReleaseToMetadata(release, tileDir)).To(Succeed())
+
+			Expect(tileInjector.ValidateMetadata(tileDir)).To(Succeed())
+		})
+
+		It("returns the problems of invalid metadata", func() {
+			Expect(ioutil.WriteFile(metadataPath, []byte("name: some-product\nreleases:\n- name: missing\n  file: missing.tgz\n  version: 1.0.0\n"), 0644)).To(Succeed())
+
+			err := tileInjector.ValidateMetadata(tileDir)
+			Expect(err).To(MatchError("product metadata " + metadataPath + " is invalid:\n- product_version is missing\n- release missing refers to releases/missing.tgz, which is not in the tile"))
+		})
+
+		It("returns an error when the metadata does not parse", func() {
+			Expect(ioutil.WriteFile(metadataPath, []byte("releases: {}\n"), 0644)).To(Succeed())
+
+			err := tileInjector.ValidateMetadata(tileDir)
+			Expect(err).To(MatchError(ContainSubstring("unable to parse product metadata " + metadataPath)))
+		})
+	})
+
+	Describe("ReadMetadata", func() {
+		It("returns the product template of the tile", func() {
+			Expect(ioutil.WriteFile(metadataPath, []byte("name: some-product\nproduct_version: 1.0.0\nstemcell_criteria:\n  os: windows2019\n  version: \"2019.41\"\nreleases: []\n"), 0644)).To(Succeed())
+
+			metadata, err := tileInjector.ReadMetadata(tileDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.Name).To(Equal("some-product"))
+			Expect(metadata.StemcellCriteria).To(Equal(&tile.StemcellCriteria{OS: "windows2019", Version: "2019.41"}))
+		})
+	})
+
+	Describe("RecordProvenance", func() {
+		var provenance tile.Provenance
+
+		BeforeEach(func() {
+			writeProductMetadata()
+			tileInjector.MetadataFile = filepath.Join("metadata", "some-product-metadata.yml")
+			provenance = tile.Provenance{
+				InjectorVersion: "1.2.3",
+				InjectedAt:      "2021-06-01T10:00:00Z",
+				InputTileSHA256: "4b2d5e6f",
+				Release:         tile.ProvenanceRelease{Name: "some-release", Version: "1.2.3", File: "some-release.tgz", SHA1: "abc", SHA256: "def"},
+			}
+		})
+
+		It("writes the provenance out of the metadata directory", func() {
+			Expect(tileInjector.RecordProvenance(provenance, tileDir)).To(Succeed())
+
+			contents, err := ioutil.ReadFile(filepath.Join(tileDir, tile.ProvenanceFile))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(`injector_version: 1.2.3
+injected_at: "2021-06-01T10:00:00Z"
+input_tile_sha256: 4b2d5e6f
+product_version: 1.0.0
+release:
+  name: some-release
+  version: 1.2.3
+  file: some-release.tgz
+  sha1: abc
+  sha256: def
+`))
+			Expect(filepath.Join(tileDir, "metadata", "winfs-injector.yml")).NotTo(BeAnExistingFile())
+		})
+
+		DescribeTable("appends the suffix to the product version",
+			func(initial, expected string) {
+				Expect(ioutil.WriteFile(metadataPath, []byte(initial), 0644)).To(Succeed())
+				tileInjector.ProductVersionSuffix = "+winfs"
+
+				Expect(tileInjector.RecordProvenance(provenance, tileDir)).To(Succeed())
+
+				contents, err := ioutil.ReadFile(metadataPath)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal(expected))
+
+				contents, err = ioutil.ReadFile(filepath.Join(tileDir, tile.ProvenanceFile))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(ContainSubstring("product_version: 2.11.0+winfs\n"))
+			},
+			Entry("plain",
+				"name: p # the product\nproduct_version: 2.11.0 # bumped by ci\nreleases: []\n",
+				"name: p # the product\nproduct_version: 2.11.0+winfs # bumped by ci\nreleases: []\n"),
+			Entry("double quoted",
+				"name: p\nproduct_version: \"2.11.0\"\nreleases: []\n",
+				"name: p\nproduct_version: \"2.11.0+winfs\"\nreleases: []\n"),
+			Entry("single quoted",
+				"name: p\nproduct_version: '2.11.0'\nreleases: []\n",
+				"name: p\nproduct_version: '2.11.0+winfs'\nreleases: []\n"),
+			Entry("already suffixed",
+				"name: p\nproduct_version: 2.11.0+winfs\nreleases: []\n",
+				"name: p\nproduct_version: 2.11.0+winfs\nreleases: []\n"),
+		)
+	})
+
+	Describe("metadata discovery", func() {
+		var logs *gbytes.Buffer
+
+		BeforeEach(func() {
+			logs = gbytes.NewBuffer()
+			tileInjector = tile.NewTileInjector(log.New(logs, "", 0))
+
+			Expect(os.Remove(metadataPath)).To(Succeed())
+			metadataPath = filepath.Join(tileDir, "metadata", "windows.yaml")
+			Expect(ioutil.WriteFile(metadataPath, []byte("name: windows2019\nproduct_version: 2.11.0\nreleases: []\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(tileDir, "metadata", "notes.yml"), []byte("name: release notes\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(tileDir, "metadata", "broken.yml"), []byte("- [\n"), 0644)).To(Succeed())
+		})
+
+		It("edits the yaml file that is a product template and reports the others", func() {
+			Expect(tileInjector.AddReleaseToMetadata(release, tileDir)).To(Succeed())
+
+			Expect(ioutil.ReadFile(metadataPath)).To(ContainSubstring("name: some-release"))
+			Expect(ioutil.ReadFile(filepath.Join(tileDir, "metadata", "notes.yml"))).To(Equal([]byte("name: release notes\n")))
+
+			Expect(logs).To(gbytes.Say("Ignoring metadata file broken.yml: not a yaml map: yaml: "))
+			Expect(logs).To(gbytes.Say("Ignoring metadata file notes.yml: missing product_version, releases"))
+		})
+
+		It("lists the rejected candidates when none of them is a product template", func() {
+			Expect(os.Remove(metadataPath)).To(Succeed())
+
+			err := tileInjector.AddReleaseToMetadata(release, tileDir)
+			Expect(err).To(MatchError(ContainSubstring("none of its yaml files is a product template:\n- broken.yml: not a yaml map: yaml: ")))
+			Expect(err).To(MatchError(ContainSubstring("\n- notes.yml: missing product_version, releases")))
+		})
+
+		It("uses the configured metadata file without looking for another one", func() {
+			tileInjector.MetadataFile = filepath.Join("metadata", "notes.yml")
+
+			Expect(tileInjector.AddReleaseToMetadata(release, tileDir)).To(Succeed())
+			Expect(ioutil.ReadFile(filepath.Join(tileDir, "metadata", "notes.yml"))).To(ContainSubstring("name: some-release"))
+		})
+
+		It("returns an error when the configured metadata file does not exist", func() {
+			tileInjector.MetadataFile = filepath.Join("metadata", "missing.yml")
+
+			err := tileInjector.AddReleaseToMetadata(release, tileDir)
+			Expect(err).To(MatchError(ContainSubstring("unable to read product metadata file '" + filepath.Join(tileDir, "metadata", "missing.yml") + "'")))
+		})
+	})
 })
@@ -0,0 +1,121 @@
+package tile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MetadataError lists the structural problems of product metadata.
+type MetadataError struct {
+	Path     string
+	Problems []string
+}
+
+func (e MetadataError) Error() string {
+	return fmt.Sprintf("product metadata %s is invalid:\n- %s", e.Path, strings.Join(e.Problems, "\n- "))
+}
+
+// Validate returns the structural problems of the metadata of a tile
+// extracted to tileDir: missing required fields, names used twice, release
+// files missing from the releases directory, and job templates of releases
+// the product does not list.
+func (m Metadata) Validate(tileDir string) []string {
+	var problems []string
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if m.Name == "" {
+		problemf("name is missing")
+	}
+	if m.ProductVersion == "" {
+		problemf("product_version is missing")
+	}
+
+	if m.StemcellCriteria != nil {
+		if m.StemcellCriteria.OS == "" {
+			problemf("stemcell_criteria.os is missing")
+		}
+		if m.StemcellCriteria.Version == "" {
+			problemf("stemcell_criteria.version is missing")
+		}
+	}
+
+	releases := map[string]bool{}
+	for i, release := range m.Releases {
+		if release.Name == "" {
+			problemf("releases[%d].name is missing", i)
+			continue
+		}
+		if releases[release.Name] {
+			problemf("release %s is listed more than once", release.Name)
+		}
+		releases[release.Name] = true
+
+		if release.Version == "" {
+			problemf("release %s has no version", release.Name)
+		}
+		if release.File == "" {
+			problemf("release %s has no file", release.Name)
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(tileDir, "releases", release.File))
+		if err != nil || !info.Mode().IsRegular() {
+			problemf("release %s refers to releases/%s, which is not in the tile", release.Name, release.File)
+		}
+	}
+
+	jobTypes := map[string]bool{}
+	for i, jobType := range m.JobTypes {
+		if jobType.Name == "" {
+			problemf("job_types[%d].name is missing", i)
+			continue
+		}
+		if jobTypes[jobType.Name] {
+			problemf("job type %s is listed more than once", jobType.Name)
+		}
+		jobTypes[jobType.Name] = true
+
+		for j, template := range jobType.Templates {
+			if template.Name == "" {
+				problemf("job type %s: templates[%d].name is missing", jobType.Name, j)
+			}
+			if !releases[template.Release] {
+				problemf("job type %s: template %s refers to release %q, which is not in releases", jobType.Name, template.Name, template.Release)
+			}
+		}
+	}
+
+	blueprints := map[string]bool{}
+	for i, blueprint := range m.PropertyBlueprints {
+		if blueprint.Name == "" {
+			problemf("property_blueprints[%d].name is missing", i)
+			continue
+		}
+		if blueprints[blueprint.Name] {
+			problemf("property blueprint %s is listed more than once", blueprint.Name)
+		}
+		blueprints[blueprint.Name] = true
+
+		if blueprint.Type == "" {
+			problemf("property blueprint %s has no type", blueprint.Name)
+		}
+	}
+
+	for i, form := range m.FormTypes {
+		if form.Name == "" {
+			problemf("form_types[%d].name is missing", i)
+		}
+	}
+
+	for i, config := range m.RuntimeConfigs {
+		if config.Name == "" {
+			problemf("runtime_configs[%d].name is missing", i)
+		}
+	}
+
+	return problems
+}
@@ -1,21 +1,62 @@
 package tile
 
 import (
+	"archive/zip"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"time"
 
 	"github.com/jhoonb/archivex"
 	"github.com/mholt/archiver"
 )
 
-type Zipper struct{}
+type Zipper struct {
+	// SourceDate, when set, is the modification time of every entry of the
+	// zipped tile, and file permissions are normalized, so that the same
+	// directory always produces the same tile.
+	SourceDate time.Time
+}
 
 func NewZipper() Zipper {
 	return Zipper{}
 }
 
+// Zip zips the directory into outputFile. The tile is written to a temporary
+// file next to outputFile and renamed into place, so that outputFile, which
+// may be the tile the directory was unzipped from, is only ever replaced by a
+// complete tile.
 func (z Zipper) Zip(zipDir, outputFile string) error {
-	zipFile := fmt.Sprintf("%s.zip", outputFile)
+	tmp, err := ioutil.TempFile(filepath.Dir(outputFile), filepath.Base(outputFile)+".*.zip")
+	if err != nil {
+		return err
+	}
+	zipFile := tmp.Name()
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := z.zip(zipDir, zipFile); err != nil {
+		os.Remove(zipFile)
+		return err
+	}
+
+	if err := os.Chmod(zipFile, 0644); err != nil {
+		os.Remove(zipFile)
+		return err
+	}
+
+	return os.Rename(zipFile, outputFile)
+}
+
+func (z Zipper) zip(zipDir, zipFile string) error {
+	if !z.SourceDate.IsZero() {
+		return z.zipReproducibly(zipDir, zipFile)
+	}
+
 	zf := archivex.ZipFile{}
 
 	err := zf.Create(zipFile)
@@ -28,19 +69,137 @@ func (z Zipper) Zip(zipDir, outputFile string) error {
 		return err
 	}
 
-	err = zf.Close()
+	return zf.Close()
+}
+
+// zipReproducibly writes the entries in the order archivex does, a directory
+// before its contents with siblings sorted by name, but without anything that
+// depends on when or by whom the directory was written.
+func (z Zipper) zipReproducibly(zipDir, zipFile string) error {
+	out, err := os.Create(zipFile)
 	if err != nil {
 		return err
 	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	if err := z.addDir(zw, zipDir, ""); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
 
-	err = os.Rename(zipFile, outputFile)
+func (z Zipper) addDir(zw *zip.Writer, dir, prefix string) error {
+	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return err
 	}
 
+	for _, info := range infos {
+		name := path.Join(prefix, info.Name())
+		header := &zip.FileHeader{
+			Name:     name,
+			Modified: z.SourceDate,
+		}
+
+		if info.IsDir() {
+			header.Name += "/"
+			header.SetMode(os.ModeDir | 0755)
+			if _, err := zw.CreateHeader(header); err != nil {
+				return err
+			}
+			if err := z.addDir(zw, filepath.Join(dir, info.Name()), name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header.Method = zip.Deflate
+		header.SetMode(0644)
+		if info.Mode()&0111 != 0 {
+			header.SetMode(0755)
+		}
+
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(w, filepath.Join(dir, info.Name())); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
 func (z Zipper) Unzip(zipFile, outputDir string) error {
 	return archiver.DefaultZip.Unarchive(zipFile, outputDir)
 }
+
+// ZipEntry is a file of a zip archive, as recorded in its central directory.
+type ZipEntry struct {
+	Name  string
+	Size  uint64
+	CRC32 uint32
+}
+
+// List returns the files of the zip archive, without its directories, in the
+// order they are stored.
+func (z Zipper) List(zipFile string) ([]ZipEntry, error) {
+	r, err := zip.OpenReader(zipFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var entries []ZipEntry
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		entries = append(entries, ZipEntry{
+			Name:  f.Name,
+			Size:  f.UncompressedSize64,
+			CRC32: f.CRC32,
+		})
+	}
+	return entries, nil
+}
+
+// ReadFile returns the contents of the named file of the zip archive.
+func (z Zipper) ReadFile(zipFile, name string) ([]byte, error) {
+	r, err := zip.OpenReader(zipFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("%s has no file %s", zipFile, name)
+}
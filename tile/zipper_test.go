@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -77,6 +78,55 @@ var _ = Describe("Zipper", func() {
 			}
 		})
 
+		Context("when a source date is set", func() {
+			var sourceDate time.Time
+
+			BeforeEach(func() {
+				sourceDate = time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+				zipper.SourceDate = sourceDate
+			})
+
+			It("zips the directory the same way whenever and however its files were written", func() {
+				Expect(zipper.Zip(srcDir, zipFile.Name())).To(Succeed())
+				first, err := ioutil.ReadFile(zipFile.Name())
+				Expect(err).NotTo(HaveOccurred())
+
+				topLevelFile := filepath.Join(srcDir, "top-level-file")
+				Expect(os.Chmod(topLevelFile, 0600)).To(Succeed())
+				modified := time.Now().Add(-time.Hour)
+				Expect(os.Chtimes(topLevelFile, modified, modified)).To(Succeed())
+
+				Expect(zipper.Zip(srcDir, zipFile.Name())).To(Succeed())
+				second, err := ioutil.ReadFile(zipFile.Name())
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(second).To(Equal(first))
+			})
+
+			It("writes every entry with the source date and normalized permissions", func() {
+				Expect(zipper.Zip(srcDir, zipFile.Name())).To(Succeed())
+
+				actualZip, err := zip.OpenReader(zipFile.Name())
+				Expect(err).NotTo(HaveOccurred())
+				defer actualZip.Close()
+
+				var names []string
+				for _, f := range actualZip.File {
+					names = append(names, f.Name)
+					Expect(f.Modified.Equal(sourceDate)).To(BeTrue(), f.Name)
+				}
+				Expect(names).To(Equal([]string{"second-level-dir/", "second-level-dir/second-level-file", "top-level-file"}))
+
+				Expect(actualZip.File[0].Mode()).To(Equal(os.ModeDir | 0755))
+				Expect(actualZip.File[2].Mode()).To(Equal(os.FileMode(0644)))
+
+				contents, err := actualZip.File[2].Open()
+				Expect(err).NotTo(HaveOccurred())
+				defer contents.Close()
+				Expect(ioutil.ReadAll(contents)).To(Equal([]byte("foo")))
+			})
+		})
+
 		Context("failure cases", func() {
 			Context("when an intermediate dir in the destination path does not exist", func() {
 				It("returns an error", func() {
@@ -90,6 +140,15 @@ var _ = Describe("Zipper", func() {
 					err := zipper.Zip("/path/to/non-existing/dir", zipFile.Name())
 					Expect(err).To(MatchError(ContainSubstring("/path/to/non-existing/dir")))
 				})
+
+				It("leaves the output file as it was, without a partial zip next to it", func() {
+					Expect(ioutil.WriteFile(zipFile.Name(), []byte("input tile"), 0644)).To(Succeed())
+
+					Expect(zipper.Zip("/path/to/non-existing/dir", zipFile.Name())).NotTo(Succeed())
+
+					Expect(ioutil.ReadFile(zipFile.Name())).To(Equal([]byte("input tile")))
+					Expect(filepath.Glob(zipFile.Name() + ".*")).To(BeEmpty())
+				})
 			})
 		})
 	})
@@ -1,28 +1,56 @@
 package winfsinjector
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strings"
+	"time"
 
+	"github.com/pivotal-cf/winfs-injector/image"
+	"github.com/pivotal-cf/winfs-injector/release"
+	"github.com/pivotal-cf/winfs-injector/tile"
 	yaml "gopkg.in/yaml.v2"
 )
 
 var (
-	readFile  = ioutil.ReadFile
-	removeAll = os.RemoveAll
+	readFile       = ioutil.ReadFile
+	removeAll      = os.RemoveAll
+	validateSource = release.ValidateSource
 )
 
+const rootfsImageName = "cloudfoundry/windows2016fs"
+
 type Application struct {
 	injector       injector
 	releaseCreator releaseCreator
 	zipper         zipper
+
+	// ReleaseTarball is a prebuilt windowsfs release injected instead of
+	// creating one. It must match the name and version of the embedded
+	// release.
+	ReleaseTarball string
+	// ExportDir receives a copy of the injected release tarball, next to
+	// sha1sum and sha256sum style checksum files, so that it can be uploaded
+	// to a director on its own.
+	ExportDir string
+	// AllowStemcellMismatch turns a rootfs image built for another Windows
+	// build than the stemcells of the tile into a warning.
+	AllowStemcellMismatch bool
+
+	// InjectorVersion is recorded in the provenance of the output tile.
+	InjectorVersion string
+	// InjectedAt dates the provenance of the output tile. It defaults to the
+	// time of the injection.
+	InjectedAt time.Time
 }
 
 //go:generate counterfeiter -o ./fakes/file_info.go --fake-name FileInfo os.FileInfo
@@ -30,7 +58,12 @@ type Application struct {
 //go:generate counterfeiter -o ./fakes/injector.go --fake-name Injector . injector
 
 type injector interface {
-	AddReleaseToMetadata(releasePath, releaseName, releaseVersion, extractedTileDir string) error
+	AddReleaseToMetadata(release tile.Release, extractedTileDir string) error
+	ApplyMetadataOpsFiles(extractedTileDir string) error
+	ReadMetadata(extractedTileDir string) (tile.Metadata, error)
+	RecordProvenance(provenance tile.Provenance, extractedTileDir string) error
+	RemoveReleaseFromMetadata(name, extractedTileDir string) (tile.Release, error)
+	ValidateMetadata(extractedTileDir string) error
 }
 
 //go:generate counterfeiter -o ./fakes/zipper.go --fake-name Zipper . zipper
@@ -43,7 +76,7 @@ type zipper interface {
 //go:generate counterfeiter -o ./fakes/release_creator.go --fake-name ReleaseCreator . releaseCreator
 
 type releaseCreator interface {
-	CreateRelease(releaseName, imageName, releaseDir, tarballPath, imageTag, registry, version string) error
+	CreateRelease(options CreateReleaseOptions) (ReleaseResult, error)
 }
 
 func NewApplication(releaseCreator releaseCreator, injector injector, zipper zipper) Application {
@@ -74,51 +107,72 @@ func (a Application) Run(inputTile, outputTile, registry, workingDir string) err
 		fmt.Println("The file system has already been injected in the tile; skipping injection")
 		return nil
 	}
+
+	if a.ReleaseTarball == "" {
+		if err := a.validateReleaseSource(embeddedReleaseDir); err != nil {
+			return err
+		}
+	}
+
 	releaseVersion, err := a.extractReleaseVersion(embeddedReleaseDir)
 	if err != nil {
 		return err
 	}
 
-	if runtime.GOOS == "windows" {
-		cmd := exec.Command("git", "config", "core.filemode", "false")
-		cmd.Dir = embeddedReleaseDir
-		stdoutStderr, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("unable to fix file permissions for windows: %s, %s", stdoutStderr, err)
-		}
+	releaseName, err := a.extractReleaseName(embeddedReleaseDir)
+	if err != nil {
+		return err
+	}
+
+	tarballPath := filepath.Join(extractedTileDir, "releases", fmt.Sprintf("%s-%s.tgz", releaseName, releaseVersion))
+
+	var result ReleaseResult
+	if a.ReleaseTarball != "" {
+		result, err = a.copyReleaseTarball(releaseName, releaseVersion, extractedTileDir, embeddedReleaseDir, tarballPath)
+	} else {
+		result, err = a.createRelease(releaseName, releaseVersion, extractedTileDir, embeddedReleaseDir, tarballPath, registry)
+	}
+	if err != nil {
+		return err
+	}
 
-		cmd = exec.Command("git", "submodule", "foreach", "git", "config", "core.filemode", "false")
-		cmd.Dir = embeddedReleaseDir
-		stdoutStderr, err = cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("unable to fix file permissions for windows: %s, %s", stdoutStderr, err)
+	if a.ExportDir != "" {
+		if err := a.exportRelease(tarballPath, result); err != nil {
+			return err
 		}
 	}
 
-	releaseName, err := a.extractReleaseName(embeddedReleaseDir)
+	err = a.injector.AddReleaseToMetadata(tile.Release{
+		Name:    releaseName,
+		File:    filepath.Base(tarballPath),
+		Version: releaseVersion,
+		SHA1:    result.SHA1,
+	}, extractedTileDir)
 	if err != nil {
 		return err
 	}
 
-	imageName := "cloudfoundry/windows2016fs"
-	imageTag, err := a.determineImageTag(embeddedReleaseDir)
+	err = a.injector.ApplyMetadataOpsFiles(extractedTileDir)
 	if err != nil {
 		return err
 	}
 
-	tarballPath := filepath.Join(extractedTileDir, "releases", fmt.Sprintf("%s-%s.tgz", releaseName, releaseVersion))
+	err = removeAll(embeddedReleaseDir)
+	if err != nil {
+		return err
+	}
 
-	err = a.releaseCreator.CreateRelease(releaseName, imageName, embeddedReleaseDir, tarballPath, imageTag, registry, releaseVersion)
+	provenance, err := a.provenance(inputTile, releaseName, releaseVersion, tarballPath, result)
 	if err != nil {
 		return err
 	}
 
-	err = a.injector.AddReleaseToMetadata(tarballPath, releaseName, releaseVersion, extractedTileDir)
+	err = a.injector.RecordProvenance(provenance, extractedTileDir)
 	if err != nil {
 		return err
 	}
 
-	err = removeAll(embeddedReleaseDir)
+	err = a.injector.ValidateMetadata(extractedTileDir)
 	if err != nil {
 		return err
 	}
@@ -126,6 +180,237 @@ func (a Application) Run(inputTile, outputTile, registry, workingDir string) err
 	return a.zipper.Zip(extractedTileDir, outputTile)
 }
 
+func (a Application) createRelease(releaseName, releaseVersion, tileDir, releaseDir, tarballPath, registry string) (ReleaseResult, error) {
+	imageTag, err := a.determineImageTag(releaseDir)
+	if err != nil {
+		return ReleaseResult{}, err
+	}
+
+	metadata, err := a.injector.ReadMetadata(tileDir)
+	if err != nil {
+		return ReleaseResult{}, err
+	}
+
+	// The tag tells the Windows build before anything is downloaded, and the
+	// image config tells it for sure once the image is opened.
+	imageRef := fmt.Sprintf("%s:%s", rootfsImageName, imageTag)
+	tagBuild := image.WindowsBuildForTag(imageTag)
+	if err := a.checkStemcell(metadata.StemcellCriteria, imageRef, tagBuild); err != nil {
+		return ReleaseResult{}, err
+	}
+
+	return a.releaseCreator.CreateRelease(CreateReleaseOptions{
+		ReleaseName: releaseName,
+		ReleaseDir:  releaseDir,
+		Version:     releaseVersion,
+		TarballPath: tarballPath,
+		ImageName:   rootfsImageName,
+		ImageTag:    imageTag,
+		Registry:    registry,
+		CheckImage: func(img image.Image) error {
+			build := image.WindowsBuildForOSVersion(img.Platform.OSVersion)
+			if build == tagBuild {
+				return nil
+			}
+			return a.checkStemcell(metadata.StemcellCriteria, imageRef, build)
+		},
+	})
+}
+
+// validateReleaseSource checks the embedded release before the image is
+// fetched, so that a broken tile fails before anything is downloaded. The
+// blob of the image is left out of the check when the name or tag it is made
+// of cannot be read, which the findings report instead.
+func (a Application) validateReleaseSource(releaseDir string) error {
+	var producedBlobs []string
+	releaseName, nameErr := a.extractReleaseName(releaseDir)
+	imageTag, tagErr := a.determineImageTag(releaseDir)
+	if nameErr == nil && tagErr == nil && releaseName != "" {
+		producedBlobs = append(producedBlobs, imageBlobName(releaseName, imageTag))
+	}
+
+	findings := validateSource(releaseDir, producedBlobs...)
+	if len(findings) > 0 {
+		return release.SourceError{Dir: releaseDir, Findings: findings}
+	}
+
+	fmt.Printf("Validated release source %s\n", releaseDir)
+	return nil
+}
+
+// imageBlobName is the path of the blob the image fetch produces for the
+// package of the release that includes it.
+func imageBlobName(releaseName, imageTag string) string {
+	return path.Join(releaseName, fmt.Sprintf("%s-%s.tgz", path.Base(rootfsImageName), imageTag))
+}
+
+// checkStemcell fails when the rootfs image does not run on the stemcells of
+// the tile, or only warns about it when mismatches are allowed.
+func (a Application) checkStemcell(criteria *tile.StemcellCriteria, imageRef, imageBuild string) error {
+	err := checkStemcell(criteria, imageRef, imageBuild)
+	if err != nil && a.AllowStemcellMismatch {
+		fmt.Printf("Warning: %s\n", err)
+		return nil
+	}
+	return err
+}
+
+// copyReleaseTarball copies the prebuilt release into the tile after checking
+// that it is the release the tile embeds, and verifies the copy.
+func (a Application) copyReleaseTarball(releaseName, releaseVersion, tileDir, releaseDir, tarballPath string) (ReleaseResult, error) {
+	manifest, err := release.ReadManifest(a.ReleaseTarball)
+	if err != nil {
+		return ReleaseResult{}, err
+	}
+
+	if manifest.Name != releaseName || manifest.Version != releaseVersion {
+		return ReleaseResult{}, fmt.Errorf("release tarball %s contains release %s/%s, but the tile embeds %s/%s", a.ReleaseTarball, manifest.Name, manifest.Version, releaseName, releaseVersion)
+	}
+
+	if err := a.checkPrebuiltStemcell(tileDir, releaseDir); err != nil {
+		return ReleaseResult{}, err
+	}
+
+	fmt.Printf("Using release tarball %s\n", a.ReleaseTarball)
+
+	var (
+		sha1Hash   = sha1.New()
+		sha256Hash = sha256.New()
+	)
+	size, err := copyFile(a.ReleaseTarball, tarballPath, sha1Hash, sha256Hash)
+	if err != nil {
+		return ReleaseResult{}, err
+	}
+
+	_, err = release.Verify(tarballPath, release.Expectations{Name: releaseName, Version: releaseVersion})
+	if err != nil {
+		return ReleaseResult{}, fmt.Errorf("release tarball failed verification: %s", err)
+	}
+
+	return ReleaseResult{
+		TarballPath: tarballPath,
+		Size:        size,
+		SHA1:        hex.EncodeToString(sha1Hash.Sum(nil)),
+		SHA256:      hex.EncodeToString(sha256Hash.Sum(nil)),
+		CommitHash:  manifest.CommitHash,
+		Jobs:        manifest.Jobs,
+		Packages:    manifest.Packages,
+	}, nil
+}
+
+// checkPrebuiltStemcell checks the rootfs image of the prebuilt release against
+// the stemcells of the tile. Being the release the tile embeds, it was built
+// with the image tag of the embedded source; when that tag cannot be read, the
+// check is skipped.
+func (a Application) checkPrebuiltStemcell(tileDir, releaseDir string) error {
+	imageTag, err := a.determineImageTag(releaseDir)
+	if err != nil {
+		fmt.Printf("Skipping the stemcell check of release tarball %s, as its rootfs image is unknown: %s\n", a.ReleaseTarball, err)
+		return nil
+	}
+
+	metadata, err := a.injector.ReadMetadata(tileDir)
+	if err != nil {
+		return err
+	}
+
+	imageRef := fmt.Sprintf("%s:%s", rootfsImageName, imageTag)
+	return a.checkStemcell(metadata.StemcellCriteria, imageRef, image.WindowsBuildForTag(imageTag))
+}
+
+// provenance describes the injection of the release into the input tile.
+func (a Application) provenance(inputTile, releaseName, releaseVersion, tarballPath string, result ReleaseResult) (tile.Provenance, error) {
+	inputTileSHA256 := sha256.New()
+	if err := hashFile(inputTile, inputTileSHA256); err != nil {
+		return tile.Provenance{}, fmt.Errorf("unable to checksum input tile: %s", err)
+	}
+
+	injectedAt := a.InjectedAt
+	if injectedAt.IsZero() {
+		injectedAt = time.Now()
+	}
+
+	provenance := tile.Provenance{
+		InjectorVersion: a.InjectorVersion,
+		InjectedAt:      injectedAt.UTC().Format(time.RFC3339),
+		InputTileSHA256: hex.EncodeToString(inputTileSHA256.Sum(nil)),
+		Release: tile.ProvenanceRelease{
+			Name:    releaseName,
+			Version: releaseVersion,
+			File:    filepath.Base(tarballPath),
+			SHA1:    result.SHA1,
+			SHA256:  result.SHA256,
+		},
+	}
+	if result.Image.Name != "" {
+		provenance.Image = &tile.ProvenanceImage{
+			Name:   result.Image.Name,
+			Tag:    result.Image.Tag,
+			Digest: result.Image.Digest.String(),
+		}
+	}
+	return provenance, nil
+}
+
+// exportRelease copies the release tarball to the export dir along with its
+// checksums.
+func (a Application) exportRelease(tarballPath string, result ReleaseResult) error {
+	name := filepath.Base(tarballPath)
+
+	if _, err := copyFile(tarballPath, filepath.Join(a.ExportDir, name)); err != nil {
+		return fmt.Errorf("unable to export release: %s", err)
+	}
+
+	for ext, digest := range map[string]string{".sha1": result.SHA1, ".sha256": result.SHA256} {
+		checksum := fmt.Sprintf("%s  %s\n", digest, name)
+		if err := ioutil.WriteFile(filepath.Join(a.ExportDir, name+ext), []byte(checksum), 0644); err != nil {
+			return fmt.Errorf("unable to export release: %s", err)
+		}
+	}
+
+	fmt.Printf("Exported release to %s\n", filepath.Join(a.ExportDir, name))
+	return nil
+}
+
+// copyFile copies src to dst, creating the directory of dst, and writes the
+// contents to hashes on the way. It returns the number of bytes copied.
+func copyFile(src, dst string, hashes ...io.Writer) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(io.MultiWriter(append(hashes, out)...), in)
+	if err != nil {
+		return n, err
+	}
+
+	return n, out.Close()
+}
+
+// hashFile writes the contents of the file to hash.
+func hashFile(path string, hash io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(hash, f)
+	return err
+}
+
 func (a Application) extractReleaseVersion(releaseDir string) (string, error) {
 	rawReleaseVersion, err := readFile(filepath.Join(releaseDir, "VERSION"))
 	if err != nil {
@@ -1,14 +1,23 @@
 package winfsinjector_test
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pivotal-cf/winfs-injector/image"
+	"github.com/pivotal-cf/winfs-injector/tile"
 	"github.com/pivotal-cf/winfs-injector/winfsinjector"
 	"github.com/pivotal-cf/winfs-injector/winfsinjector/fakes"
 )
@@ -25,6 +34,10 @@ var _ = Describe("application", func() {
 			registry   string
 			workingDir string
 
+			validatedDir   string
+			producedBlobs  []string
+			sourceFindings []string
+
 			app winfsinjector.Application
 
 			err error
@@ -35,13 +48,15 @@ var _ = Describe("application", func() {
 			fakeInjector = new(fakes.Injector)
 			fakeZipper = new(fakes.Zipper)
 
-			inputTile = "/path/to/input/tile"
 			outputTile = "/path/to/output/tile"
 			registry = "/path/to/docker/registry"
 
 			workingDir, err = ioutil.TempDir("", "")
 			Expect(err).ToNot(HaveOccurred())
 
+			inputTile = filepath.Join(workingDir, "input.pivotal")
+			Expect(ioutil.WriteFile(inputTile, []byte("input-tile"), 0644)).To(Succeed())
+
 			embedFilePath := fmt.Sprintf("%s/extracted-tile/embed", workingDir)
 			err := os.MkdirAll(embedFilePath, os.ModePerm)
 			Expect(err).ToNot(HaveOccurred())
@@ -69,12 +84,19 @@ windows2019fs/windows2016fs-2019.0.43.tgz:
 			err = os.MkdirAll(embedFilePath+"/windowsfs-release", os.ModePerm)
 			Expect(err).ToNot(HaveOccurred())
 
+			validatedDir, producedBlobs, sourceFindings = "", nil, nil
+			winfsinjector.SetValidateSource(func(dir string, blobs ...string) []string {
+				validatedDir, producedBlobs = dir, blobs
+				return sourceFindings
+			})
+
 			app = winfsinjector.NewApplication(fakeReleaseCreator, fakeInjector, fakeZipper)
 		})
 
 		AfterEach(func() {
 			winfsinjector.ResetReadFile()
 			winfsinjector.ResetRemoveAll()
+			winfsinjector.ResetValidateSource()
 		})
 
 		It("unzips the tile", func() {
@@ -84,7 +106,7 @@ windows2019fs/windows2016fs-2019.0.43.tgz:
 			Expect(fakeZipper.UnzipCallCount()).To(Equal(1))
 
 			inputTile, extractedTileDir := fakeZipper.UnzipArgsForCall(0)
-			Expect(inputTile).To(Equal(filepath.Join("/", "path", "to", "input", "tile")))
+			Expect(inputTile).To(Equal(filepath.Join(workingDir, "input.pivotal")))
 			Expect(extractedTileDir).To(Equal(fmt.Sprintf("%s%s", workingDir, filepath.Join("/", "extracted-tile"))))
 		})
 
@@ -94,17 +116,49 @@ windows2019fs/windows2016fs-2019.0.43.tgz:
 
 			Expect(fakeReleaseCreator.CreateReleaseCallCount()).To(Equal(1))
 
-			releaseName, imageName, releaseDir, tarballPath, imageTag, registry, version := fakeReleaseCreator.CreateReleaseArgsForCall(0)
-			Expect(releaseName).To(Equal("windows2019fs"))
-			Expect(imageName).To(Equal("cloudfoundry/windows2016fs"))
-			Expect(releaseDir).To(Equal(fmt.Sprintf("%s/extracted-tile/embed/windowsfs-release", workingDir)))
-			Expect(tarballPath).To(Equal(fmt.Sprintf("%s/extracted-tile/releases/windows2019fs-9.3.6.tgz", workingDir)))
-			Expect(imageTag).To(Equal("2019.0.43"))
-			Expect(registry).To(Equal("/path/to/docker/registry"))
-			Expect(version).To(Equal("9.3.6"))
+			options := fakeReleaseCreator.CreateReleaseArgsForCall(0)
+			Expect(options.CheckImage).NotTo(BeNil())
+			options.CheckImage = nil
+			Expect(options).To(Equal(winfsinjector.CreateReleaseOptions{
+				ReleaseName: "windows2019fs",
+				ReleaseDir:  fmt.Sprintf("%s/extracted-tile/embed/windowsfs-release", workingDir),
+				Version:     "9.3.6",
+				TarballPath: fmt.Sprintf("%s/extracted-tile/releases/windows2019fs-9.3.6.tgz", workingDir),
+				ImageName:   "cloudfoundry/windows2016fs",
+				ImageTag:    "2019.0.43",
+				Registry:    "/path/to/docker/registry",
+			}))
+		})
+
+		It("validates the embedded release with the blob the image fetch produces", func() {
+			err := app.Run(inputTile, outputTile, registry, workingDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(validatedDir).To(Equal(fmt.Sprintf("%s/extracted-tile/embed/windowsfs-release", workingDir)))
+			Expect(producedBlobs).To(Equal([]string{"windows2019fs/windows2016fs-2019.0.43.tgz"}))
+		})
+
+		Context("when the embedded release has problems", func() {
+			BeforeEach(func() {
+				sourceFindings = []string{"VERSION is missing", "config/final.yml has no 'name'"}
+			})
+
+			It("returns them before creating the release", func() {
+				err := app.Run(inputTile, outputTile, registry, workingDir)
+				Expect(err).To(MatchError(fmt.Sprintf("release source %s/extracted-tile/embed/windowsfs-release is invalid:\n- VERSION is missing\n- config/final.yml has no 'name'", workingDir)))
+
+				Expect(fakeInjector.ReadMetadataCallCount()).To(Equal(0))
+				Expect(fakeReleaseCreator.CreateReleaseCallCount()).To(Equal(0))
+				Expect(fakeZipper.ZipCallCount()).To(Equal(0))
+			})
 		})
 
 		It("injects the build windows release into the extracted tile", func() {
+			fakeReleaseCreator.CreateReleaseReturns(winfsinjector.ReleaseResult{
+				TarballPath: fmt.Sprintf("%s/extracted-tile/releases/windows2019fs-9.3.6.tgz", workingDir),
+				SHA1:        "e2f5a2a5b3c6a9a3c0c1e9f9d7c8b1a4f3e2d1c0",
+			}, nil)
+
 			err := app.Run(inputTile, outputTile, registry, workingDir)
 			Expect(err).NotTo(HaveOccurred())
 
@@ -112,10 +166,51 @@ windows2019fs/windows2016fs-2019.0.43.tgz:
 			Expect(fakeZipper.UnzipCallCount()).To(Equal(1))
 
 			Expect(fakeInjector.AddReleaseToMetadataCallCount()).To(Equal(1))
-			releasePath, releaseName, releaseVersion, tileDir := fakeInjector.AddReleaseToMetadataArgsForCall(0)
-			Expect(releasePath).To(Equal(fmt.Sprintf("%s/extracted-tile/releases/windows2019fs-9.3.6.tgz", workingDir)))
-			Expect(releaseName).To(Equal("windows2019fs"))
-			Expect(releaseVersion).To(Equal("9.3.6"))
+			release, tileDir := fakeInjector.AddReleaseToMetadataArgsForCall(0)
+			Expect(release).To(Equal(tile.Release{
+				Name:    "windows2019fs",
+				File:    "windows2019fs-9.3.6.tgz",
+				Version: "9.3.6",
+				SHA1:    "e2f5a2a5b3c6a9a3c0c1e9f9d7c8b1a4f3e2d1c0",
+			}))
+			Expect(tileDir).To(Equal(filepath.Join(workingDir, "extracted-tile")))
+		})
+
+		It("records the provenance of the injection", func() {
+			fakeReleaseCreator.CreateReleaseReturns(winfsinjector.ReleaseResult{
+				SHA1:   "e2f5a2a5b3c6a9a3c0c1e9f9d7c8b1a4f3e2d1c0",
+				SHA256: "8d2c5b4f3e2d1c0e2f5a2a5b3c6a9a3c0c1e9f9d7c8b1a4f3e2d1c0e2f5a2a5b",
+				Image: image.Image{
+					Name:   "cloudfoundry/windows2016fs",
+					Tag:    "2019.0.43",
+					Digest: "sha256:4b2d5e6f",
+				},
+			}, nil)
+			app.InjectorVersion = "1.2.3"
+			app.InjectedAt = time.Date(2021, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+			err := app.Run(inputTile, outputTile, registry, workingDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeInjector.RecordProvenanceCallCount()).To(Equal(1))
+			provenance, tileDir := fakeInjector.RecordProvenanceArgsForCall(0)
+			Expect(provenance).To(Equal(tile.Provenance{
+				InjectorVersion: "1.2.3",
+				InjectedAt:      "2021-06-01T10:00:00Z",
+				InputTileSHA256: fmt.Sprintf("%x", sha256.Sum256([]byte("input-tile"))),
+				Image: &tile.ProvenanceImage{
+					Name:   "cloudfoundry/windows2016fs",
+					Tag:    "2019.0.43",
+					Digest: "sha256:4b2d5e6f",
+				},
+				Release: tile.ProvenanceRelease{
+					Name:    "windows2019fs",
+					Version: "9.3.6",
+					File:    "windows2019fs-9.3.6.tgz",
+					SHA1:    "e2f5a2a5b3c6a9a3c0c1e9f9d7c8b1a4f3e2d1c0",
+					SHA256:  "8d2c5b4f3e2d1c0e2f5a2a5b3c6a9a3c0c1e9f9d7c8b1a4f3e2d1c0e2f5a2a5b",
+				},
+			}))
 			Expect(tileDir).To(Equal(filepath.Join(workingDir, "extracted-tile")))
 		})
 
@@ -152,6 +247,151 @@ windows2019fs/windows2016fs-2019.0.43.tgz:
 			Expect(zipFile).To(Equal("/path/to/output/tile"))
 		})
 
+		Context("when a prebuilt release tarball is given", func() {
+			BeforeEach(func() {
+				app.ReleaseTarball = writeReleaseTarball(workingDir, "windows2019fs", "9.3.6")
+			})
+
+			It("copies it into the tile instead of creating the release", func() {
+				err := app.Run(inputTile, outputTile, registry, workingDir)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeReleaseCreator.CreateReleaseCallCount()).To(Equal(0))
+				Expect(validatedDir).To(BeEmpty())
+
+				tarballPath := filepath.Join(workingDir, "extracted-tile", "releases", "windows2019fs-9.3.6.tgz")
+				Expect(ioutil.ReadFile(tarballPath)).To(Equal(mustReadFile(app.ReleaseTarball)))
+
+				Expect(fakeInjector.AddReleaseToMetadataCallCount()).To(Equal(1))
+				release, _ := fakeInjector.AddReleaseToMetadataArgsForCall(0)
+				Expect(release).To(Equal(tile.Release{
+					Name:    "windows2019fs",
+					File:    "windows2019fs-9.3.6.tgz",
+					Version: "9.3.6",
+					SHA1:    fmt.Sprintf("%x", sha1.Sum(mustReadFile(app.ReleaseTarball))),
+				}))
+			})
+
+			Context("when the tile runs on stemcells of another Windows build than the image", func() {
+				BeforeEach(func() {
+					fakeInjector.ReadMetadataReturns(tile.Metadata{
+						StemcellCriteria: &tile.StemcellCriteria{OS: "windows2016", Version: "1200.14"},
+					}, nil)
+				})
+
+				It("returns an error without injecting it", func() {
+					err := app.Run(inputTile, outputTile, registry, workingDir)
+					Expect(err).To(MatchError("rootfs image cloudfoundry/windows2016fs:2019.0.43 is built for windows2019 (Windows build 10.0.17763), " +
+						"but the tile runs on stemcell windows2016 version 1200.14, which is windows2016 (Windows build 10.0.14393)"))
+
+					Expect(fakeInjector.AddReleaseToMetadataCallCount()).To(Equal(0))
+					Expect(fakeZipper.ZipCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when the embedded source does not name the rootfs image", func() {
+				BeforeEach(func() {
+					winfsinjector.SetReadFile(func(path string) ([]byte, error) {
+						switch filepath.Base(path) {
+						case "VERSION":
+							return []byte("9.3.6"), nil
+						case "blobs.yml":
+							return []byte("--- {}\n"), nil
+						case "final.yml":
+							return []byte(`name: windows2019fs`), nil
+						default:
+							return nil, errors.New("readFile called for unexpected input: " + path)
+						}
+					})
+					fakeInjector.ReadMetadataReturns(tile.Metadata{
+						StemcellCriteria: &tile.StemcellCriteria{OS: "windows2016", Version: "1200.14"},
+					}, nil)
+				})
+
+				It("skips the stemcell check and injects it", func() {
+					err := app.Run(inputTile, outputTile, registry, workingDir)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(fakeInjector.ReadMetadataCallCount()).To(Equal(0))
+					Expect(fakeZipper.ZipCallCount()).To(Equal(1))
+				})
+			})
+
+			Context("when the tarball is a different version of the release", func() {
+				BeforeEach(func() {
+					app.ReleaseTarball = writeReleaseTarball(workingDir, "windows2019fs", "9.3.5")
+				})
+
+				It("returns an error without injecting it", func() {
+					err := app.Run(inputTile, outputTile, registry, workingDir)
+					Expect(err).To(MatchError(fmt.Sprintf("release tarball %s contains release windows2019fs/9.3.5, but the tile embeds windows2019fs/9.3.6", app.ReleaseTarball)))
+
+					Expect(fakeInjector.AddReleaseToMetadataCallCount()).To(Equal(0))
+					Expect(fakeZipper.ZipCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when a package of the tarball does not match its digest", func() {
+				BeforeEach(func() {
+					digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("hwc-helper")))
+					app.ReleaseTarball = writeReleaseTarballWithPackage(workingDir, "windows2019fs", "9.3.6", digest, []byte("tampered"))
+				})
+
+				It("returns an error without injecting it", func() {
+					err := app.Run(inputTile, outputTile, registry, workingDir)
+					Expect(err).To(MatchError(ContainSubstring("release tarball failed verification: packages/hwc-helper.tgz does not match its digest")))
+
+					Expect(fakeInjector.AddReleaseToMetadataCallCount()).To(Equal(0))
+					Expect(fakeZipper.ZipCallCount()).To(Equal(0))
+				})
+			})
+
+			Context("when the packages of the tarball match their digests", func() {
+				BeforeEach(func() {
+					digest := fmt.Sprintf("%x", sha1.Sum([]byte("hwc-helper")))
+					app.ReleaseTarball = writeReleaseTarballWithPackage(workingDir, "windows2019fs", "9.3.6", digest, []byte("hwc-helper"))
+				})
+
+				It("injects it", func() {
+					err := app.Run(inputTile, outputTile, registry, workingDir)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeZipper.ZipCallCount()).To(Equal(1))
+				})
+			})
+		})
+
+		Context("when the release is exported", func() {
+			var exportDir string
+
+			BeforeEach(func() {
+				exportDir = filepath.Join(workingDir, "export")
+				app.ExportDir = exportDir
+
+				fakeReleaseCreator.CreateReleaseStub = func(options winfsinjector.CreateReleaseOptions) (winfsinjector.ReleaseResult, error) {
+					Expect(os.MkdirAll(filepath.Dir(options.TarballPath), 0755)).To(Succeed())
+					return winfsinjector.ReleaseResult{
+						TarballPath: options.TarballPath,
+						SHA1:        fmt.Sprintf("%x", sha1.Sum([]byte("release-tarball"))),
+						SHA256:      fmt.Sprintf("%x", sha256.Sum256([]byte("release-tarball"))),
+					}, ioutil.WriteFile(options.TarballPath, []byte("release-tarball"), 0644)
+				}
+			})
+
+			It("keeps a copy of the release tarball with checksum files", func() {
+				err := app.Run(inputTile, outputTile, registry, workingDir)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(ioutil.ReadFile(filepath.Join(exportDir, "windows2019fs-9.3.6.tgz"))).To(Equal([]byte("release-tarball")))
+				Expect(ioutil.ReadFile(filepath.Join(exportDir, "windows2019fs-9.3.6.tgz.sha1"))).To(Equal([]byte(
+					fmt.Sprintf("%x  windows2019fs-9.3.6.tgz\n", sha1.Sum([]byte("release-tarball"))))))
+				Expect(ioutil.ReadFile(filepath.Join(exportDir, "windows2019fs-9.3.6.tgz.sha256"))).To(Equal([]byte(
+					fmt.Sprintf("%x  windows2019fs-9.3.6.tgz\n", sha256.Sum256([]byte("release-tarball"))))))
+
+				Expect(filepath.Join(workingDir, "extracted-tile", "releases", "windows2019fs-9.3.6.tgz")).To(BeAnExistingFile())
+				Expect(fakeZipper.ZipCallCount()).To(Equal(1))
+			})
+		})
+
 		Context("when the image tag of release dir is malformed", func() {
 			BeforeEach(func() {
 				winfsinjector.SetReadFile(func(path string) ([]byte, error) {
@@ -204,6 +444,147 @@ windows2019fs/windows2016fs-MISSING-IMAGE-TAG.tgz:
 			})
 		})
 
+		It("applies the metadata ops files to the metadata with the release", func() {
+			fakeInjector.ApplyMetadataOpsFilesStub = func(string) error {
+				Expect(fakeInjector.AddReleaseToMetadataCallCount()).To(Equal(1))
+				Expect(fakeInjector.ValidateMetadataCallCount()).To(Equal(0))
+				return nil
+			}
+
+			err := app.Run(inputTile, outputTile, registry, workingDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeInjector.ApplyMetadataOpsFilesCallCount()).To(Equal(1))
+			Expect(fakeInjector.ApplyMetadataOpsFilesArgsForCall(0)).To(Equal(filepath.Join(workingDir, "extracted-tile")))
+		})
+
+		Context("when a metadata ops file fails", func() {
+			BeforeEach(func() {
+				fakeInjector.ApplyMetadataOpsFilesReturns(errors.New("some-error"))
+			})
+
+			It("returns the error without zipping the tile", func() {
+				err := app.Run(inputTile, outputTile, registry, workingDir)
+				Expect(err).To(MatchError("some-error"))
+				Expect(fakeZipper.ZipCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the injected metadata is invalid", func() {
+			BeforeEach(func() {
+				fakeInjector.ValidateMetadataReturns(errors.New("some-error"))
+			})
+
+			It("returns the error without zipping the tile", func() {
+				err := app.Run(inputTile, outputTile, registry, workingDir)
+				Expect(err).To(MatchError("some-error"))
+
+				Expect(fakeInjector.ValidateMetadataCallCount()).To(Equal(1))
+				Expect(fakeInjector.ValidateMetadataArgsForCall(0)).To(Equal(filepath.Join(workingDir, "extracted-tile")))
+				Expect(fakeZipper.ZipCallCount()).To(Equal(0))
+			})
+		})
+
+		Context("when the tile runs on stemcells of another Windows build than the image", func() {
+			BeforeEach(func() {
+				fakeInjector.ReadMetadataReturns(tile.Metadata{
+					StemcellCriteria: &tile.StemcellCriteria{OS: "windows2016", Version: "1200.14"},
+				}, nil)
+			})
+
+			It("fails before creating the release", func() {
+				err := app.Run(inputTile, outputTile, registry, workingDir)
+				Expect(err).To(MatchError("rootfs image cloudfoundry/windows2016fs:2019.0.43 is built for windows2019 (Windows build 10.0.17763), " +
+					"but the tile runs on stemcell windows2016 version 1200.14, which is windows2016 (Windows build 10.0.14393)"))
+
+				Expect(fakeInjector.ReadMetadataArgsForCall(0)).To(Equal(filepath.Join(workingDir, "extracted-tile")))
+				Expect(fakeReleaseCreator.CreateReleaseCallCount()).To(Equal(0))
+			})
+
+			Context("when mismatches are allowed", func() {
+				BeforeEach(func() {
+					app.AllowStemcellMismatch = true
+				})
+
+				It("creates the release", func() {
+					err := app.Run(inputTile, outputTile, registry, workingDir)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(fakeReleaseCreator.CreateReleaseCallCount()).To(Equal(1))
+					Expect(fakeZipper.ZipCallCount()).To(Equal(1))
+				})
+			})
+		})
+
+		Context("when the stemcell version names another Windows release than its os", func() {
+			BeforeEach(func() {
+				fakeInjector.ReadMetadataReturns(tile.Metadata{
+					StemcellCriteria: &tile.StemcellCriteria{OS: "windows2019", Version: "~> 2022.3"},
+				}, nil)
+			})
+
+			It("fails", func() {
+				err := app.Run(inputTile, outputTile, registry, workingDir)
+				Expect(err).To(BeAssignableToTypeOf(winfsinjector.StemcellMismatchError{}))
+				Expect(err.(winfsinjector.StemcellMismatchError).StemcellBuild).To(Equal("10.0.20348"))
+			})
+		})
+
+		DescribeTable("checks the image against the stemcell version",
+			func(version string, mismatch bool) {
+				fakeInjector.ReadMetadataReturns(tile.Metadata{
+					StemcellCriteria: &tile.StemcellCriteria{OS: "windows2019", Version: version},
+				}, nil)
+
+				err := app.Run(inputTile, outputTile, registry, workingDir)
+				if mismatch {
+					Expect(err).To(BeAssignableToTypeOf(winfsinjector.StemcellMismatchError{}))
+				} else {
+					Expect(err).NotTo(HaveOccurred())
+				}
+			},
+			Entry("an exact version", "2019.41", false),
+			Entry("a ~> constraint", "~> 2019.41", false),
+			Entry("a ~> constraint on the Windows release", "~>2019", false),
+			Entry("an exact version of another Windows release", "2022.3", true),
+			Entry("a ~> constraint on another Windows release", "~> 2022.3", true),
+		)
+
+		DescribeTable("refuses stemcell versions that are neither exact nor a ~> constraint",
+			func(version string) {
+				fakeInjector.ReadMetadataReturns(tile.Metadata{
+					StemcellCriteria: &tile.StemcellCriteria{OS: "windows2019", Version: version},
+				}, nil)
+
+				err := app.Run(inputTile, outputTile, registry, workingDir)
+				Expect(err).To(MatchError(fmt.Sprintf("stemcell version %q is not supported: expected an exact version such as 2019.41 or a constraint such as ~> 2019.41", version)))
+				Expect(fakeReleaseCreator.CreateReleaseCallCount()).To(Equal(0))
+			},
+			Entry("a lower bound", ">= 2019"),
+			Entry("an upper bound", "< 2022.3"),
+			Entry("a wildcard", "2019.x"),
+			Entry("several constraints", "~> 2019.41, < 2019.50"),
+		)
+
+		Context("when the image config names another Windows build than the image tag", func() {
+			BeforeEach(func() {
+				fakeInjector.ReadMetadataReturns(tile.Metadata{
+					StemcellCriteria: &tile.StemcellCriteria{OS: "windows2019", Version: "2019.41"},
+				}, nil)
+			})
+
+			It("checks the image against the stemcell once it is opened", func() {
+				err := app.Run(inputTile, outputTile, registry, workingDir)
+				Expect(err).NotTo(HaveOccurred())
+
+				checkImage := fakeReleaseCreator.CreateReleaseArgsForCall(0).CheckImage
+				Expect(checkImage(image.Image{Platform: v1.Platform{OSVersion: "10.0.17763.1879"}})).To(Succeed())
+				Expect(checkImage(image.Image{Platform: v1.Platform{OSVersion: "10.0.20348.587"}})).To(MatchError(
+					"rootfs image cloudfoundry/windows2016fs:2019.0.43 is built for windows2022 (Windows build 10.0.20348), " +
+						"but the tile runs on stemcell windows2019 version 2019.41, which is windows2019 (Windows build 10.0.17763)"))
+			})
+		})
+
 		Context("when there is multiple directories embedded in the tile", func() {
 			BeforeEach(func() {
 				embedFilePath := fmt.Sprintf("%s/extracted-tile/embed", workingDir)
@@ -217,14 +598,18 @@ windows2019fs/windows2016fs-MISSING-IMAGE-TAG.tgz:
 
 				Expect(fakeReleaseCreator.CreateReleaseCallCount()).To(Equal(1))
 
-				releaseName, imageName, releaseDir, tarballPath, imageTag, registry, version := fakeReleaseCreator.CreateReleaseArgsForCall(0)
-				Expect(releaseName).To(Equal("windows2019fs"))
-				Expect(imageName).To(Equal("cloudfoundry/windows2016fs"))
-				Expect(releaseDir).To(Equal(fmt.Sprintf("%s/extracted-tile/embed/windowsfs-release", workingDir)))
-				Expect(tarballPath).To(Equal(fmt.Sprintf("%s/extracted-tile/releases/windows2019fs-9.3.6.tgz", workingDir)))
-				Expect(imageTag).To(Equal("2019.0.43"))
-				Expect(registry).To(Equal("/path/to/docker/registry"))
-				Expect(version).To(Equal("9.3.6"))
+				options := fakeReleaseCreator.CreateReleaseArgsForCall(0)
+				Expect(options.CheckImage).NotTo(BeNil())
+				options.CheckImage = nil
+				Expect(options).To(Equal(winfsinjector.CreateReleaseOptions{
+					ReleaseName: "windows2019fs",
+					ReleaseDir:  fmt.Sprintf("%s/extracted-tile/embed/windowsfs-release", workingDir),
+					Version:     "9.3.6",
+					TarballPath: fmt.Sprintf("%s/extracted-tile/releases/windows2019fs-9.3.6.tgz", workingDir),
+					ImageName:   "cloudfoundry/windows2016fs",
+					ImageTag:    "2019.0.43",
+					Registry:    "/path/to/docker/registry",
+				}))
 			})
 		})
 
@@ -253,7 +638,7 @@ windows2019fs/windows2016fs-MISSING-IMAGE-TAG.tgz:
 
 		Context("when the release creator fails", func() {
 			BeforeEach(func() {
-				fakeReleaseCreator.CreateReleaseReturns(errors.New("some-error"))
+				fakeReleaseCreator.CreateReleaseReturns(winfsinjector.ReleaseResult{}, errors.New("some-error"))
 			})
 
 			It("returns the error", func() {
@@ -303,3 +688,44 @@ windows2019fs/windows2016fs-MISSING-IMAGE-TAG.tgz:
 		})
 	})
 })
+
+// writeReleaseTarball writes a release tarball holding only a release.MF, the
+// way the bosh cli lays it out.
+func writeReleaseTarball(dir, name, version string) string {
+	return writeReleaseTarballWithPackage(dir, name, version, "", nil)
+}
+
+// writeReleaseTarballWithPackage writes a release tarball that lists a
+// package with the given sha1 in its manifest, when contents is not nil.
+func writeReleaseTarballWithPackage(dir, name, version, sha1 string, contents []byte) string {
+	path := filepath.Join(dir, fmt.Sprintf("prebuilt-%s-%s.tgz", name, version))
+	f, err := os.Create(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+
+	manifest := fmt.Sprintf("name: %s\nversion: %s\n", name, version)
+	if contents != nil {
+		manifest += fmt.Sprintf("packages:\n- name: hwc-helper\n  sha1: %s\n", sha1)
+	}
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	if contents != nil {
+		Expect(tw.WriteHeader(&tar.Header{Name: "./packages/hwc-helper.tgz", Mode: 0644, Size: int64(len(contents))})).To(Succeed())
+		_, err = tw.Write(contents)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tw.WriteHeader(&tar.Header{Name: "./release.MF", Mode: 0644, Size: int64(len(manifest))})).To(Succeed())
+	_, err = tw.Write([]byte(manifest))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(tw.Close()).To(Succeed())
+	Expect(gw.Close()).To(Succeed())
+
+	return path
+}
+
+func mustReadFile(path string) []byte {
+	contents, err := ioutil.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+	return contents
+}
@@ -3,6 +3,8 @@ package winfsinjector
 import (
 	"io/ioutil"
 	"os"
+
+	"github.com/pivotal-cf/winfs-injector/release"
 )
 
 func SetReadFile(f func(string) ([]byte, error)) {
@@ -20,3 +22,11 @@ func SetRemoveAll(f func(string) error) {
 func ResetRemoveAll() {
 	removeAll = os.RemoveAll
 }
+
+func SetValidateSource(f func(string, ...string) []string) {
+	validateSource = f
+}
+
+func ResetValidateSource() {
+	validateSource = release.ValidateSource
+}
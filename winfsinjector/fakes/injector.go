@@ -3,16 +3,16 @@ package fakes
 
 import (
 	sync "sync"
+
+	tile "github.com/pivotal-cf/winfs-injector/tile"
 )
 
 type Injector struct {
-	AddReleaseToMetadataStub        func(string, string, string, string) error
+	AddReleaseToMetadataStub        func(tile.Release, string) error
 	addReleaseToMetadataMutex       sync.RWMutex
 	addReleaseToMetadataArgsForCall []struct {
-		arg1 string
+		arg1 tile.Release
 		arg2 string
-		arg3 string
-		arg4 string
 	}
 	addReleaseToMetadataReturns struct {
 		result1 error
@@ -20,23 +20,82 @@ type Injector struct {
 	addReleaseToMetadataReturnsOnCall map[int]struct {
 		result1 error
 	}
+	ApplyMetadataOpsFilesStub        func(string) error
+	applyMetadataOpsFilesMutex       sync.RWMutex
+	applyMetadataOpsFilesArgsForCall []struct {
+		arg1 string
+	}
+	applyMetadataOpsFilesReturns struct {
+		result1 error
+	}
+	applyMetadataOpsFilesReturnsOnCall map[int]struct {
+		result1 error
+	}
+	ReadMetadataStub        func(string) (tile.Metadata, error)
+	readMetadataMutex       sync.RWMutex
+	readMetadataArgsForCall []struct {
+		arg1 string
+	}
+	readMetadataReturns struct {
+		result1 tile.Metadata
+		result2 error
+	}
+	readMetadataReturnsOnCall map[int]struct {
+		result1 tile.Metadata
+		result2 error
+	}
+	RecordProvenanceStub        func(tile.Provenance, string) error
+	recordProvenanceMutex       sync.RWMutex
+	recordProvenanceArgsForCall []struct {
+		arg1 tile.Provenance
+		arg2 string
+	}
+	recordProvenanceReturns struct {
+		result1 error
+	}
+	recordProvenanceReturnsOnCall map[int]struct {
+		result1 error
+	}
+	RemoveReleaseFromMetadataStub        func(string, string) (tile.Release, error)
+	removeReleaseFromMetadataMutex       sync.RWMutex
+	removeReleaseFromMetadataArgsForCall []struct {
+		arg1 string
+		arg2 string
+	}
+	removeReleaseFromMetadataReturns struct {
+		result1 tile.Release
+		result2 error
+	}
+	removeReleaseFromMetadataReturnsOnCall map[int]struct {
+		result1 tile.Release
+		result2 error
+	}
+	ValidateMetadataStub        func(string) error
+	validateMetadataMutex       sync.RWMutex
+	validateMetadataArgsForCall []struct {
+		arg1 string
+	}
+	validateMetadataReturns struct {
+		result1 error
+	}
+	validateMetadataReturnsOnCall map[int]struct {
+		result1 error
+	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *Injector) AddReleaseToMetadata(arg1 string, arg2 string, arg3 string, arg4 string) error {
+func (fake *Injector) AddReleaseToMetadata(arg1 tile.Release, arg2 string) error {
 	fake.addReleaseToMetadataMutex.Lock()
 	ret, specificReturn := fake.addReleaseToMetadataReturnsOnCall[len(fake.addReleaseToMetadataArgsForCall)]
 	fake.addReleaseToMetadataArgsForCall = append(fake.addReleaseToMetadataArgsForCall, struct {
-		arg1 string
+		arg1 tile.Release
 		arg2 string
-		arg3 string
-		arg4 string
-	}{arg1, arg2, arg3, arg4})
-	fake.recordInvocation("AddReleaseToMetadata", []interface{}{arg1, arg2, arg3, arg4})
+	}{arg1, arg2})
+	fake.recordInvocation("AddReleaseToMetadata", []interface{}{arg1, arg2})
 	fake.addReleaseToMetadataMutex.Unlock()
 	if fake.AddReleaseToMetadataStub != nil {
-		return fake.AddReleaseToMetadataStub(arg1, arg2, arg3, arg4)
+		return fake.AddReleaseToMetadataStub(arg1, arg2)
 	}
 	if specificReturn {
 		return ret.result1
@@ -51,17 +110,17 @@ func (fake *Injector) AddReleaseToMetadataCallCount() int {
 	return len(fake.addReleaseToMetadataArgsForCall)
 }
 
-func (fake *Injector) AddReleaseToMetadataCalls(stub func(string, string, string, string) error) {
+func (fake *Injector) AddReleaseToMetadataCalls(stub func(tile.Release, string) error) {
 	fake.addReleaseToMetadataMutex.Lock()
 	defer fake.addReleaseToMetadataMutex.Unlock()
 	fake.AddReleaseToMetadataStub = stub
 }
 
-func (fake *Injector) AddReleaseToMetadataArgsForCall(i int) (string, string, string, string) {
+func (fake *Injector) AddReleaseToMetadataArgsForCall(i int) (tile.Release, string) {
 	fake.addReleaseToMetadataMutex.RLock()
 	defer fake.addReleaseToMetadataMutex.RUnlock()
 	argsForCall := fake.addReleaseToMetadataArgsForCall[i]
-	return argsForCall.arg1, argsForCall.arg2, argsForCall.arg3, argsForCall.arg4
+	return argsForCall.arg1, argsForCall.arg2
 }
 
 func (fake *Injector) AddReleaseToMetadataReturns(result1 error) {
@@ -87,11 +146,329 @@ func (fake *Injector) AddReleaseToMetadataReturnsOnCall(i int, result1 error) {
 	}{result1}
 }
 
+func (fake *Injector) ApplyMetadataOpsFiles(arg1 string) error {
+	fake.applyMetadataOpsFilesMutex.Lock()
+	ret, specificReturn := fake.applyMetadataOpsFilesReturnsOnCall[len(fake.applyMetadataOpsFilesArgsForCall)]
+	fake.applyMetadataOpsFilesArgsForCall = append(fake.applyMetadataOpsFilesArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("ApplyMetadataOpsFiles", []interface{}{arg1})
+	fake.applyMetadataOpsFilesMutex.Unlock()
+	if fake.ApplyMetadataOpsFilesStub != nil {
+		return fake.ApplyMetadataOpsFilesStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.applyMetadataOpsFilesReturns
+	return fakeReturns.result1
+}
+
+func (fake *Injector) ApplyMetadataOpsFilesCallCount() int {
+	fake.applyMetadataOpsFilesMutex.RLock()
+	defer fake.applyMetadataOpsFilesMutex.RUnlock()
+	return len(fake.applyMetadataOpsFilesArgsForCall)
+}
+
+func (fake *Injector) ApplyMetadataOpsFilesCalls(stub func(string) error) {
+	fake.applyMetadataOpsFilesMutex.Lock()
+	defer fake.applyMetadataOpsFilesMutex.Unlock()
+	fake.ApplyMetadataOpsFilesStub = stub
+}
+
+func (fake *Injector) ApplyMetadataOpsFilesArgsForCall(i int) string {
+	fake.applyMetadataOpsFilesMutex.RLock()
+	defer fake.applyMetadataOpsFilesMutex.RUnlock()
+	argsForCall := fake.applyMetadataOpsFilesArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *Injector) ApplyMetadataOpsFilesReturns(result1 error) {
+	fake.applyMetadataOpsFilesMutex.Lock()
+	defer fake.applyMetadataOpsFilesMutex.Unlock()
+	fake.ApplyMetadataOpsFilesStub = nil
+	fake.applyMetadataOpsFilesReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *Injector) ApplyMetadataOpsFilesReturnsOnCall(i int, result1 error) {
+	fake.applyMetadataOpsFilesMutex.Lock()
+	defer fake.applyMetadataOpsFilesMutex.Unlock()
+	fake.ApplyMetadataOpsFilesStub = nil
+	if fake.applyMetadataOpsFilesReturnsOnCall == nil {
+		fake.applyMetadataOpsFilesReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.applyMetadataOpsFilesReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *Injector) ReadMetadata(arg1 string) (tile.Metadata, error) {
+	fake.readMetadataMutex.Lock()
+	ret, specificReturn := fake.readMetadataReturnsOnCall[len(fake.readMetadataArgsForCall)]
+	fake.readMetadataArgsForCall = append(fake.readMetadataArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("ReadMetadata", []interface{}{arg1})
+	fake.readMetadataMutex.Unlock()
+	if fake.ReadMetadataStub != nil {
+		return fake.ReadMetadataStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	fakeReturns := fake.readMetadataReturns
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *Injector) ReadMetadataCallCount() int {
+	fake.readMetadataMutex.RLock()
+	defer fake.readMetadataMutex.RUnlock()
+	return len(fake.readMetadataArgsForCall)
+}
+
+func (fake *Injector) ReadMetadataCalls(stub func(string) (tile.Metadata, error)) {
+	fake.readMetadataMutex.Lock()
+	defer fake.readMetadataMutex.Unlock()
+	fake.ReadMetadataStub = stub
+}
+
+func (fake *Injector) ReadMetadataArgsForCall(i int) string {
+	fake.readMetadataMutex.RLock()
+	defer fake.readMetadataMutex.RUnlock()
+	argsForCall := fake.readMetadataArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *Injector) ReadMetadataReturns(result1 tile.Metadata, result2 error) {
+	fake.readMetadataMutex.Lock()
+	defer fake.readMetadataMutex.Unlock()
+	fake.ReadMetadataStub = nil
+	fake.readMetadataReturns = struct {
+		result1 tile.Metadata
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *Injector) ReadMetadataReturnsOnCall(i int, result1 tile.Metadata, result2 error) {
+	fake.readMetadataMutex.Lock()
+	defer fake.readMetadataMutex.Unlock()
+	fake.ReadMetadataStub = nil
+	if fake.readMetadataReturnsOnCall == nil {
+		fake.readMetadataReturnsOnCall = make(map[int]struct {
+			result1 tile.Metadata
+			result2 error
+		})
+	}
+	fake.readMetadataReturnsOnCall[i] = struct {
+		result1 tile.Metadata
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *Injector) RecordProvenance(arg1 tile.Provenance, arg2 string) error {
+	fake.recordProvenanceMutex.Lock()
+	ret, specificReturn := fake.recordProvenanceReturnsOnCall[len(fake.recordProvenanceArgsForCall)]
+	fake.recordProvenanceArgsForCall = append(fake.recordProvenanceArgsForCall, struct {
+		arg1 tile.Provenance
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("RecordProvenance", []interface{}{arg1, arg2})
+	fake.recordProvenanceMutex.Unlock()
+	if fake.RecordProvenanceStub != nil {
+		return fake.RecordProvenanceStub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.recordProvenanceReturns
+	return fakeReturns.result1
+}
+
+func (fake *Injector) RecordProvenanceCallCount() int {
+	fake.recordProvenanceMutex.RLock()
+	defer fake.recordProvenanceMutex.RUnlock()
+	return len(fake.recordProvenanceArgsForCall)
+}
+
+func (fake *Injector) RecordProvenanceCalls(stub func(tile.Provenance, string) error) {
+	fake.recordProvenanceMutex.Lock()
+	defer fake.recordProvenanceMutex.Unlock()
+	fake.RecordProvenanceStub = stub
+}
+
+func (fake *Injector) RecordProvenanceArgsForCall(i int) (tile.Provenance, string) {
+	fake.recordProvenanceMutex.RLock()
+	defer fake.recordProvenanceMutex.RUnlock()
+	argsForCall := fake.recordProvenanceArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *Injector) RecordProvenanceReturns(result1 error) {
+	fake.recordProvenanceMutex.Lock()
+	defer fake.recordProvenanceMutex.Unlock()
+	fake.RecordProvenanceStub = nil
+	fake.recordProvenanceReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *Injector) RecordProvenanceReturnsOnCall(i int, result1 error) {
+	fake.recordProvenanceMutex.Lock()
+	defer fake.recordProvenanceMutex.Unlock()
+	fake.RecordProvenanceStub = nil
+	if fake.recordProvenanceReturnsOnCall == nil {
+		fake.recordProvenanceReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.recordProvenanceReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *Injector) RemoveReleaseFromMetadata(arg1 string, arg2 string) (tile.Release, error) {
+	fake.removeReleaseFromMetadataMutex.Lock()
+	ret, specificReturn := fake.removeReleaseFromMetadataReturnsOnCall[len(fake.removeReleaseFromMetadataArgsForCall)]
+	fake.removeReleaseFromMetadataArgsForCall = append(fake.removeReleaseFromMetadataArgsForCall, struct {
+		arg1 string
+		arg2 string
+	}{arg1, arg2})
+	fake.recordInvocation("RemoveReleaseFromMetadata", []interface{}{arg1, arg2})
+	fake.removeReleaseFromMetadataMutex.Unlock()
+	if fake.RemoveReleaseFromMetadataStub != nil {
+		return fake.RemoveReleaseFromMetadataStub(arg1, arg2)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	fakeReturns := fake.removeReleaseFromMetadataReturns
+	return fakeReturns.result1, fakeReturns.result2
+}
+
+func (fake *Injector) RemoveReleaseFromMetadataCallCount() int {
+	fake.removeReleaseFromMetadataMutex.RLock()
+	defer fake.removeReleaseFromMetadataMutex.RUnlock()
+	return len(fake.removeReleaseFromMetadataArgsForCall)
+}
+
+func (fake *Injector) RemoveReleaseFromMetadataCalls(stub func(string, string) (tile.Release, error)) {
+	fake.removeReleaseFromMetadataMutex.Lock()
+	defer fake.removeReleaseFromMetadataMutex.Unlock()
+	fake.RemoveReleaseFromMetadataStub = stub
+}
+
+func (fake *Injector) RemoveReleaseFromMetadataArgsForCall(i int) (string, string) {
+	fake.removeReleaseFromMetadataMutex.RLock()
+	defer fake.removeReleaseFromMetadataMutex.RUnlock()
+	argsForCall := fake.removeReleaseFromMetadataArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
+func (fake *Injector) RemoveReleaseFromMetadataReturns(result1 tile.Release, result2 error) {
+	fake.removeReleaseFromMetadataMutex.Lock()
+	defer fake.removeReleaseFromMetadataMutex.Unlock()
+	fake.RemoveReleaseFromMetadataStub = nil
+	fake.removeReleaseFromMetadataReturns = struct {
+		result1 tile.Release
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *Injector) RemoveReleaseFromMetadataReturnsOnCall(i int, result1 tile.Release, result2 error) {
+	fake.removeReleaseFromMetadataMutex.Lock()
+	defer fake.removeReleaseFromMetadataMutex.Unlock()
+	fake.RemoveReleaseFromMetadataStub = nil
+	if fake.removeReleaseFromMetadataReturnsOnCall == nil {
+		fake.removeReleaseFromMetadataReturnsOnCall = make(map[int]struct {
+			result1 tile.Release
+			result2 error
+		})
+	}
+	fake.removeReleaseFromMetadataReturnsOnCall[i] = struct {
+		result1 tile.Release
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *Injector) ValidateMetadata(arg1 string) error {
+	fake.validateMetadataMutex.Lock()
+	ret, specificReturn := fake.validateMetadataReturnsOnCall[len(fake.validateMetadataArgsForCall)]
+	fake.validateMetadataArgsForCall = append(fake.validateMetadataArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("ValidateMetadata", []interface{}{arg1})
+	fake.validateMetadataMutex.Unlock()
+	if fake.ValidateMetadataStub != nil {
+		return fake.ValidateMetadataStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	fakeReturns := fake.validateMetadataReturns
+	return fakeReturns.result1
+}
+
+func (fake *Injector) ValidateMetadataCallCount() int {
+	fake.validateMetadataMutex.RLock()
+	defer fake.validateMetadataMutex.RUnlock()
+	return len(fake.validateMetadataArgsForCall)
+}
+
+func (fake *Injector) ValidateMetadataCalls(stub func(string) error) {
+	fake.validateMetadataMutex.Lock()
+	defer fake.validateMetadataMutex.Unlock()
+	fake.ValidateMetadataStub = stub
+}
+
+func (fake *Injector) ValidateMetadataArgsForCall(i int) string {
+	fake.validateMetadataMutex.RLock()
+	defer fake.validateMetadataMutex.RUnlock()
+	argsForCall := fake.validateMetadataArgsForCall[i]
+	return argsForCall.arg1
+}
+
+func (fake *Injector) ValidateMetadataReturns(result1 error) {
+	fake.validateMetadataMutex.Lock()
+	defer fake.validateMetadataMutex.Unlock()
+	fake.ValidateMetadataStub = nil
+	fake.validateMetadataReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *Injector) ValidateMetadataReturnsOnCall(i int, result1 error) {
+	fake.validateMetadataMutex.Lock()
+	defer fake.validateMetadataMutex.Unlock()
+	fake.ValidateMetadataStub = nil
+	if fake.validateMetadataReturnsOnCall == nil {
+		fake.validateMetadataReturnsOnCall = make(map[int]struct {
+			result1 error
+		})
+	}
+	fake.validateMetadataReturnsOnCall[i] = struct {
+		result1 error
+	}{result1}
+}
+
 func (fake *Injector) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
 	fake.addReleaseToMetadataMutex.RLock()
 	defer fake.addReleaseToMetadataMutex.RUnlock()
+	fake.applyMetadataOpsFilesMutex.RLock()
+	defer fake.applyMetadataOpsFilesMutex.RUnlock()
+	fake.readMetadataMutex.RLock()
+	defer fake.readMetadataMutex.RUnlock()
+	fake.recordProvenanceMutex.RLock()
+	defer fake.recordProvenanceMutex.RUnlock()
+	fake.removeReleaseFromMetadataMutex.RLock()
+	defer fake.removeReleaseFromMetadataMutex.RUnlock()
+	fake.validateMetadataMutex.RLock()
+	defer fake.validateMetadataMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
 	for key, value := range fake.invocations {
 		copiedInvocations[key] = value
@@ -2,52 +2,45 @@
 package fakes
 
 import (
-	"sync"
+	sync "sync"
+
+	winfsinjector "github.com/pivotal-cf/winfs-injector/winfsinjector"
 )
 
 type ReleaseCreator struct {
-	CreateReleaseStub        func(releaseName, imageName, releaseDir, tarballPath, imageTag, registry, version string) error
+	CreateReleaseStub        func(winfsinjector.CreateReleaseOptions) (winfsinjector.ReleaseResult, error)
 	createReleaseMutex       sync.RWMutex
 	createReleaseArgsForCall []struct {
-		releaseName string
-		imageName   string
-		releaseDir  string
-		tarballPath string
-		imageTag    string
-		registry    string
-		version     string
+		arg1 winfsinjector.CreateReleaseOptions
 	}
 	createReleaseReturns struct {
-		result1 error
+		result1 winfsinjector.ReleaseResult
+		result2 error
 	}
 	createReleaseReturnsOnCall map[int]struct {
-		result1 error
+		result1 winfsinjector.ReleaseResult
+		result2 error
 	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *ReleaseCreator) CreateRelease(releaseName string, imageName string, releaseDir string, tarballPath string, imageTag string, registry string, version string) error {
+func (fake *ReleaseCreator) CreateRelease(arg1 winfsinjector.CreateReleaseOptions) (winfsinjector.ReleaseResult, error) {
 	fake.createReleaseMutex.Lock()
 	ret, specificReturn := fake.createReleaseReturnsOnCall[len(fake.createReleaseArgsForCall)]
 	fake.createReleaseArgsForCall = append(fake.createReleaseArgsForCall, struct {
-		releaseName string
-		imageName   string
-		releaseDir  string
-		tarballPath string
-		imageTag    string
-		registry    string
-		version     string
-	}{releaseName, imageName, releaseDir, tarballPath, imageTag, registry, version})
-	fake.recordInvocation("CreateRelease", []interface{}{releaseName, imageName, releaseDir, tarballPath, imageTag, registry, version})
+		arg1 winfsinjector.CreateReleaseOptions
+	}{arg1})
+	fake.recordInvocation("CreateRelease", []interface{}{arg1})
 	fake.createReleaseMutex.Unlock()
 	if fake.CreateReleaseStub != nil {
-		return fake.CreateReleaseStub(releaseName, imageName, releaseDir, tarballPath, imageTag, registry, version)
+		return fake.CreateReleaseStub(arg1)
 	}
 	if specificReturn {
-		return ret.result1
+		return ret.result1, ret.result2
 	}
-	return fake.createReleaseReturns.result1
+	fakeReturns := fake.createReleaseReturns
+	return fakeReturns.result1, fakeReturns.result2
 }
 
 func (fake *ReleaseCreator) CreateReleaseCallCount() int {
@@ -56,29 +49,43 @@ func (fake *ReleaseCreator) CreateReleaseCallCount() int {
 	return len(fake.createReleaseArgsForCall)
 }
 
-func (fake *ReleaseCreator) CreateReleaseArgsForCall(i int) (string, string, string, string, string, string, string) {
+func (fake *ReleaseCreator) CreateReleaseCalls(stub func(winfsinjector.CreateReleaseOptions) (winfsinjector.ReleaseResult, error)) {
+	fake.createReleaseMutex.Lock()
+	defer fake.createReleaseMutex.Unlock()
+	fake.CreateReleaseStub = stub
+}
+
+func (fake *ReleaseCreator) CreateReleaseArgsForCall(i int) winfsinjector.CreateReleaseOptions {
 	fake.createReleaseMutex.RLock()
 	defer fake.createReleaseMutex.RUnlock()
-	return fake.createReleaseArgsForCall[i].releaseName, fake.createReleaseArgsForCall[i].imageName, fake.createReleaseArgsForCall[i].releaseDir, fake.createReleaseArgsForCall[i].tarballPath, fake.createReleaseArgsForCall[i].imageTag, fake.createReleaseArgsForCall[i].registry, fake.createReleaseArgsForCall[i].version
+	argsForCall := fake.createReleaseArgsForCall[i]
+	return argsForCall.arg1
 }
 
-func (fake *ReleaseCreator) CreateReleaseReturns(result1 error) {
+func (fake *ReleaseCreator) CreateReleaseReturns(result1 winfsinjector.ReleaseResult, result2 error) {
+	fake.createReleaseMutex.Lock()
+	defer fake.createReleaseMutex.Unlock()
 	fake.CreateReleaseStub = nil
 	fake.createReleaseReturns = struct {
-		result1 error
-	}{result1}
+		result1 winfsinjector.ReleaseResult
+		result2 error
+	}{result1, result2}
 }
 
-func (fake *ReleaseCreator) CreateReleaseReturnsOnCall(i int, result1 error) {
+func (fake *ReleaseCreator) CreateReleaseReturnsOnCall(i int, result1 winfsinjector.ReleaseResult, result2 error) {
+	fake.createReleaseMutex.Lock()
+	defer fake.createReleaseMutex.Unlock()
 	fake.CreateReleaseStub = nil
 	if fake.createReleaseReturnsOnCall == nil {
 		fake.createReleaseReturnsOnCall = make(map[int]struct {
-			result1 error
+			result1 winfsinjector.ReleaseResult
+			result2 error
 		})
 	}
 	fake.createReleaseReturnsOnCall[i] = struct {
-		result1 error
-	}{result1}
+		result1 winfsinjector.ReleaseResult
+		result2 error
+	}{result1, result2}
 }
 
 func (fake *ReleaseCreator) Invocations() map[string][][]interface{} {
@@ -1,65 +1,129 @@
 package winfsinjector
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
+	"path"
 
-	"code.cloudfoundry.org/hydrator/imagefetcher"
-	"github.com/cloudfoundry/bosh-cli/cmd"
-	"github.com/cloudfoundry/bosh-cli/cmd/opts"
-	"github.com/cloudfoundry/bosh-cli/ui"
-	"github.com/cloudfoundry/bosh-utils/logger"
+	"github.com/pivotal-cf/winfs-injector/image"
+	"github.com/pivotal-cf/winfs-injector/release"
 )
 
-type ReleaseCreator struct{}
+// ReleaseCreator streams the rootfs image into the embedded release while it
+// builds the release tarball. It keeps no state between calls and does not touch the
+// process environment, so several releases can be created at the same time.
+type ReleaseCreator struct {
+	Image   image.Config
+	Release release.Config
 
-func (rc ReleaseCreator) CreateRelease(releaseName, imageName, releaseDir, tarballPath, imageTag, registry, version string) error {
-	hLogger := log.New(os.Stdout, "", 0)
-	releaseBlob := filepath.Join(releaseDir, "blobs", releaseName)
+	// ScratchDir holds the intermediate files of a release creation, each in
+	// its own subdirectory. It defaults to the system temp dir.
+	ScratchDir string
+}
+
+// CreateReleaseOptions describe the release to create and the image that is
+// embedded in it.
+type CreateReleaseOptions struct {
+	ReleaseName string
+	ReleaseDir  string
+	Version     string
+	// TarballPath is where the release tarball is written.
+	TarballPath string
+
+	ImageName string
+	ImageTag  string
+	Registry  string
+	// CheckImage is called with the image once its manifest and config are
+	// fetched, before any layer is, and stops the creation when it fails.
+	CheckImage func(image.Image) error
+}
+
+// ReleaseResult describes a release tarball that is ready to be injected.
+// SHA1 and SHA256 are the hex digests of the tarball.
+type ReleaseResult struct {
+	TarballPath string
+	Size        int64
+	SHA1        string
+	SHA256      string
+
+	CommitHash string
+	Jobs       []release.JobRef
+	Packages   []release.PackageRef
+
+	// Image is the rootfs image the release was built from. It is empty for
+	// prebuilt releases.
+	Image image.Image
+}
 
-	h := imagefetcher.New(hLogger, releaseBlob, imageName, imageTag, registry, false)
-	if err := h.Run(); err != nil {
-		return err
+func newReleaseResult(tarball release.Tarball) ReleaseResult {
+	return ReleaseResult{
+		TarballPath: tarball.Path,
+		Size:        tarball.Size,
+		SHA1:        tarball.SHA1,
+		SHA256:      tarball.SHA256,
+		CommitHash:  tarball.Manifest.CommitHash,
+		Jobs:        tarball.Manifest.Jobs,
+		Packages:    tarball.Manifest.Packages,
 	}
+}
+
+func (rc ReleaseCreator) CreateRelease(options CreateReleaseOptions) (ReleaseResult, error) {
+	hLogger := log.New(os.Stdout, "", 0)
 
-	releaseVersion := opts.VersionArg{}
-	if err := releaseVersion.UnmarshalFlag(version); err != nil {
-		return err
+	scratchDir, err := ioutil.TempDir(rc.ScratchDir, "winfs-create-release")
+	if err != nil {
+		return ReleaseResult{}, err
 	}
+	defer os.RemoveAll(scratchDir)
 
-	l := logger.NewLogger(logger.LevelInfo)
-	u := ui.NewConfUI(l)
-	defer u.Flush()
-	deps := cmd.NewBasicDeps(u, l)
+	imageConfig := rc.Image
+	imageConfig.ScratchDir = scratchDir
 
-	createReleaseOpts := &opts.CreateReleaseOpts{
-		Directory: opts.DirOrCWDArg{Path: releaseDir},
-		Version:   releaseVersion,
+	fetcher := image.NewFetcher(hLogger, imageConfig)
+	layout, err := fetcher.Open(options.ImageName, options.ImageTag, options.Registry)
+	if err != nil {
+		return ReleaseResult{}, err
 	}
 
-	if tarballPath != "" {
-		expanded, err := filepath.Abs(tarballPath)
-		if err != nil {
-			return err
+	if options.CheckImage != nil {
+		if err := options.CheckImage(layout.Image()); err != nil {
+			return ReleaseResult{}, err
 		}
+	}
 
-		createReleaseOpts.Tarball = opts.FileArg{FS: deps.FS, ExpandedPath: expanded}
+	// The image is written straight into the package that includes it, so
+	// neither the image nor the package archive land on disk.
+	blob := release.Blob{
+		Name: path.Join(options.ReleaseName, layout.FileName()),
+		Size: layout.Size(),
+		Write: func(w io.Writer) error {
+			_, err := layout.WriteTo(w)
+			return err
+		},
 	}
 
-	// bosh create-release adds ~7GB of temp files that should be cleaned up
-	tmpDir, err := ioutil.TempDir("", "winfs-create-release")
+	builder := release.NewBuilder(hLogger, rc.Release)
+	tarball, err := builder.Build(options.ReleaseDir, options.Version, options.TarballPath, blob)
 	if err != nil {
-		return err
+		return ReleaseResult{}, err
 	}
-	defer os.RemoveAll(tmpDir)
-	os.Setenv("HOME", tmpDir)
 
-	createReleaseCommand := cmd.NewCmd(opts.BoshOpts{}, createReleaseOpts, deps)
-	if err := createReleaseCommand.Execute(); err != nil {
-		return err
+	// The tarball is read back before it goes into the tile, so that a
+	// corrupted job, package or layer fails the injection.
+	_, err = release.Verify(tarball.Path, release.Expectations{
+		Name:    options.ReleaseName,
+		Version: options.Version,
+		Blobs:   map[string]func(io.Reader) error{blob.Name: layout.Verify},
+	})
+	if err != nil {
+		return ReleaseResult{}, fmt.Errorf("release tarball failed verification: %s", err)
 	}
+	hLogger.Printf("Verified release tarball %s\n", tarball.Path)
 
-	return nil
+	result := newReleaseResult(tarball)
+	result.Image = layout.Image()
+	return result, nil
 }
@@ -0,0 +1,160 @@
+package winfsinjector_test
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pivotal-cf/winfs-injector/image"
+	"github.com/pivotal-cf/winfs-injector/internal/testhelpers"
+	"github.com/pivotal-cf/winfs-injector/winfsinjector"
+)
+
+var _ = Describe("ReleaseCreator", func() {
+	Describe("CreateRelease", func() {
+		var (
+			registry *testhelpers.Registry
+			tmpDir   string
+			home     string
+
+			releaseCreator winfsinjector.ReleaseCreator
+		)
+
+		BeforeEach(func() {
+			registry = testhelpers.NewRegistry("cloudfoundry/windows2016fs")
+			registry.AddImage("2019.0.43", []byte("rootfs-layer"))
+
+			var err error
+			tmpDir, err = ioutil.TempDir("", "")
+			Expect(err).NotTo(HaveOccurred())
+
+			home = os.Getenv("HOME")
+
+			releaseCreator = winfsinjector.ReleaseCreator{
+				Image:      image.Config{CacheDir: filepath.Join(tmpDir, "cache")},
+				ScratchDir: tmpDir,
+			}
+		})
+
+		AfterEach(func() {
+			registry.Close()
+			Expect(os.RemoveAll(tmpDir)).To(Succeed())
+		})
+
+		It("streams the image into the rootfs package", func() {
+			releaseDir := filepath.Join(tmpDir, "release")
+			Expect(testhelpers.CopyDir("../release/fixtures/windowsfs-release", releaseDir)).To(Succeed())
+
+			tarballPath := filepath.Join(tmpDir, "releases", "windows2019fs-9.3.6.tgz")
+			result, err := releaseCreator.CreateRelease(winfsinjector.CreateReleaseOptions{
+				ReleaseName: "windows2019fs",
+				ReleaseDir:  releaseDir,
+				Version:     "9.3.6",
+				TarballPath: tarballPath,
+				ImageName:   "cloudfoundry/windows2016fs",
+				ImageTag:    "2019.0.43",
+				Registry:    registry.URL(),
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			tarball, err := ioutil.ReadFile(tarballPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(result.TarballPath).To(Equal(tarballPath))
+			Expect(result.Size).To(Equal(int64(len(tarball))))
+			Expect(result.SHA1).To(Equal(fmt.Sprintf("%x", sha1.Sum(tarball))))
+			Expect(result.SHA256).To(Equal(fmt.Sprintf("%x", sha256.Sum256(tarball))))
+			Expect(result.CommitHash).To(Equal("non-git"))
+			Expect(result.Jobs).To(HaveLen(1))
+			Expect(result.Packages).To(HaveLen(2))
+			Expect(result.Image.Tag).To(Equal("2019.0.43"))
+			Expect(result.Image.Digest).NotTo(BeEmpty())
+
+			pkg := testhelpers.ReadTgz(testhelpers.ReadTgz(tarball)["packages/windows2019fs.tgz"])
+			image := testhelpers.ReadTgz(pkg["./windows2019fs/windows2016fs-2019.0.43.tgz"])
+			Expect(image).To(HaveKeyWithValue("blobs/sha256/"+digest.FromBytes([]byte("rootfs-layer")).Encoded(), []byte("rootfs-layer")))
+			Expect(image).To(HaveKey("index.json"))
+
+			blobs, err := ioutil.ReadDir(filepath.Join(releaseDir, "blobs", "windows2019fs"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(blobs).To(HaveLen(1))
+		})
+
+		It("checks the image before building the release", func() {
+			releaseDir := filepath.Join(tmpDir, "release")
+			Expect(testhelpers.CopyDir("../release/fixtures/windowsfs-release", releaseDir)).To(Succeed())
+
+			var checked image.Image
+			tarballPath := filepath.Join(tmpDir, "releases", "windows2019fs-9.3.6.tgz")
+			_, err := releaseCreator.CreateRelease(winfsinjector.CreateReleaseOptions{
+				ReleaseName: "windows2019fs",
+				ReleaseDir:  releaseDir,
+				Version:     "9.3.6",
+				TarballPath: tarballPath,
+				ImageName:   "cloudfoundry/windows2016fs",
+				ImageTag:    "2019.0.43",
+				Registry:    registry.URL(),
+				CheckImage: func(img image.Image) error {
+					checked = img
+					return errors.New("wrong image")
+				},
+			})
+			Expect(err).To(MatchError("wrong image"))
+
+			Expect(checked.Tag).To(Equal("2019.0.43"))
+			Expect(tarballPath).NotTo(BeAnExistingFile())
+		})
+
+		It("creates several releases at the same time without changing the environment", func() {
+			const releases = 4
+
+			var (
+				wg   sync.WaitGroup
+				errs = make([]error, releases)
+			)
+
+			for i := 0; i < releases; i++ {
+				releaseDir := filepath.Join(tmpDir, fmt.Sprintf("release-%d", i))
+				Expect(testhelpers.CopyDir("../release/fixtures/windowsfs-release", releaseDir)).To(Succeed())
+
+				wg.Add(1)
+				go func(i int, releaseDir string) {
+					defer GinkgoRecover()
+					defer wg.Done()
+
+					tarballPath := filepath.Join(tmpDir, "releases", fmt.Sprintf("windows2019fs-9.3.%d.tgz", i))
+					_, errs[i] = releaseCreator.CreateRelease(winfsinjector.CreateReleaseOptions{
+						ReleaseName: "windows2019fs",
+						ReleaseDir:  releaseDir,
+						Version:     fmt.Sprintf("9.3.%d", i),
+						TarballPath: tarballPath,
+						ImageName:   "cloudfoundry/windows2016fs",
+						ImageTag:    "2019.0.43",
+						Registry:    registry.URL(),
+					})
+				}(i, releaseDir)
+			}
+
+			wg.Wait()
+
+			for i, err := range errs {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(tmpDir, "releases", fmt.Sprintf("windows2019fs-9.3.%d.tgz", i))).To(BeAnExistingFile())
+			}
+
+			Expect(os.Getenv("HOME")).To(Equal(home))
+
+			scratch, err := filepath.Glob(filepath.Join(tmpDir, "winfs-create-release*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(scratch).To(BeEmpty())
+		})
+	})
+})
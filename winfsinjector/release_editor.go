@@ -0,0 +1,146 @@
+package winfsinjector
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/pivotal-cf/winfs-injector/release"
+	"github.com/pivotal-cf/winfs-injector/tile"
+)
+
+// ReleaseEditor adds any bosh release to a tile, or removes one from it, the
+// way Application injects the windowsfs release.
+type ReleaseEditor struct {
+	injector injector
+	zipper   zipper
+}
+
+func NewReleaseEditor(injector injector, zipper zipper) ReleaseEditor {
+	return ReleaseEditor{
+		injector: injector,
+		zipper:   zipper,
+	}
+}
+
+// AddRelease copies the release tarball into the tile, named after the name
+// and version in its release.MF, and lists it in the product metadata. The
+// tarball is verified before anything is changed, and the file of another
+// version of the release that the metadata listed is only removed from the
+// tile once the edited metadata is valid.
+func (e ReleaseEditor) AddRelease(inputTile, outputTile, releaseTarball, workingDir string) error {
+	if inputTile == "" {
+		return errors.New("--tile is required")
+	}
+
+	if releaseTarball == "" {
+		return errors.New("--release is required")
+	}
+
+	manifest, err := release.ReadManifest(releaseTarball)
+	if err != nil {
+		return err
+	}
+
+	_, err = release.Verify(releaseTarball, release.Expectations{Name: manifest.Name, Version: manifest.Version})
+	if err != nil {
+		return fmt.Errorf("release tarball failed verification: %s", err)
+	}
+
+	extractedTileDir := filepath.Join(workingDir, "extracted-tile")
+	if err := e.zipper.Unzip(inputTile, extractedTileDir); err != nil {
+		return err
+	}
+
+	metadata, err := e.injector.ReadMetadata(extractedTileDir)
+	if err != nil {
+		return err
+	}
+
+	fileName := fmt.Sprintf("%s-%s.tgz", manifest.Name, manifest.Version)
+
+	sha1Hash := sha1.New()
+	if _, err := copyFile(releaseTarball, filepath.Join(extractedTileDir, "releases", fileName), sha1Hash); err != nil {
+		return err
+	}
+
+	err = e.injector.AddReleaseToMetadata(tile.Release{
+		Name:    manifest.Name,
+		File:    fileName,
+		Version: manifest.Version,
+		SHA1:    hex.EncodeToString(sha1Hash.Sum(nil)),
+	}, extractedTileDir)
+	if err != nil {
+		return err
+	}
+
+	if err := e.injector.ValidateMetadata(extractedTileDir); err != nil {
+		return err
+	}
+
+	for _, listed := range metadata.Releases {
+		if listed.Name == manifest.Name && listed.File != "" && listed.File != fileName {
+			if err := removeAll(filepath.Join(extractedTileDir, "releases", listed.File)); err != nil {
+				return err
+			}
+			fmt.Printf("Replaced release %s version %s\n", listed.Name, listed.Version)
+		}
+	}
+
+	if err := e.zipper.Zip(extractedTileDir, e.outputTile(inputTile, outputTile)); err != nil {
+		return err
+	}
+
+	fmt.Printf("Added release %s version %s\n", manifest.Name, manifest.Version)
+	return nil
+}
+
+// RemoveRelease removes the release with the name from the product metadata
+// of the tile, along with its file.
+func (e ReleaseEditor) RemoveRelease(inputTile, outputTile, releaseName, workingDir string) error {
+	if inputTile == "" {
+		return errors.New("--tile is required")
+	}
+
+	if releaseName == "" {
+		return errors.New("--release is required")
+	}
+
+	extractedTileDir := filepath.Join(workingDir, "extracted-tile")
+	if err := e.zipper.Unzip(inputTile, extractedTileDir); err != nil {
+		return err
+	}
+
+	removed, err := e.injector.RemoveReleaseFromMetadata(releaseName, extractedTileDir)
+	if err != nil {
+		return err
+	}
+
+	if removed.File != "" {
+		if err := removeAll(filepath.Join(extractedTileDir, "releases", removed.File)); err != nil {
+			return err
+		}
+	}
+
+	if err := e.injector.ValidateMetadata(extractedTileDir); err != nil {
+		return err
+	}
+
+	if err := e.zipper.Zip(extractedTileDir, e.outputTile(inputTile, outputTile)); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed release %s version %s\n", removed.Name, removed.Version)
+	return nil
+}
+
+// outputTile returns where the edited tile is written, which defaults to the
+// input tile.
+func (e ReleaseEditor) outputTile(inputTile, outputTile string) string {
+	if outputTile == "" {
+		return inputTile
+	}
+	return outputTile
+}
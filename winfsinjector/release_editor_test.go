@@ -0,0 +1,163 @@
+package winfsinjector_test
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/winfs-injector/tile"
+	"github.com/pivotal-cf/winfs-injector/winfsinjector"
+	"github.com/pivotal-cf/winfs-injector/winfsinjector/fakes"
+)
+
+var _ = Describe("ReleaseEditor", func() {
+	var (
+		fakeInjector *fakes.Injector
+		fakeZipper   *fakes.Zipper
+
+		workingDir       string
+		extractedTileDir string
+		editor           winfsinjector.ReleaseEditor
+	)
+
+	BeforeEach(func() {
+		fakeInjector = new(fakes.Injector)
+		fakeZipper = new(fakes.Zipper)
+
+		var err error
+		workingDir, err = ioutil.TempDir("", "")
+		Expect(err).NotTo(HaveOccurred())
+
+		extractedTileDir = filepath.Join(workingDir, "extracted-tile")
+		Expect(os.MkdirAll(filepath.Join(extractedTileDir, "releases"), 0755)).To(Succeed())
+
+		editor = winfsinjector.NewReleaseEditor(fakeInjector, fakeZipper)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workingDir)).To(Succeed())
+	})
+
+	Describe("AddRelease", func() {
+		var releaseTarball string
+
+		BeforeEach(func() {
+			releaseTarball = writeReleaseTarball(workingDir, "monitoring-agent", "1.2.3")
+		})
+
+		It("copies the release into the tile and lists it in the metadata", func() {
+			err := editor.AddRelease("input.pivotal", "output.pivotal", releaseTarball, workingDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			inputTile, dir := fakeZipper.UnzipArgsForCall(0)
+			Expect(inputTile).To(Equal("input.pivotal"))
+			Expect(dir).To(Equal(extractedTileDir))
+
+			copied := filepath.Join(extractedTileDir, "releases", "monitoring-agent-1.2.3.tgz")
+			Expect(mustReadFile(copied)).To(Equal(mustReadFile(releaseTarball)))
+
+			release, dir := fakeInjector.AddReleaseToMetadataArgsForCall(0)
+			Expect(release).To(Equal(tile.Release{
+				Name:    "monitoring-agent",
+				File:    "monitoring-agent-1.2.3.tgz",
+				Version: "1.2.3",
+				SHA1:    fmt.Sprintf("%x", sha1.Sum(mustReadFile(releaseTarball))),
+			}))
+			Expect(dir).To(Equal(extractedTileDir))
+
+			Expect(fakeInjector.ValidateMetadataCallCount()).To(Equal(1))
+			dir, outputTile := fakeZipper.ZipArgsForCall(0)
+			Expect(dir).To(Equal(extractedTileDir))
+			Expect(outputTile).To(Equal("output.pivotal"))
+		})
+
+		It("rewrites the input tile when no output tile is given", func() {
+			Expect(editor.AddRelease("input.pivotal", "", releaseTarball, workingDir)).To(Succeed())
+
+			_, outputTile := fakeZipper.ZipArgsForCall(0)
+			Expect(outputTile).To(Equal("input.pivotal"))
+		})
+
+		It("removes the file of the version it replaces", func() {
+			oldFile := filepath.Join(extractedTileDir, "releases", "monitoring-agent-1.2.2.tgz")
+			Expect(ioutil.WriteFile(oldFile, []byte("old"), 0644)).To(Succeed())
+			fakeInjector.ReadMetadataReturns(tile.Metadata{
+				Releases: []tile.Release{{Name: "monitoring-agent", File: "monitoring-agent-1.2.2.tgz", Version: "1.2.2"}},
+			}, nil)
+
+			Expect(editor.AddRelease("input.pivotal", "output.pivotal", releaseTarball, workingDir)).To(Succeed())
+
+			Expect(oldFile).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(extractedTileDir, "releases", "monitoring-agent-1.2.3.tgz")).To(BeAnExistingFile())
+		})
+
+		It("does not zip the tile when the metadata does not take the release", func() {
+			fakeInjector.AddReleaseToMetadataReturns(errors.New("conflict"))
+
+			err := editor.AddRelease("input.pivotal", "output.pivotal", releaseTarball, workingDir)
+			Expect(err).To(MatchError("conflict"))
+			Expect(fakeZipper.ZipCallCount()).To(Equal(0))
+		})
+
+		It("verifies the release tarball before it unzips the tile", func() {
+			Expect(ioutil.WriteFile(releaseTarball, []byte("not a tarball"), 0644)).To(Succeed())
+
+			err := editor.AddRelease("input.pivotal", "output.pivotal", releaseTarball, workingDir)
+			Expect(err).To(HaveOccurred())
+			Expect(fakeZipper.UnzipCallCount()).To(Equal(0))
+			Expect(fakeZipper.ZipCallCount()).To(Equal(0))
+		})
+
+		It("keeps the file of the version it would replace when the edited metadata is invalid", func() {
+			oldFile := filepath.Join(extractedTileDir, "releases", "monitoring-agent-1.2.2.tgz")
+			Expect(ioutil.WriteFile(oldFile, []byte("old"), 0644)).To(Succeed())
+			fakeInjector.ReadMetadataReturns(tile.Metadata{
+				Releases: []tile.Release{{Name: "monitoring-agent", File: "monitoring-agent-1.2.2.tgz", Version: "1.2.2"}},
+			}, nil)
+			fakeInjector.ValidateMetadataReturns(errors.New("invalid metadata"))
+
+			err := editor.AddRelease("input.pivotal", "output.pivotal", releaseTarball, workingDir)
+			Expect(err).To(MatchError("invalid metadata"))
+			Expect(oldFile).To(BeAnExistingFile())
+			Expect(fakeZipper.ZipCallCount()).To(Equal(0))
+		})
+
+		It("requires a release tarball", func() {
+			err := editor.AddRelease("input.pivotal", "output.pivotal", "", workingDir)
+			Expect(err).To(MatchError("--release is required"))
+		})
+	})
+
+	Describe("RemoveRelease", func() {
+		It("removes the release from the metadata and its file from the tile", func() {
+			releaseFile := filepath.Join(extractedTileDir, "releases", "monitoring-agent-1.2.3.tgz")
+			Expect(ioutil.WriteFile(releaseFile, []byte("release"), 0644)).To(Succeed())
+			fakeInjector.RemoveReleaseFromMetadataReturns(tile.Release{Name: "monitoring-agent", File: "monitoring-agent-1.2.3.tgz", Version: "1.2.3"}, nil)
+
+			err := editor.RemoveRelease("input.pivotal", "output.pivotal", "monitoring-agent", workingDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			name, dir := fakeInjector.RemoveReleaseFromMetadataArgsForCall(0)
+			Expect(name).To(Equal("monitoring-agent"))
+			Expect(dir).To(Equal(extractedTileDir))
+			Expect(releaseFile).NotTo(BeAnExistingFile())
+
+			Expect(fakeInjector.ValidateMetadataCallCount()).To(Equal(1))
+			_, outputTile := fakeZipper.ZipArgsForCall(0)
+			Expect(outputTile).To(Equal("output.pivotal"))
+		})
+
+		It("does not zip the tile when the metadata does not list the release", func() {
+			fakeInjector.RemoveReleaseFromMetadataReturns(tile.Release{}, errors.New("product metadata does not list release monitoring-agent"))
+
+			err := editor.RemoveRelease("input.pivotal", "output.pivotal", "monitoring-agent", workingDir)
+			Expect(err).To(MatchError("product metadata does not list release monitoring-agent"))
+			Expect(fakeZipper.ZipCallCount()).To(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,108 @@
+package winfsinjector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pivotal-cf/winfs-injector/image"
+	"github.com/pivotal-cf/winfs-injector/tile"
+)
+
+// stemcellOSPrefix starts the os of Windows stemcells, which goes on with the
+// Windows release their VMs run. Windows containers only run on hosts of their
+// own build.
+const stemcellOSPrefix = "windows"
+
+// stemcellVersionPattern matches the stemcell versions of criteria that can
+// be checked: an exact version such as 2019.41, or a pessimistic constraint
+// such as ~> 2019.41, which stays on the Windows release the version starts
+// with.
+var stemcellVersionPattern = regexp.MustCompile(`^(?:~>\s*)?(\d+)(?:\.\d+)*$`)
+
+// StemcellMismatchError tells that the rootfs image is built for another
+// Windows build than the stemcells the tile runs on.
+type StemcellMismatchError struct {
+	Image         string
+	ImageBuild    string
+	Criteria      tile.StemcellCriteria
+	StemcellBuild string
+}
+
+func (e StemcellMismatchError) Error() string {
+	return fmt.Sprintf("rootfs image %s is built for %s, but the tile runs on stemcell %s version %s, which is %s",
+		e.Image, describeBuild(e.ImageBuild), e.Criteria.OS, e.Criteria.Version, describeBuild(e.StemcellBuild))
+}
+
+// checkStemcell checks that the rootfs image, built for the Windows build,
+// runs on the stemcells the criteria select. Both the os of the criteria and
+// a version named after a Windows release, such as 2019.41, determine the
+// build of the stemcells; criteria that determine none are not checked.
+// Versions other than an exact one or a ~> constraint are refused, as the
+// Windows releases they select are not known.
+func checkStemcell(criteria *tile.StemcellCriteria, imageRef, imageBuild string) error {
+	if criteria == nil || imageBuild == "" {
+		return nil
+	}
+
+	line, err := stemcellLine(criteria.Version)
+	if err != nil {
+		return err
+	}
+
+	builds := []string{
+		stemcellBuild(criteria.OS),
+		image.WindowsBuildForTag(line),
+	}
+	for _, build := range builds {
+		if build != "" && build != imageBuild {
+			return StemcellMismatchError{
+				Image:         imageRef,
+				ImageBuild:    imageBuild,
+				Criteria:      *criteria,
+				StemcellBuild: build,
+			}
+		}
+	}
+	return nil
+}
+
+// stemcellLine returns the Windows release the stemcell version starts with,
+// or an empty string when the criteria have no version.
+func stemcellLine(version string) (string, error) {
+	version = strings.TrimSpace(version)
+	if version == "" {
+		return "", nil
+	}
+
+	matches := stemcellVersionPattern.FindStringSubmatch(version)
+	if matches == nil {
+		return "", fmt.Errorf("stemcell version %q is not supported: expected an exact version such as 2019.41 or a constraint such as ~> 2019.41", version)
+	}
+	return matches[1], nil
+}
+
+// stemcellBuild returns the Windows build of the stemcell os, or an empty
+// string when the os does not name a known Windows release.
+func stemcellBuild(os string) string {
+	if !strings.HasPrefix(os, stemcellOSPrefix) {
+		return ""
+	}
+	return image.WindowsBuilds[strings.TrimPrefix(os, stemcellOSPrefix)]
+}
+
+// describeBuild names the Windows build along with the stemcell os it
+// belongs to, when there is one. Of the releases sharing a build, such as 1809
+// and 2019, the stemcells are named after the latest.
+func describeBuild(build string) string {
+	latest := ""
+	for release, releaseBuild := range image.WindowsBuilds {
+		if releaseBuild == build && release > latest {
+			latest = release
+		}
+	}
+	if latest == "" {
+		return fmt.Sprintf("Windows build %s", build)
+	}
+	return fmt.Sprintf("%s%s (Windows build %s)", stemcellOSPrefix, latest, build)
+}